@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// Events published by the watchdog.
+const EventBuildStalled = "build.stalled"
+
+type activeBuild struct {
+	lastOutput time.Time
+	process    *os.Process
+}
+
+// activeBuilds tracks builds that have started but not yet finished, and
+// the reason for aborting any build, running or still queued, that should
+// stop early.
+var activeBuilds = struct {
+	sync.Mutex
+	builds  map[string]*activeBuild
+	aborted map[string]error
+}{builds: make(map[string]*activeBuild), aborted: make(map[string]error)}
+
+func trackActiveBuild(e Event) {
+	activeBuilds.Lock()
+	defer activeBuilds.Unlock()
+	switch e.Type {
+	case EventBuildStarted:
+		activeBuilds.builds[e.BuildId] = &activeBuild{lastOutput: time.Now()}
+	case EventBuildSucceeded, EventBuildFailed:
+		delete(activeBuilds.builds, e.BuildId)
+		delete(activeBuilds.aborted, e.BuildId)
+	}
+}
+
+func isBuildActive(buildId string) bool {
+	activeBuilds.Lock()
+	defer activeBuilds.Unlock()
+	_, ok := activeBuilds.builds[buildId]
+	return ok
+}
+
+// touchBuild records that buildId just produced output.
+func touchBuild(buildId string) {
+	activeBuilds.Lock()
+	defer activeBuilds.Unlock()
+	if b, ok := activeBuilds.builds[buildId]; ok {
+		b.lastOutput = time.Now()
+	}
+}
+
+func setBuildProcess(buildId string, p *os.Process) {
+	activeBuilds.Lock()
+	defer activeBuilds.Unlock()
+	if b, ok := activeBuilds.builds[buildId]; ok {
+		b.process = p
+		// The build may have been aborted while the process was starting.
+		if p != nil && activeBuilds.aborted[buildId] != nil {
+			killProcessGroup(p)
+		}
+	}
+}
+
+// abortBuild stops buildId with err as its failure: a running build has its
+// current command killed, a queued one fails as soon as it starts.
+func abortBuild(buildId string, err error) {
+	activeBuilds.Lock()
+	defer activeBuilds.Unlock()
+	if activeBuilds.aborted[buildId] != nil {
+		return
+	}
+	activeBuilds.aborted[buildId] = err
+	if b, ok := activeBuilds.builds[buildId]; ok && b.process != nil {
+		killProcessGroup(b.process)
+	}
+}
+
+// abortError returns why buildId was aborted, if it was.
+func abortError(buildId string) error {
+	activeBuilds.Lock()
+	defer activeBuilds.Unlock()
+	return activeBuilds.aborted[buildId]
+}
+
+// runCommand runs cmd as a step of buildId, streaming its output to the
+// build log and tracking its process group so the watchdog can kill it.
+func runCommand(buildId string, cmd *exec.Cmd) error {
+	if err := abortError(buildId); err != nil {
+		return err
+	}
+	out := &LogStreamer{buildId: buildId}
+	cmd.Stdout = out
+	cmd.Stderr = out
+	setProcessGroup(cmd)
+	start := time.Now()
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	setBuildProcess(buildId, cmd.Process)
+	err := cmd.Wait()
+	setBuildProcess(buildId, nil)
+	out.Flush()
+	recordResourceUsage(buildId, cmd.ProcessState, time.Since(start))
+	if aborted := abortError(buildId); aborted != nil {
+		return aborted
+	}
+	return err
+}
+
+// checkStalledBuilds kills the processes of builds that have been silent
+// for longer than timeout. The build then fails with the stall as its error.
+func checkStalledBuilds(timeout time.Duration) {
+	var stalled []string
+	activeBuilds.Lock()
+	for buildId, b := range activeBuilds.builds {
+		if activeBuilds.aborted[buildId] == nil && time.Since(b.lastOutput) >= timeout {
+			stalled = append(stalled, buildId)
+		}
+	}
+	activeBuilds.Unlock()
+
+	for _, buildId := range stalled {
+		abortBuild(buildId, fmt.Errorf("build stalled: no output for %s", timeout))
+		log.Printf("Build %s stalled with no output for %s, killed", buildId, timeout)
+		bus.Publish(Event{Type: EventBuildStalled, BuildId: buildId})
+	}
+}
+
+func runWatchdog(timeout time.Duration) {
+	for range time.Tick(time.Minute) {
+		checkStalledBuilds(timeout)
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// adminToken gates the admin endpoints that change the host or what
+// builds may do, which are disabled unless ADMIN_TOKEN is set.
+func adminToken() string {
+	return os.Getenv("ADMIN_TOKEN")
+}
+
+// authorizeAdmin checks the request carries the admin token as a bearer
+// token.
+func authorizeAdmin(w http.ResponseWriter, r *http.Request) bool {
+	token := adminToken()
+	if token == "" {
+		http.Error(w, "Admin endpoint is disabled; set ADMIN_TOKEN to enable it", http.StatusNotFound)
+		return false
+	}
+	given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+		http.Error(w, "Invalid admin token", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// dockerfileBaseImages returns the registry images a Dockerfile builds
+// FROM. Build stages, scratch, images chosen by build args and images
+// already pinned to a digest are skipped, since none of them can move.
+func dockerfileBaseImages(path string) []string {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	var images []string
+	for _, image := range parseFromImages(f) {
+		if !strings.Contains(image, "@") {
+			images = append(images, image)
+		}
+	}
+	return images
+}
+
+// dockerfileFromImages returns every image a Dockerfile builds FROM,
+// including those pinned to a digest, for policy checks. Images chosen by
+// build args are resolved with buildArgs and the defaults of the ARGs
+// before the first FROM, as buildx would; those that can't be resolved
+// are returned as written, with their $ references.
+func dockerfileFromImages(path string, buildArgs map[string]string) []string {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	return scanFromImages(f, buildArgs, true)
+}
+
+// parseFromImages reads the FROM images of the Dockerfile in r as
+// written, skipping build stages, scratch and images chosen by build args.
+func parseFromImages(r io.Reader) []string {
+	return scanFromImages(r, nil, false)
+}
+
+// scanFromImages reads the FROM images of the Dockerfile in r, leaving
+// out build stages and scratch. Images chosen by build args are resolved
+// when resolve is set, and skipped otherwise.
+func scanFromImages(r io.Reader, buildArgs map[string]string, resolve bool) []string {
+	// Only ARGs before the first FROM are in scope for FROM lines.
+	args := make(map[string]string)
+	declared := make(map[string]bool)
+	inStage := false
+	stages := make(map[string]bool)
+	seen := make(map[string]bool)
+	var images []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		if !inStage && strings.EqualFold(fields[0], "ARG") {
+			for _, arg := range fields[1:] {
+				name, value, hasValue := strings.Cut(arg, "=")
+				declared[name] = true
+				if v, ok := buildArgs[name]; ok {
+					args[name] = v
+				} else if hasValue {
+					args[name] = strings.Trim(value, `"'`)
+				}
+			}
+			continue
+		}
+		if !strings.EqualFold(fields[0], "FROM") {
+			continue
+		}
+		inStage = true
+		fields = fields[1:]
+		for len(fields) > 0 && strings.HasPrefix(fields[0], "--") {
+			fields = fields[1:]
+		}
+		if len(fields) == 0 {
+			continue
+		}
+		image := fields[0]
+		if resolve && strings.Contains(image, "$") {
+			if resolved, ok := expandArgs(image, args, declared); ok {
+				image = resolved
+			}
+		}
+		isStage := stages[strings.ToLower(image)]
+		if len(fields) >= 3 && strings.EqualFold(fields[1], "AS") {
+			stages[strings.ToLower(fields[2])] = true
+		}
+		if isStage || image == "scratch" || image == "" || strings.Contains(image, "$") && !resolve || seen[image] {
+			continue
+		}
+		seen[image] = true
+		images = append(images, image)
+	}
+	return images
+}
+
+// expandArgs substitutes $NAME, ${NAME}, ${NAME:-default} and
+// ${NAME:+alternative} in s with args. It fails if s refers to an ARG
+// that was not declared or has no value.
+func expandArgs(s string, args map[string]string, declared map[string]bool) (string, bool) {
+	ok := true
+	expanded := os.Expand(s, func(name string) string {
+		if n, def, found := strings.Cut(name, ":-"); found {
+			if v := args[n]; v != "" {
+				return v
+			}
+			return def
+		}
+		if n, alt, found := strings.Cut(name, ":+"); found {
+			if args[n] != "" {
+				return alt
+			}
+			return ""
+		}
+		v, set := args[name]
+		if !declared[name] || !set {
+			ok = false
+		}
+		return v
+	})
+	return expanded, ok
+}
+
+// saveBaseImages replaces the base images repoURL builds from. Digests of
+// new ones are filled in by the next watcher pass.
+func saveBaseImages(repoURL string, images []string) error {
+	query := "DELETE FROM base_images WHERE repo_url = ?"
+	args := []interface{}{repoURL}
+	if len(images) > 0 {
+		query += " AND image NOT IN (?" + strings.Repeat(", ?", len(images)-1) + ")"
+		for _, image := range images {
+			args = append(args, image)
+		}
+	}
+	if _, err := db.Exec(query, args...); err != nil {
+		return err
+	}
+	for _, image := range images {
+		if _, err := db.Exec("INSERT OR IGNORE INTO base_images (repo_url, image, digest) VALUES (?, ?, '')", repoURL, image); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// registryDigest returns the digest an image tag currently points to in
+// its registry.
+func registryDigest(image string) (string, error) {
+	out, err := exec.Command("docker", "buildx", "imagetools", "inspect", image, "--format", "{{.Manifest.Digest}}").Output()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// checkBaseImages looks up the current digest of every watched base image
+// and rebuilds the repositories whose base moved since it was last seen.
+func checkBaseImages() {
+	if buildsPaused() {
+		return
+	}
+	rows, err := db.Query("SELECT repo_url, image, digest FROM base_images ORDER BY repo_url, image")
+	if err != nil {
+		log.Printf("Error getting base images: %v", err)
+		return
+	}
+	type watched struct{ repo, image, digest string }
+	var all []watched
+	for rows.Next() {
+		var w watched
+		if err := rows.Scan(&w.repo, &w.image, &w.digest); err != nil {
+			log.Printf("Error reading base image: %v", err)
+			continue
+		}
+		all = append(all, w)
+	}
+	rows.Close()
+
+	digests := make(map[string]string)
+	moved := make(map[string][]watched) // repo -> its base images that moved, with their new digests
+	var repos []string
+	for _, w := range all {
+		digest, ok := digests[w.image]
+		if !ok {
+			if digest, err = registryDigest(w.image); err != nil {
+				log.Printf("Error resolving digest of %s: %v", w.image, err)
+			}
+			digests[w.image] = digest
+		}
+		if digest == "" || digest == w.digest {
+			continue
+		}
+		// The first sighting only records the digest.
+		if w.digest == "" {
+			saveBaseImageDigest(w.repo, w.image, digest)
+			continue
+		}
+		if _, ok := moved[w.repo]; !ok {
+			repos = append(repos, w.repo)
+		}
+		moved[w.repo] = append(moved[w.repo], watched{w.repo, w.image, digest})
+	}
+
+	// New digests are only stored once the rebuild is queued, so a
+	// rebuild that could not be queued is retried on the next check.
+	for _, repoURL := range repos {
+		image := moved[repoURL][0].image
+		req := BuildRequest{RepoUrl: repoURL, Trigger: &Trigger{Source: TriggerBaseImage, BaseImage: image}}
+		if err := validateBuildRequest(&req); err != nil {
+			log.Printf("Not rebuilding %s for updated %s: %v", repoURL, image, err)
+			continue
+		}
+		buildId, ok := submitBuild(req)
+		if !ok {
+			log.Printf("Build queue full, not rebuilding %s for updated %s", repoURL, image)
+			continue
+		}
+		log.Printf("Triggered build %s of %s for updated base image %s", buildId, repoURL, image)
+		for _, w := range moved[repoURL] {
+			saveBaseImageDigest(w.repo, w.image, w.digest)
+		}
+	}
+}
+
+func saveBaseImageDigest(repoURL, image, digest string) {
+	if _, err := db.Exec("UPDATE base_images SET digest = ? WHERE repo_url = ? AND image = ?", digest, repoURL, image); err != nil {
+		log.Printf("Error updating base image digest: %v", err)
+	}
+}
+
+// runBaseImageWatcher checks base images every interval.
+func runBaseImageWatcher(interval time.Duration) {
+	for range time.Tick(interval) {
+		checkBaseImages()
+	}
+}
+
+// pinBaseImagesEnabled reports whether builds should pin their base
+// images to the digests they resolve to, set by PIN_BASE_IMAGES.
+func pinBaseImagesEnabled() bool {
+	return os.Getenv("PIN_BASE_IMAGES") != ""
+}
+
+// pinBaseImages rewrites the FROM lines of the Dockerfile at path to pin
+// images to their current registry digests, returning what each was
+// pinned to.
+func pinBaseImages(buildId, path string, images []string) (map[string]string, error) {
+	pins := make(map[string]string)
+	for _, image := range images {
+		digest, err := registryDigest(image)
+		if err != nil {
+			return nil, fmt.Errorf("resolving digest of %s: %v", image, err)
+		}
+		pins[image] = digest
+		logLine(buildId, "==> pinned "+image+" to "+digest)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	lines := strings.Split(string(data), "\n")
+	for i, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || !strings.EqualFold(fields[0], "FROM") {
+			continue
+		}
+		for _, field := range fields[1:] {
+			if strings.HasPrefix(field, "--") {
+				continue
+			}
+			if digest, ok := pins[field]; ok {
+				lines[i] = strings.Replace(line, field, field+"@"+digest, 1)
+			}
+			break
+		}
+	}
+	return pins, os.WriteFile(path, []byte(strings.Join(lines, "\n")), 0644)
+}
+
+func saveBaseDigests(buildId string, images []BuiltImage) error {
+	for _, built := range images {
+		for image, digest := range built.BaseDigests {
+			if _, err := db.Exec("INSERT OR REPLACE INTO build_base_digests (build_id, image, digest) VALUES (?, ?, ?)", buildId, image, digest); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// BaseAdvisory lists known vulnerabilities of a base image digest.
+type BaseAdvisory struct {
+	Digest string   `json:"digest"`
+	CVEs   []string `json:"cves"`
+}
+
+// VulnerableBuild is a build that was pinned to a base image digest with
+// known vulnerabilities.
+type VulnerableBuild struct {
+	BuildId string   `json:"buildId"`
+	RepoUrl string   `json:"repoUrl"`
+	Image   string   `json:"image"`
+	Digest  string   `json:"digest"`
+	CVEs    []string `json:"cves"`
+}
+
+func saveBaseAdvisory(advisory BaseAdvisory) error {
+	cves, err := encodeJSONColumn(advisory.CVEs)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("INSERT OR REPLACE INTO base_advisories (digest, cves) VALUES (?, ?)", advisory.Digest, cves)
+	return err
+}
+
+func deleteBaseAdvisory(digest string) error {
+	_, err := db.Exec("DELETE FROM base_advisories WHERE digest = ?", digest)
+	return err
+}
+
+func setBaseAdvisoryHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	var advisory BaseAdvisory
+	if err := json.NewDecoder(r.Body).Decode(&advisory); err != nil || advisory.Digest == "" {
+		http.Error(w, "Request must contain digest and cves", http.StatusBadRequest)
+		return
+	}
+	if len(advisory.CVEs) == 0 {
+		if err := deleteBaseAdvisory(advisory.Digest); err != nil {
+			http.Error(w, "Could not clear advisory", http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(advisory)
+		return
+	}
+	if err := saveBaseAdvisory(advisory); err != nil {
+		http.Error(w, "Could not save advisory", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(advisory)
+}
+
+// getVulnerableBuilds lists builds pinned to base image digests that have
+// advisories, limited to one build if buildId is set.
+func getVulnerableBuilds(buildId string) ([]VulnerableBuild, error) {
+	query := `SELECT d.build_id, COALESCE(b.repo_url, ''), d.image, d.digest, a.cves
+        FROM build_base_digests d
+        JOIN base_advisories a ON a.digest = d.digest
+        LEFT JOIN builds b ON b.id = d.build_id`
+	var args []interface{}
+	if buildId != "" {
+		query += " WHERE d.build_id = ?"
+		args = append(args, buildId)
+	}
+	rows, err := db.Query(query+" ORDER BY d.build_id, d.image", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	builds := []VulnerableBuild{}
+	for rows.Next() {
+		var b VulnerableBuild
+		var cves string
+		if err := rows.Scan(&b.BuildId, &b.RepoUrl, &b.Image, &b.Digest, &cves); err != nil {
+			return nil, err
+		}
+		if err := decodeJSONColumn(cves, &b.CVEs); err != nil {
+			return nil, err
+		}
+		builds = append(builds, b)
+	}
+	return builds, rows.Err()
+}
+
+// vulnerableBuildsHandler lists builds pinned to base image digests that
+// have advisories.
+func vulnerableBuildsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	builds, err := getVulnerableBuilds("")
+	if err != nil {
+		http.Error(w, "Could not get builds", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(builds)
+}
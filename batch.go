@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+type BatchRequest struct {
+	Builds []BuildRequest `json:"builds"`
+}
+
+type BatchResponse struct {
+	BatchId  string   `json:"batchId"`
+	BuildIds []string `json:"buildIds"`
+}
+
+type BatchBuild struct {
+	BuildId string `json:"buildId"`
+	RepoUrl string `json:"repoUrl"`
+	Status  string `json:"status"`
+	Error   string `json:"error,omitempty"`
+}
+
+type BatchStatus struct {
+	BatchId string       `json:"batchId"`
+	Status  string       `json:"status"`
+	Builds  []BatchBuild `json:"builds"`
+}
+
+// saveBatch records every build of a batch in one transaction so a batch
+// is either fully queued or not at all.
+func saveBatch(batchId string, buildIds []string, reqs []BuildRequest) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	for i, req := range reqs {
+		_, err := tx.Exec("INSERT INTO batch_builds (batch_id, build_id, repo_url, status) VALUES (?, ?, ?, 'queued')", batchId, buildIds[i], req.RepoUrl)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func getBatch(batchId string) ([]BatchBuild, error) {
+	rows, err := db.Query("SELECT build_id, repo_url, status, error FROM batch_builds WHERE batch_id = ? ORDER BY rowid", batchId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var builds []BatchBuild
+	for rows.Next() {
+		var b BatchBuild
+		if err := rows.Scan(&b.BuildId, &b.RepoUrl, &b.Status, &b.Error); err != nil {
+			return nil, err
+		}
+		builds = append(builds, b)
+	}
+	return builds, rows.Err()
+}
+
+// combinedStatus reduces the statuses of a batch's builds to one: failed
+// if any failed, succeeded once all succeeded, otherwise still running.
+func combinedStatus(builds []BatchBuild) string {
+	status := "succeeded"
+	for _, b := range builds {
+		switch b.Status {
+		case "failed":
+			return "failed"
+		case "queued", "running":
+			status = "running"
+		}
+	}
+	return status
+}
+
+// recordBatchStatus keeps batch_builds in step with the lifecycle of the
+// builds it tracks; builds outside a batch match no rows.
+func recordBatchStatus(e Event) {
+	var status, errMsg string
+	switch e.Type {
+	case EventBuildStarted:
+		status = "running"
+	case EventBuildSucceeded:
+		status = "succeeded"
+	case EventBuildFailed:
+		status = "failed"
+		errMsg = redact(e.Err.Error())
+	default:
+		return
+	}
+	if _, err := db.Exec("UPDATE batch_builds SET status = ?, error = ? WHERE build_id = ?", status, errMsg, e.BuildId); err != nil {
+		log.Printf("Error updating batch status: %v", err)
+	}
+}
+
+func batchBuildHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	var req BatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Builds) == 0 {
+		http.Error(w, "Request must contain at least one build", http.StatusBadRequest)
+		return
+	}
+
+	if draining.Load() {
+		rejectDraining(w)
+		return
+	}
+	for i := range req.Builds {
+		if err := validateBuildRequest(&req.Builds[i]); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if !queue.ReserveN(len(req.Builds)) {
+		rejectQueueFull(w)
+		return
+	}
+
+	batchId := uuid.New().String()
+	buildIds := make([]string, len(req.Builds))
+	for i := range req.Builds {
+		buildIds[i] = uuid.New().String()
+	}
+	if err := saveBatch(batchId, buildIds, req.Builds); err != nil {
+		log.Printf("Error saving batch: %v", err)
+		queue.ReleaseN(len(req.Builds))
+		http.Error(w, "Could not create batch", http.StatusInternalServerError)
+		return
+	}
+
+	for i, buildReq := range req.Builds {
+		buildId, buildReq := buildIds[i], buildReq
+		buildReq.Trigger = &Trigger{Source: TriggerBatch, Client: r.RemoteAddr, BatchId: batchId}
+		joinConcurrencyGroup(buildId, buildReq)
+		bus.Publish(Event{Type: EventBuildQueued, BuildId: buildId, RepoUrl: buildReq.RepoUrl})
+		go runQueued(buildId, buildReq)
+	}
+
+	json.NewEncoder(w).Encode(BatchResponse{BatchId: batchId, BuildIds: buildIds})
+}
+
+func batchStatusHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	batchId := mux.Vars(r)["batchId"]
+	builds, err := getBatch(batchId)
+	if err != nil {
+		http.Error(w, "Could not get batch details", http.StatusInternalServerError)
+		return
+	}
+	if len(builds) == 0 {
+		http.Error(w, "Batch not found", http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(BatchStatus{BatchId: batchId, Status: combinedStatus(builds), Builds: builds})
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// bitbucketPush holds the parts of a Bitbucket Cloud repo:push event the
+// server uses.
+type bitbucketPush struct {
+	Repository struct {
+		FullName string `json:"full_name"`
+		Links    struct {
+			HTML struct {
+				Href string `json:"href"`
+			} `json:"html"`
+		} `json:"links"`
+	} `json:"repository"`
+	Push struct {
+		Changes []struct {
+			// New is the state of the ref after the push, null when it
+			// was deleted.
+			New *struct {
+				Type   string `json:"type"`
+				Name   string `json:"name"`
+				Target struct {
+					Hash    string    `json:"hash"`
+					Message string    `json:"message"`
+					Date    time.Time `json:"date"`
+					Author  struct {
+						// Raw is "Name <email>".
+						Raw string `json:"raw"`
+					} `json:"author"`
+				} `json:"target"`
+			} `json:"new"`
+		} `json:"changes"`
+	} `json:"push"`
+}
+
+// repoURLs lists the clone URLs a Bitbucket repository may be
+// registered under.
+func (p bitbucketPush) repoURLs() []string {
+	html := strings.TrimSuffix(p.Repository.Links.HTML.Href, "/")
+	urls := []string{html}
+	if html != "" {
+		urls = append(urls, html+".git")
+	}
+	if name := p.Repository.FullName; name != "" {
+		urls = append(urls, "https://bitbucket.org/"+name+".git", "git@bitbucket.org:"+name+".git")
+	}
+	return urls
+}
+
+// parseAuthor splits a raw "Name <email>" author.
+func parseAuthor(raw string) (name, email string) {
+	name, email, ok := strings.Cut(raw, "<")
+	if !ok {
+		return strings.TrimSpace(raw), ""
+	}
+	return strings.TrimSpace(name), strings.TrimSuffix(strings.TrimSpace(email), ">")
+}
+
+// bitbucketWebhookHandler builds the configured branch of a repository
+// when Bitbucket Cloud reports a push to it.
+func bitbucketWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	body, ok := readWebhookBody(w, r)
+	if !ok {
+		return
+	}
+	var push bitbucketPush
+	if err := json.Unmarshal(body, &push); err != nil {
+		http.Error(w, "Invalid payload", http.StatusBadRequest)
+		return
+	}
+	s, err := findWebhookSettings(push.repoURLs()...)
+	if err == sql.ErrNoRows {
+		http.Error(w, "No webhook configured for repository", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Could not get webhook settings", http.StatusInternalServerError)
+		return
+	}
+	deliveryId := r.Header.Get("X-Request-UUID")
+	if !validSignature(s.Secret, body, r.Header.Get("X-Hub-Signature")) {
+		log.Printf("Rejected Bitbucket delivery %s for %s: bad signature", deliveryId, s.RepoUrl)
+		http.Error(w, "Invalid signature", http.StatusUnauthorized)
+		return
+	}
+
+	switch event := r.Header.Get("X-Event-Key"); event {
+	case "diagnostics:ping":
+		json.NewEncoder(w).Encode(WebhookResponse{Status: "pong"})
+		return
+	case "repo:push":
+	default:
+		json.NewEncoder(w).Encode(WebhookResponse{Status: WebhookIgnored, Reason: "event " + event + " is not handled"})
+		return
+	}
+
+	// One push can update several branches and tags.
+	pushed := make(map[string]PushedCommit)
+	for _, change := range push.Push.Changes {
+		if change.New == nil || change.New.Type != "branch" {
+			continue
+		}
+		target := change.New.Target
+		author, email := parseAuthor(target.Author.Raw)
+		pushed[change.New.Name] = PushedCommit{
+			ID:     target.Hash,
+			Commit: CommitInfo{Author: author, AuthorEmail: email, Message: target.Message, CommittedAt: target.Date},
+		}
+	}
+	triggerPush(w, s, "bitbucket", deliveryId, pushed)
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// DefaultBranch is the branch a repository's remote HEAD points to, which
+// builds check out when they name no branch.
+type DefaultBranch struct {
+	RepoUrl   string    `json:"repoUrl"`
+	Branch    string    `json:"branch"`
+	CheckedAt time.Time `json:"checkedAt"`
+}
+
+// detectDefaultBranch asks the remote which branch its HEAD points to.
+func detectDefaultBranch(repoURL string) (string, error) {
+	out, err := exec.Command("git", "ls-remote", "--symref", "--", repoURL, "HEAD").Output()
+	if err != nil {
+		return "", fmt.Errorf("git ls-remote: %v", err)
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		// ref: refs/heads/main	HEAD
+		ref, ok := strings.CutPrefix(line, "ref: ")
+		if !ok {
+			continue
+		}
+		ref, _, _ = strings.Cut(ref, "\t")
+		if branch, ok := strings.CutPrefix(ref, "refs/heads/"); ok {
+			return branch, nil
+		}
+	}
+	return "", fmt.Errorf("remote HEAD of %s is not a branch", redact(repoURL))
+}
+
+func saveDefaultBranch(repoURL, branch string) error {
+	_, err := db.Exec("INSERT OR REPLACE INTO default_branches (repo_url, branch, checked_at) VALUES (?, ?, ?)", repoURL, branch, time.Now().UTC())
+	return err
+}
+
+func getDefaultBranch(repoURL string) (DefaultBranch, error) {
+	b := DefaultBranch{RepoUrl: repoURL}
+	err := db.QueryRow("SELECT branch, checked_at FROM default_branches WHERE repo_url = ?", repoURL).Scan(&b.Branch, &b.CheckedAt)
+	return b, err
+}
+
+// defaultBranch returns the stored default branch of repoURL, detecting
+// and storing it the first time the repository is built.
+func defaultBranch(repoURL string) (string, error) {
+	b, err := getDefaultBranch(repoURL)
+	if err == nil {
+		return b.Branch, nil
+	}
+	if err != sql.ErrNoRows {
+		return "", err
+	}
+	branch, err := detectDefaultBranch(repoURL)
+	if err != nil {
+		return "", err
+	}
+	return branch, saveDefaultBranch(repoURL, branch)
+}
+
+// validateBranch rejects names git would not accept as a branch, or
+// would parse as an option.
+func validateBranch(branch string) error {
+	if err := exec.Command("git", "check-ref-format", "--branch", branch).Run(); err != nil {
+		return fmt.Errorf("invalid branch name %q", branch)
+	}
+	return nil
+}
+
+// validateTag rejects names git would not accept as a tag, or would parse
+// as an option.
+func validateTag(tag string) error {
+	if strings.HasPrefix(tag, "-") || exec.Command("git", "check-ref-format", "refs/tags/"+tag).Run() != nil {
+		return fmt.Errorf("invalid tag name %q", tag)
+	}
+	return nil
+}
+
+// validateRepoURL rejects repository URLs git would parse as an option,
+// such as --upload-pack=<command>.
+func validateRepoURL(repoURL string) error {
+	if strings.HasPrefix(repoURL, "-") {
+		return fmt.Errorf("invalid repository URL %q", repoURL)
+	}
+	return nil
+}
+
+// commitPattern matches full or abbreviated SHA-1 and SHA-256 commit IDs.
+var commitPattern = regexp.MustCompile(`^[0-9a-f]{7,64}$`)
+
+func validateCommit(commit string) error {
+	if !commitPattern.MatchString(commit) {
+		return fmt.Errorf("invalid commit %q: must be a hexadecimal commit ID", commit)
+	}
+	return nil
+}
+
+// refreshDefaultBranches re-detects every known repository's default
+// branch, so a rename such as master to main is picked up.
+func refreshDefaultBranches() {
+	rows, err := db.Query("SELECT repo_url, branch FROM default_branches ORDER BY repo_url")
+	if err != nil {
+		log.Printf("Error getting default branches: %v", err)
+		return
+	}
+	known := make(map[string]string)
+	var repos []string
+	for rows.Next() {
+		var repoURL, branch string
+		if err := rows.Scan(&repoURL, &branch); err == nil {
+			known[repoURL] = branch
+			repos = append(repos, repoURL)
+		}
+	}
+	rows.Close()
+
+	for _, repoURL := range repos {
+		branch, err := detectDefaultBranch(repoURL)
+		if err != nil {
+			log.Printf("Error detecting default branch of %s: %v", repoURL, err)
+			continue
+		}
+		if branch != known[repoURL] {
+			log.Printf("Default branch of %s changed from %s to %s", repoURL, known[repoURL], branch)
+		}
+		if err := saveDefaultBranch(repoURL, branch); err != nil {
+			log.Printf("Error saving default branch of %s: %v", repoURL, err)
+		}
+	}
+}
+
+func runDefaultBranchRefresher(interval time.Duration) {
+	for range time.Tick(interval) {
+		refreshDefaultBranches()
+	}
+}
+
+// defaultBranchHandler reports a repository's default branch, detecting
+// it if it is not known yet or ?refresh=true is given.
+func defaultBranchHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	repoURL := r.URL.Query().Get("repo")
+	if repoURL == "" {
+		http.Error(w, "Request must contain repo", http.StatusBadRequest)
+		return
+	}
+	if err := validateRepoURL(repoURL); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	b, err := getDefaultBranch(repoURL)
+	if err == sql.ErrNoRows || r.URL.Query().Get("refresh") == "true" {
+		var branch string
+		if branch, err = detectDefaultBranch(repoURL); err != nil {
+			http.Error(w, "Could not detect default branch: "+err.Error(), http.StatusBadGateway)
+			return
+		}
+		if err = saveDefaultBranch(repoURL, branch); err != nil {
+			http.Error(w, "Could not save default branch", http.StatusInternalServerError)
+			return
+		}
+		b, err = getDefaultBranch(repoURL)
+	}
+	if err != nil {
+		http.Error(w, "Could not get default branch", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(b)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// BuildArgSettings are the build args every build of a repository gets
+// unless its request sets them.
+type BuildArgSettings struct {
+	RepoUrl   string            `json:"repoUrl"`
+	BuildArgs map[string]string `json:"buildArgs"`
+}
+
+func validateBuildArgs(args map[string]string) error {
+	for name := range args {
+		if name == "" || strings.ContainsAny(name, "= \t\n") {
+			return fmt.Errorf("invalid build arg name %q", name)
+		}
+	}
+	return nil
+}
+
+// getDefaultBuildArgs returns the repository's default build args, or
+// sql.ErrNoRows if it has none.
+func getDefaultBuildArgs(repoURL string) (map[string]string, error) {
+	var body string
+	err := db.QueryRow("SELECT args FROM default_build_args WHERE repo_url = ?", repoURL).Scan(&body)
+	if err != nil {
+		return nil, err
+	}
+	var args map[string]string
+	err = json.Unmarshal([]byte(body), &args)
+	return args, err
+}
+
+func saveDefaultBuildArgs(repoURL string, args map[string]string) error {
+	body, err := json.Marshal(args)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("INSERT OR REPLACE INTO default_build_args (repo_url, args) VALUES (?, ?)", repoURL, string(body))
+	return err
+}
+
+// checkBuildArgsAgainstParameters rejects build args named like one of
+// the repository's declared parameters, whose values must go through
+// the parameter's type checks.
+func checkBuildArgsAgainstParameters(repoURL string, args map[string]string) error {
+	if len(args) == 0 {
+		return nil
+	}
+	params, err := getParameters(repoURL)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, p := range params {
+		if _, ok := args[p.Name]; ok {
+			return fmt.Errorf("%s is a declared parameter; set it in parameters", p.Name)
+		}
+	}
+	return nil
+}
+
+func setBuildArgsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	var settings BuildArgSettings
+	if err := json.NewDecoder(r.Body).Decode(&settings); err != nil || settings.RepoUrl == "" {
+		http.Error(w, "Request must contain repoUrl and buildArgs", http.StatusBadRequest)
+		return
+	}
+	if err := validateRepoURL(settings.RepoUrl); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validateBuildArgs(settings.BuildArgs); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := checkBuildArgsAgainstParameters(settings.RepoUrl, settings.BuildArgs); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := saveDefaultBuildArgs(settings.RepoUrl, settings.BuildArgs); err != nil {
+		http.Error(w, "Could not save build args", http.StatusInternalServerError)
+		return
+	}
+	settings.BuildArgs = redactValues(settings.BuildArgs)
+	json.NewEncoder(w).Encode(settings)
+}
+
+func getBuildArgsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	repoURL := r.URL.Query().Get("repo")
+	if err := validateRepoURL(repoURL); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	args, err := getDefaultBuildArgs(repoURL)
+	if err == sql.ErrNoRows {
+		http.Error(w, "No build args configured for repository", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Could not get build args", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(BuildArgSettings{RepoUrl: repoURL, BuildArgs: redactValues(args)})
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// StepCache is whether one Dockerfile step of a build came from cache.
+type StepCache struct {
+	Step   string `json:"step"`
+	Cached bool   `json:"cached"`
+}
+
+type CacheStats struct {
+	BuildId  string      `json:"buildId"`
+	RepoUrl  string      `json:"repoUrl"`
+	Steps    int         `json:"steps"`
+	Cached   int         `json:"cached"`
+	HitRatio float64     `json:"hitRatio"`
+	Details  []StepCache `json:"details,omitempty"`
+	Time     time.Time   `json:"time"`
+}
+
+// buildxStep matches a Dockerfile step in buildx plain progress output,
+// e.g. "#6 [build 2/4] RUN go mod download".
+var buildxStep = regexp.MustCompile(`^#(\d+) (\[[^\]]*\d+/\d+\] .*)$`)
+
+// buildxCacheStats counts the Dockerfile steps in a build log and how many
+// were cached. Each buildx invocation restarts its step numbering with a
+// "#0" line.
+func buildxCacheStats(buildId string) ([]StepCache, error) {
+	f, err := os.Open(logPath(buildId))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var steps []StepCache
+	index := make(map[string]int)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		// Drop the timestamp logLine prefixes each line with.
+		_, line, _ := strings.Cut(scanner.Text(), " ")
+		if strings.HasPrefix(line, "#0 ") {
+			index = make(map[string]int)
+			continue
+		}
+		if m := buildxStep.FindStringSubmatch(line); m != nil {
+			if _, ok := index[m[1]]; !ok {
+				index[m[1]] = len(steps)
+				steps = append(steps, StepCache{Step: m[2]})
+			}
+			continue
+		}
+		id, rest, ok := strings.Cut(line, " ")
+		if !ok || rest != "CACHED" {
+			continue
+		}
+		if i, ok := index[strings.TrimPrefix(id, "#")]; ok {
+			steps[i].Cached = true
+		}
+	}
+	return steps, scanner.Err()
+}
+
+// recordCacheStats stores the cache hit ratio of a finished build.
+func recordCacheStats(e Event) {
+	if e.Type != EventBuildSucceeded && e.Type != EventBuildFailed {
+		return
+	}
+	go func() {
+		steps, err := buildxCacheStats(e.BuildId)
+		if err != nil || len(steps) == 0 {
+			return
+		}
+		cached := 0
+		for _, s := range steps {
+			if s.Cached {
+				cached++
+			}
+		}
+		details, err := json.Marshal(steps)
+		if err == nil {
+			_, err = db.Exec("INSERT INTO build_cache_stats (build_id, repo_url, steps, cached, details) VALUES (?, ?, ?, ?, ?)",
+				e.BuildId, e.RepoUrl, len(steps), cached, string(details))
+		}
+		if err != nil {
+			log.Printf("Error recording cache stats for %s: %v", e.BuildId, err)
+		}
+	}()
+}
+
+func scanCacheStats(row rowScanner) (CacheStats, error) {
+	var stats CacheStats
+	var details string
+	err := row.Scan(&stats.BuildId, &stats.RepoUrl, &stats.Steps, &stats.Cached, &details, &stats.Time)
+	if err != nil {
+		return stats, err
+	}
+	if stats.Steps > 0 {
+		stats.HitRatio = float64(stats.Cached) / float64(stats.Steps)
+	}
+	err = decodeJSONColumn(details, &stats.Details)
+	return stats, err
+}
+
+func getCacheStats(buildId string) (CacheStats, error) {
+	return scanCacheStats(db.QueryRow("SELECT build_id, repo_url, steps, cached, details, timestamp FROM build_cache_stats WHERE build_id = ?", buildId))
+}
+
+// getCacheTrend returns the cache stats of repoURL's latest builds,
+// without their per-step details.
+func getCacheTrend(repoURL string, limit int) ([]CacheStats, error) {
+	rows, err := db.Query("SELECT build_id, repo_url, steps, cached, '', timestamp FROM build_cache_stats WHERE repo_url = ? ORDER BY timestamp DESC LIMIT ?", repoURL, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	trend := []CacheStats{}
+	for rows.Next() {
+		stats, err := scanCacheStats(rows)
+		if err != nil {
+			return nil, err
+		}
+		trend = append(trend, stats)
+	}
+	return trend, rows.Err()
+}
+
+func cacheStatsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	stats, err := getCacheStats(mux.Vars(r)["buildId"])
+	if err == sql.ErrNoRows {
+		http.Error(w, "No cache stats for build", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Could not get cache stats", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(stats)
+}
+
+// cacheTrendHandler lists the cache hit ratio of a repository's most
+// recent builds, newest first, so a drop can be traced to the build that
+// caused it. ?limit= defaults to 20.
+func cacheTrendHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	repoURL := r.URL.Query().Get("repo")
+	if repoURL == "" {
+		http.Error(w, "Request must contain repo", http.StatusBadRequest)
+		return
+	}
+	limit := 20
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "limit must be a positive number", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	trend, err := getCacheTrend(repoURL, limit)
+	if err != nil {
+		http.Error(w, "Could not get cache stats", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(trend)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// HostCapacity is the headroom left on the host that runs builds.
+type HostCapacity struct {
+	RunningBuilds    int     `json:"runningBuilds"`
+	QueuedBuilds     int     `json:"queuedBuilds"`
+	Concurrency      int     `json:"concurrency"`
+	CPUs             int     `json:"cpus"`
+	Load1            float64 `json:"load1"`
+	MemoryTotalBytes int64   `json:"memoryTotalBytes"`
+	MemoryFreeBytes  int64   `json:"memoryFreeBytes"`
+	DiskTotalBytes   int64   `json:"diskTotalBytes"`
+	DiskFreeBytes    int64   `json:"diskFreeBytes"`
+	Docker           Health  `json:"docker"`
+	Buildx           Health  `json:"buildx"`
+	GPUs             int     `json:"gpus"`
+	GPUsFree         int     `json:"gpusFree"`
+	// Labels are what builds' worker requirements are matched against.
+	Labels map[string]string `json:"labels"`
+}
+
+type Health struct {
+	Healthy bool   `json:"healthy"`
+	Detail  string `json:"detail"`
+}
+
+// loadAverage returns the one-minute load average from /proc/loadavg.
+func loadAverage() float64 {
+	data, err := os.ReadFile("/proc/loadavg")
+	if err != nil {
+		return 0
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return 0
+	}
+	load, _ := strconv.ParseFloat(fields[0], 64)
+	return load
+}
+
+// memoryInfo returns total and available memory from /proc/meminfo.
+func memoryInfo() (total, available int64) {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, 0
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		kb, _ := strconv.ParseInt(fields[1], 10, 64)
+		switch fields[0] {
+		case "MemTotal:":
+			total = kb * 1024
+		case "MemAvailable:":
+			available = kb * 1024
+		}
+	}
+	return total, available
+}
+
+func dockerHealth() Health {
+	out, err := exec.Command("docker", "info", "--format", "{{.ServerVersion}}").CombinedOutput()
+	if err != nil {
+		return Health{Detail: strings.TrimSpace(string(out))}
+	}
+	return Health{Healthy: true, Detail: "server " + strings.TrimSpace(string(out))}
+}
+
+// buildxHealth reports the status of the current buildx builder.
+func buildxHealth() Health {
+	out, err := exec.Command("docker", "buildx", "inspect").CombinedOutput()
+	if err != nil {
+		return Health{Detail: strings.TrimSpace(string(out))}
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		if status, ok := strings.CutPrefix(strings.TrimSpace(line), "Status:"); ok {
+			status = strings.TrimSpace(status)
+			return Health{Healthy: status == "running", Detail: status}
+		}
+	}
+	return Health{Detail: "builder status unknown"}
+}
+
+// capacityHandler reports running builds and remaining CPU, memory and
+// disk on the local host, along with Docker and buildx health.
+func capacityHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	stats := queue.Stats()
+	capacity := HostCapacity{
+		RunningBuilds: stats.Running,
+		QueuedBuilds:  stats.Queued,
+		Concurrency:   stats.Concurrency,
+		CPUs:          runtime.NumCPU(),
+		Load1:         loadAverage(),
+		Docker:        dockerHealth(),
+		Buildx:        buildxHealth(),
+		Labels:        workerLabels(),
+	}
+	capacity.MemoryTotalBytes, capacity.MemoryFreeBytes = memoryInfo()
+	capacity.DiskTotalBytes, capacity.DiskFreeBytes = diskSpace(workspaceRoot)
+	capacity.GPUs, capacity.GPUsFree = gpus.Total()
+	json.NewEncoder(w).Encode(capacity)
+}
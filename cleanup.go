@@ -0,0 +1,271 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type CleanupRequest struct {
+	Scopes    []string `json:"scopes"`
+	DryRun    bool     `json:"dryRun"`
+	OlderThan string   `json:"olderThan"`
+}
+
+type CleanupResult struct {
+	Scope string   `json:"scope"`
+	Items []string `json:"items"`
+	Bytes int64    `json:"bytes"`
+	Error string   `json:"error,omitempty"`
+}
+
+type CleanupResponse struct {
+	DryRun     bool            `json:"dryRun"`
+	Results    []CleanupResult `json:"results"`
+	TotalBytes int64           `json:"totalBytes"`
+}
+
+// cleanupScopes maps each supported scope to the function that finds, and
+// unless dryRun is set removes, what it covers.
+var cleanupScopes = map[string]func(dryRun bool, olderThan time.Duration) CleanupResult{
+	"workspaces":   cleanupWorkspaces,
+	"images":       cleanupImages,
+	"buildx-cache": cleanupBuildxCache,
+	"logs":         cleanupLogs,
+	"containers":   cleanupContainers,
+}
+
+// workspaceRoot holds build workspaces: WORKSPACE_DIR, or the system
+// temporary directory if unset.
+var workspaceRoot string
+
+// buildDir is the workspace a build clones into.
+func buildDir(buildId string) string {
+	return filepath.Join(workspaceRoot, buildId)
+}
+
+// cleanupWorkspaces removes build workspaces left behind by builds that
+// are no longer running, e.g. because the server stopped mid-build, apart
+// from failed builds' workspaces still within their retention period.
+func cleanupWorkspaces(dryRun bool, olderThan time.Duration) CleanupResult {
+	result := CleanupResult{Scope: "workspaces", Items: []string{}}
+	entries, err := os.ReadDir(workspaceRoot)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	for _, entry := range entries {
+		if _, err := uuid.Parse(entry.Name()); err != nil || !entry.IsDir() || isBuildActive(entry.Name()) || isWorkspaceRetained(entry.Name()) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || time.Since(info.ModTime()) < olderThan {
+			continue
+		}
+		dir := buildDir(entry.Name())
+		result.Items = append(result.Items, dir)
+		result.Bytes += dirSize(dir)
+		if !dryRun {
+			if err := os.RemoveAll(dir); err != nil {
+				log.Printf("Error removing workspace %s: %v", dir, err)
+			}
+		}
+	}
+	return result
+}
+
+// cleanupLogs removes the logs of builds that are no longer running and
+// last wrote to them longer than olderThan ago.
+func cleanupLogs(dryRun bool, olderThan time.Duration) CleanupResult {
+	result := CleanupResult{Scope: "logs", Items: []string{}}
+	entries, err := os.ReadDir(logDir)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	for _, entry := range entries {
+		buildId, ok := strings.CutSuffix(entry.Name(), ".log")
+		if !ok || entry.IsDir() || isBuildActive(buildId) {
+			continue
+		}
+		if _, err := uuid.Parse(buildId); err != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || time.Since(info.ModTime()) < olderThan {
+			continue
+		}
+		path := logPath(buildId)
+		result.Items = append(result.Items, path)
+		result.Bytes += info.Size()
+		if !dryRun {
+			if err := os.Remove(path); err != nil {
+				log.Printf("Error removing build log %s: %v", path, err)
+			}
+		}
+	}
+	return result
+}
+
+// cleanupImages removes dangling images built by this server.
+func cleanupImages(dryRun bool, olderThan time.Duration) CleanupResult {
+	result := CleanupResult{Scope: "images", Items: []string{}}
+	// The listing and the prune share one cutoff so that a dry run lists
+	// exactly what a real run removes.
+	cutoff := time.Now().Add(-olderThan)
+	out, err := exec.Command("docker", "image", "ls", "--filter", "dangling=true", "--filter", instanceFilter(), "--format", "{{.ID}}\t{{.CreatedAt}}").Output()
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		id, createdAt, ok := strings.Cut(line, "\t")
+		if !ok {
+			continue
+		}
+		created, err := time.Parse("2006-01-02 15:04:05 -0700 MST", createdAt)
+		if err != nil || created.After(cutoff) {
+			continue
+		}
+		result.Items = append(result.Items, id)
+		if size, ok := imageSize(id); ok {
+			result.Bytes += size
+		}
+	}
+	if !dryRun && len(result.Items) > 0 {
+		if err := exec.Command("docker", "image", "prune", "--force", "--filter", "until="+cutoff.Format(time.RFC3339), "--filter", instanceFilter()).Run(); err != nil {
+			result.Error = err.Error()
+		}
+	}
+	return result
+}
+
+// cleanupContainers removes debug containers older than olderThan that no
+// debug session owns, such as those left running when the server
+// stopped.
+func cleanupContainers(dryRun bool, olderThan time.Duration) CleanupResult {
+	result := CleanupResult{Scope: "containers", Items: []string{}}
+	cutoff := time.Now().Add(-olderThan)
+	out, err := exec.Command("docker", "ps", "--all", "--size", "--filter", "label="+labelDebug, "--filter", instanceFilter(),
+		"--format", "{{.Names}}\t{{.Label \""+labelDebug+"\"}}\t{{.CreatedAt}}\t{{.Size}}").Output()
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) != 4 {
+			continue
+		}
+		name, buildId := fields[0], fields[1]
+		if s, ok := getDebugSession(buildId); ok && s.Container == name {
+			continue
+		}
+		created, err := time.Parse("2006-01-02 15:04:05 -0700 MST", fields[2])
+		if err != nil || created.After(cutoff) {
+			continue
+		}
+		result.Items = append(result.Items, name)
+		// Size reads like "12MB (virtual 4.3GB)"; only the container's
+		// own layer is freed.
+		if size := strings.Fields(fields[3]); len(size) > 0 {
+			result.Bytes += parseSize(size[0])
+		}
+		if !dryRun {
+			if out, err := exec.Command("docker", "rm", "--force", name).CombinedOutput(); err != nil {
+				log.Printf("Error removing debug container %s: %v: %s", name, err, strings.TrimSpace(string(out)))
+			}
+		}
+	}
+	return result
+}
+
+var reclaimablePattern = regexp.MustCompile(`(?m)^Reclaimable:\s*(\S+)`)
+
+// cleanupBuildxCache prunes buildx cache records not used within olderThan.
+// Cache records carry no labels; to keep other workloads' cache, give the
+// server a builder of its own with BUILDX_BUILDER.
+func cleanupBuildxCache(dryRun bool, olderThan time.Duration) CleanupResult {
+	result := CleanupResult{Scope: "buildx-cache", Items: []string{}}
+	filter := "until=" + olderThan.String()
+	out, err := exec.Command("docker", "buildx", "du", "--filter", filter).Output()
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	if m := reclaimablePattern.FindStringSubmatch(string(out)); m != nil {
+		result.Bytes = parseSize(m[1])
+	}
+	if !dryRun && result.Bytes > 0 {
+		if err := exec.Command("docker", "buildx", "prune", "--force", "--filter", filter).Run(); err != nil {
+			result.Error = err.Error()
+		}
+	}
+	return result
+}
+
+var sizePattern = regexp.MustCompile(`^([\d.]+)\s*([kKMGT]?i?B)$`)
+
+// parseSize converts docker's human readable sizes such as "1.2GB" to bytes.
+func parseSize(s string) int64 {
+	m := sizePattern.FindStringSubmatch(s)
+	if m == nil {
+		return 0
+	}
+	n, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return 0
+	}
+	units := map[string]float64{
+		"B": 1, "kB": 1e3, "KB": 1e3, "MB": 1e6, "GB": 1e9, "TB": 1e12,
+		"KiB": 1 << 10, "MiB": 1 << 20, "GiB": 1 << 30, "TiB": 1 << 40,
+	}
+	return int64(n * units[m[2]])
+}
+
+// cleanupHandler removes what the requested scopes cover, which needs the
+// admin token.
+func cleanupHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if !authorizeAdmin(w, r) {
+		return
+	}
+	var req CleanupRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Scopes) == 0 {
+		http.Error(w, "Request must list at least one scope", http.StatusBadRequest)
+		return
+	}
+	olderThan := 24 * time.Hour
+	if req.OlderThan != "" {
+		d, err := time.ParseDuration(req.OlderThan)
+		if err != nil {
+			http.Error(w, "Invalid olderThan duration", http.StatusBadRequest)
+			return
+		}
+		olderThan = d
+	}
+	for _, scope := range req.Scopes {
+		if _, ok := cleanupScopes[scope]; !ok {
+			http.Error(w, fmt.Sprintf("Unknown cleanup scope %q", scope), http.StatusBadRequest)
+			return
+		}
+	}
+
+	resp := CleanupResponse{DryRun: req.DryRun}
+	for _, scope := range req.Scopes {
+		result := cleanupScopes[scope](req.DryRun, olderThan)
+		resp.TotalBytes += result.Bytes
+		resp.Results = append(resp.Results, result)
+	}
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// CommitInfo is the human-facing metadata of a built commit.
+type CommitInfo struct {
+	Author      string    `json:"author"`
+	AuthorEmail string    `json:"authorEmail"`
+	Message     string    `json:"message"`
+	CommittedAt time.Time `json:"committedAt"`
+}
+
+// commitInfo reads the author, subject line and commit date of HEAD.
+func commitInfo(repoDir string) (CommitInfo, error) {
+	var info CommitInfo
+	out, err := exec.Command("git", "-C", repoDir, "log", "-1", "--format=%an%x00%ae%x00%s%x00%cI").Output()
+	if err != nil {
+		return info, err
+	}
+	fields := strings.Split(strings.TrimSpace(string(out)), "\x00")
+	if len(fields) != 4 {
+		return info, fmt.Errorf("unexpected git log output %q", out)
+	}
+	info.Author, info.AuthorEmail, info.Message = fields[0], fields[1], fields[2]
+	info.CommittedAt, err = time.Parse(time.RFC3339, fields[3])
+	return info, err
+}
+
+// lastBuiltCommit returns the commit of the most recent successful build
+// of repoURL's branch, if there is one.
+func lastBuiltCommit(repoURL, branch string) (string, bool) {
+	build, err := store.LastBranchBuild(repoURL, branch)
+	return build.CommitID, err == nil
+}
+
+// changedFiles lists the files that differ between base and HEAD.
+func changedFiles(repoDir, base string) ([]string, error) {
+	return diffFiles(repoDir, base, "HEAD")
+}
+
+// diffFiles lists the files that differ between two commits of the
+// repository at dir.
+func diffFiles(dir, from, to string) ([]string, error) {
+	out, err := exec.Command("git", "-C", dir, "diff", "--name-only", from, to).Output()
+	if err != nil {
+		return nil, err
+	}
+	files := []string{}
+	for _, f := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		if f != "" {
+			files = append(files, f)
+		}
+	}
+	return files, nil
+}
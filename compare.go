@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+type StageDelta struct {
+	Stage        string   `json:"stage"`
+	FromSeconds  *float64 `json:"fromSeconds,omitempty"`
+	ToSeconds    *float64 `json:"toSeconds,omitempty"`
+	DeltaSeconds *float64 `json:"deltaSeconds,omitempty"`
+}
+
+type SizeDelta struct {
+	FromBytes  int64 `json:"fromBytes"`
+	ToBytes    int64 `json:"toBytes"`
+	DeltaBytes int64 `json:"deltaBytes"`
+}
+
+type MetricDelta struct {
+	Name  string   `json:"name"`
+	From  string   `json:"from,omitempty"`
+	To    string   `json:"to,omitempty"`
+	Delta *float64 `json:"delta,omitempty"`
+}
+
+// VulnerabilityDelta compares the known CVEs of the base images two
+// builds were pinned to.
+type VulnerabilityDelta struct {
+	FromCount int      `json:"fromCount"`
+	ToCount   int      `json:"toCount"`
+	Added     []string `json:"added,omitempty"`
+	Fixed     []string `json:"fixed,omitempty"`
+}
+
+// BuildComparison is what changed between two successful builds. Fields
+// are omitted when the data to compute them is no longer available, e.g.
+// a removed image or log.
+type BuildComparison struct {
+	From            BuildResponse      `json:"from"`
+	To              BuildResponse      `json:"to"`
+	Stages          []StageDelta       `json:"stages"`
+	ImageSize       *SizeDelta         `json:"imageSize,omitempty"`
+	ChangedFiles    []string           `json:"changedFiles,omitempty"`
+	Vulnerabilities VulnerabilityDelta `json:"vulnerabilities"`
+	Metrics         []MetricDelta      `json:"metrics"`
+}
+
+// stageDurations times each stage of a build from the START and END
+// markers in its log, returning stages in the order they ran.
+func stageDurations(buildId string) ([]string, map[string]float64, error) {
+	f, err := os.Open(logPath(buildId))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	var order []string
+	started := make(map[string]time.Time)
+	durations := make(map[string]float64)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 4 || fields[1] != "==>" {
+			continue
+		}
+		ts, err := time.Parse(time.RFC3339Nano, fields[0])
+		if err != nil {
+			continue
+		}
+		stage := strings.ToLower(fields[2])
+		switch fields[3] {
+		case "START":
+			started[stage] = ts
+			order = append(order, stage)
+		case "END":
+			if start, ok := started[stage]; ok {
+				durations[stage] = ts.Sub(start).Seconds()
+			}
+		}
+	}
+	return order, durations, scanner.Err()
+}
+
+// compareStages pairs up the stage durations of two builds.
+func compareStages(from, to string) []StageDelta {
+	fromOrder, fromDurations, _ := stageDurations(from)
+	toOrder, toDurations, _ := stageDurations(to)
+	deltas := []StageDelta{}
+	seen := make(map[string]bool)
+	for _, stage := range append(fromOrder, toOrder...) {
+		if seen[stage] {
+			continue
+		}
+		seen[stage] = true
+		delta := StageDelta{Stage: stage}
+		if d, ok := fromDurations[stage]; ok {
+			delta.FromSeconds = &d
+		}
+		if d, ok := toDurations[stage]; ok {
+			delta.ToSeconds = &d
+		}
+		if delta.FromSeconds != nil && delta.ToSeconds != nil {
+			d := *delta.ToSeconds - *delta.FromSeconds
+			delta.DeltaSeconds = &d
+		}
+		deltas = append(deltas, delta)
+	}
+	return deltas
+}
+
+func compareMetrics(from, to string) ([]MetricDelta, error) {
+	fromMetrics, err := getMetrics(from)
+	if err != nil {
+		return nil, err
+	}
+	toMetrics, err := getMetrics(to)
+	if err != nil {
+		return nil, err
+	}
+	deltas := []MetricDelta{}
+	index := make(map[string]int)
+	fromNumbers := make(map[string]*float64)
+	for _, m := range fromMetrics {
+		index[m.Name] = len(deltas)
+		deltas = append(deltas, MetricDelta{Name: m.Name, From: m.Value})
+		fromNumbers[m.Name] = m.Number
+	}
+	for _, m := range toMetrics {
+		i, ok := index[m.Name]
+		if !ok {
+			deltas = append(deltas, MetricDelta{Name: m.Name, To: m.Value})
+			continue
+		}
+		deltas[i].To = m.Value
+		if n := fromNumbers[m.Name]; n != nil && m.Number != nil {
+			d := *m.Number - *n
+			deltas[i].Delta = &d
+		}
+	}
+	return deltas, nil
+}
+
+func compareVulnerabilities(from, to string) (VulnerabilityDelta, error) {
+	fromCVEs, err := buildCVEs(from)
+	if err != nil {
+		return VulnerabilityDelta{}, err
+	}
+	toCVEs, err := buildCVEs(to)
+	if err != nil {
+		return VulnerabilityDelta{}, err
+	}
+	return VulnerabilityDelta{
+		FromCount: len(fromCVEs),
+		ToCount:   len(toCVEs),
+		Added:     missingFrom(toCVEs, fromCVEs),
+		Fixed:     missingFrom(fromCVEs, toCVEs),
+	}, nil
+}
+
+// compareChangedFiles lists the files changed between the two builds'
+// commits, from the repository mirror when there is one, or else from
+// the later build's own change list when it was built on top of the
+// earlier one.
+func compareChangedFiles(from, to BuildResponse) []string {
+	if from.RepoUrl == to.RepoUrl && mirrorDir != "" {
+		if files, err := diffFiles(mirrorPath(from.RepoUrl), from.CommitID, to.CommitID); err == nil {
+			return files
+		}
+	}
+	if to.BaseCommit == from.CommitID {
+		return to.ChangedFiles
+	}
+	return nil
+}
+
+func compareBuildsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	fromId, toId := r.URL.Query().Get("from"), r.URL.Query().Get("to")
+	if fromId == "" || toId == "" {
+		http.Error(w, "Request must contain from and to build IDs", http.StatusBadRequest)
+		return
+	}
+	from, err := getBuild(fromId)
+	if err == sql.ErrNoRows {
+		http.Error(w, "No successful build "+fromId, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Could not get build details", http.StatusInternalServerError)
+		return
+	}
+	to, err := getBuild(toId)
+	if err == sql.ErrNoRows {
+		http.Error(w, "No successful build "+toId, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Could not get build details", http.StatusInternalServerError)
+		return
+	}
+
+	comparison := BuildComparison{From: from, To: to, Stages: compareStages(fromId, toId)}
+	fromSize, fromOk := imageSize(from.Image)
+	toSize, toOk := imageSize(to.Image)
+	if fromOk && toOk {
+		comparison.ImageSize = &SizeDelta{FromBytes: fromSize, ToBytes: toSize, DeltaBytes: toSize - fromSize}
+	}
+	comparison.ChangedFiles = compareChangedFiles(from, to)
+	if comparison.Vulnerabilities, err = compareVulnerabilities(fromId, toId); err != nil {
+		http.Error(w, "Could not get build vulnerabilities", http.StatusInternalServerError)
+		return
+	}
+	if comparison.Metrics, err = compareMetrics(fromId, toId); err != nil {
+		http.Error(w, "Could not get build metrics", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(comparison)
+}
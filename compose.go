@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// composeConfig is the part of `docker compose config` output a compose
+// build needs. Compose normalizes depends_on to a map and build contexts
+// to absolute paths.
+type composeConfig struct {
+	Services map[string]struct {
+		Build *struct {
+			Context    string             `json:"context"`
+			Dockerfile string             `json:"dockerfile"`
+			Args       map[string]*string `json:"args"`
+		} `json:"build"`
+		DependsOn map[string]json.RawMessage `json:"depends_on"`
+	} `json:"services"`
+}
+
+var nonImageChars = regexp.MustCompile(`[^a-z0-9._-]+`)
+
+// composeProject names a repository's images in compose builds unless
+// its image naming says otherwise, taken from the last element of its
+// URL.
+func composeProject(repoURL string) string {
+	name := strings.TrimSuffix(path.Base(strings.TrimRight(repoURL, "/")), ".git")
+	return strings.Trim(nonImageChars.ReplaceAllString(strings.ToLower(name), "-"), "-._")
+}
+
+// composeEnvNames are the only variables of the server's environment that
+// docker compose sees. Compose files interpolate ${VAR} from the
+// environment, so anything else, such as ADMIN_TOKEN, could end up in a
+// build arg and be baked into an image.
+var composeEnvNames = []string{
+	"PATH", "HOME", "XDG_RUNTIME_DIR",
+	"DOCKER_HOST", "DOCKER_CONTEXT", "DOCKER_CONFIG", "DOCKER_CERT_PATH", "DOCKER_TLS_VERIFY",
+	"SYSTEMROOT", "USERPROFILE", "APPDATA", "LOCALAPPDATA", "TEMP", "TMP",
+}
+
+func composeEnv() []string {
+	var env []string
+	for _, name := range composeEnvNames {
+		if v, ok := os.LookupEnv(name); ok {
+			env = append(env, name+"="+v)
+		}
+	}
+	return env
+}
+
+// checkWithinDir checks that p, with symlinks followed, is dir or inside
+// it, so a compose file can't build from elsewhere on the server.
+func checkWithinDir(dir, p string) error {
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return err
+	}
+	resolved, err := filepath.EvalSymlinks(p)
+	if err != nil {
+		return err
+	}
+	rel, err := filepath.Rel(root, resolved)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("%s is outside the repository", p)
+	}
+	return nil
+}
+
+// serviceDockerfile is where a service's Dockerfile is, relative to its
+// context unless absolute.
+func serviceDockerfile(context, dockerfile string) string {
+	if dockerfile != "" && !filepath.IsAbs(dockerfile) {
+		return filepath.Join(context, dockerfile)
+	}
+	return dockerfile
+}
+
+// checkServicePaths rejects a service whose build context or Dockerfile
+// is outside repoDir.
+func checkServicePaths(repoDir, context, dockerfile string) error {
+	if err := checkWithinDir(repoDir, context); err != nil {
+		return fmt.Errorf("build context: %v", err)
+	}
+	if dockerfile = serviceDockerfile(context, dockerfile); dockerfile != "" {
+		if err := checkWithinDir(repoDir, dockerfile); err != nil {
+			return fmt.Errorf("dockerfile: %v", err)
+		}
+	}
+	return nil
+}
+
+func loadComposeConfig(repoDir string) (composeConfig, error) {
+	var config composeConfig
+	cmd := exec.Command("docker", "compose", "--project-directory", repoDir, "config", "--format", "json")
+	cmd.Env = composeEnv()
+	out, err := cmd.Output()
+	if err != nil {
+		return config, fmt.Errorf("docker compose config: %v", err)
+	}
+	if err := json.Unmarshal(out, &config); err != nil {
+		return config, fmt.Errorf("could not parse compose config: %v", err)
+	}
+	return config, nil
+}
+
+// composeBuildOrder returns the services with a build section so that
+// each comes after the services it depends on, directly or through
+// services that only pull an image.
+func composeBuildOrder(config composeConfig) ([]string, error) {
+	names := make([]string, 0, len(config.Services))
+	for name := range config.Services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var order []string
+	state := make(map[string]int) // 1 visiting, 2 done
+	var visit func(name string) error
+	visit = func(name string) error {
+		switch state[name] {
+		case 1:
+			return fmt.Errorf("compose services have a dependency cycle through %s", name)
+		case 2:
+			return nil
+		}
+		state[name] = 1
+		deps := make([]string, 0, len(config.Services[name].DependsOn))
+		for dep := range config.Services[name].DependsOn {
+			deps = append(deps, dep)
+		}
+		sort.Strings(deps)
+		for _, dep := range deps {
+			if err := visit(dep); err != nil {
+				return err
+			}
+		}
+		state[name] = 2
+		if config.Services[name].Build != nil {
+			order = append(order, name)
+		}
+		return nil
+	}
+	for _, name := range names {
+		if err := visit(name); err != nil {
+			return nil, err
+		}
+	}
+	return order, nil
+}
+
+// buildComposeImages builds every service in the repository's compose
+// file that has a build section, tagging each <project>-<service>:<tag>.
+// buildArgs take precedence over args set in the compose file.
+func buildComposeImages(buildId, repoDir, project, tag string, compression *Compression, buildArgs, labels map[string]string, platforms []string, gpuIndexes []int) ([]BuiltImage, error) {
+	config, err := loadComposeConfig(repoDir)
+	if err != nil {
+		return nil, err
+	}
+	order, err := composeBuildOrder(config)
+	if err != nil {
+		return nil, err
+	}
+	if len(order) == 0 {
+		return nil, fmt.Errorf("compose file has no services with a build section")
+	}
+	for _, name := range order {
+		if err := checkServicePaths(repoDir, config.Services[name].Build.Context, config.Services[name].Build.Dockerfile); err != nil {
+			return nil, fmt.Errorf("service %s: %v", name, err)
+		}
+	}
+
+	var images []BuiltImage
+	for _, name := range order {
+		build := config.Services[name].Build
+		args := make(map[string]string)
+		for k, v := range build.Args {
+			if v != nil {
+				args[k] = *v
+			}
+		}
+		for k, v := range buildArgs {
+			args[k] = v
+		}
+		logLine(buildId, "==> building service "+name)
+		dockerfile := serviceDockerfile(build.Context, build.Dockerfile)
+		serviceLabels := map[string]string{labelService: name}
+		for k, v := range labels {
+			serviceLabels[k] = v
+		}
+		image := fmt.Sprintf("%s-%s:%s", project, name, tag)
+		built, err := buildImage(buildId, build.Context, dockerfile, image, compression, args, serviceLabels, platforms, gpuIndexes)
+		if err != nil {
+			return nil, fmt.Errorf("service %s: %v", name, err)
+		}
+		built.Service = name
+		images = append(images, built)
+	}
+	return images, nil
+}
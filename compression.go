@@ -0,0 +1,122 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// Compression selects how buildx compresses a repository's image layers.
+type Compression struct {
+	Type string `json:"type"`
+	// Level is the compression level; nil uses the compressor's default.
+	Level *int `json:"level,omitempty"`
+	// Force recompresses layers inherited from the base image.
+	Force bool `json:"force,omitempty"`
+}
+
+type CompressionSettings struct {
+	RepoUrl     string      `json:"repoUrl"`
+	Compression Compression `json:"compression"`
+}
+
+// compressionLevels is the range of levels each compressor accepts.
+var compressionLevels = map[string][2]int{
+	"uncompressed": {0, 0},
+	"gzip":         {0, 9},
+	"estargz":      {0, 9},
+	"zstd":         {0, 22},
+}
+
+func validateCompression(c Compression) error {
+	levels, ok := compressionLevels[c.Type]
+	if !ok {
+		return fmt.Errorf("unknown compression type %q", c.Type)
+	}
+	if c.Level != nil && (*c.Level < levels[0] || *c.Level > levels[1]) {
+		return fmt.Errorf("%s compression level must be between %d and %d", c.Type, levels[0], levels[1])
+	}
+	return nil
+}
+
+// getCompression returns the repository's compression settings, or nil if
+// it uses the buildx defaults.
+func getCompression(repoURL string) (*Compression, error) {
+	var body string
+	err := db.QueryRow("SELECT compression FROM build_compression WHERE repo_url = ?", repoURL).Scan(&body)
+	if err != nil {
+		return nil, err
+	}
+	var c Compression
+	err = json.Unmarshal([]byte(body), &c)
+	return &c, err
+}
+
+// outputFlag is the buildx --output flag for a local image compressed
+// with c.
+func outputFlag(c *Compression) string {
+	flag := "--output=type=docker"
+	if c == nil {
+		return flag
+	}
+	flag += ",compression=" + c.Type
+	if c.Level != nil {
+		flag += ",compression-level=" + strconv.Itoa(*c.Level)
+	}
+	if c.Force {
+		flag += ",force-compression=true"
+	}
+	return flag
+}
+
+func saveCompression(repoURL string, c Compression) error {
+	body, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("INSERT OR REPLACE INTO build_compression (repo_url, compression) VALUES (?, ?)", repoURL, string(body))
+	return err
+}
+
+func setCompressionHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	var settings CompressionSettings
+	if err := json.NewDecoder(r.Body).Decode(&settings); err != nil || settings.RepoUrl == "" {
+		http.Error(w, "Request must contain repoUrl and compression", http.StatusBadRequest)
+		return
+	}
+	if err := validateRepoURL(settings.RepoUrl); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validateCompression(settings.Compression); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := saveCompression(settings.RepoUrl, settings.Compression); err != nil {
+		http.Error(w, "Could not save compression", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(settings)
+}
+
+func getCompressionHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	repoURL := r.URL.Query().Get("repo")
+	if err := validateRepoURL(repoURL); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c, err := getCompression(repoURL)
+	if err == sql.ErrNoRows {
+		http.Error(w, "No compression configured for repository", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Could not get compression", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(CompressionSettings{RepoUrl: repoURL, Compression: *c})
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+// concurrencyGroups tracks the queued and running builds of each
+// concurrency group, so a new build can supersede them.
+var concurrencyGroups = struct {
+	sync.Mutex
+	members map[string][]string
+	groupOf map[string]string
+}{members: make(map[string][]string), groupOf: make(map[string]string)}
+
+// joinConcurrencyGroup adds buildId to its request's group, first aborting
+// the builds already in it when the request asks to cancel them.
+func joinConcurrencyGroup(buildId string, req BuildRequest) {
+	group := req.ConcurrencyGroup
+	if group == "" {
+		return
+	}
+	concurrencyGroups.Lock()
+	defer concurrencyGroups.Unlock()
+	if req.CancelInProgress {
+		for _, id := range concurrencyGroups.members[group] {
+			abortBuild(id, fmt.Errorf("canceled: superseded by build %s in concurrency group %s", buildId, group))
+		}
+	}
+	concurrencyGroups.members[group] = append(concurrencyGroups.members[group], buildId)
+	concurrencyGroups.groupOf[buildId] = group
+}
+
+// leaveConcurrencyGroup removes finished builds from their group.
+func leaveConcurrencyGroup(e Event) {
+	if e.Type != EventBuildSucceeded && e.Type != EventBuildFailed {
+		return
+	}
+	concurrencyGroups.Lock()
+	defer concurrencyGroups.Unlock()
+	group, ok := concurrencyGroups.groupOf[e.BuildId]
+	if !ok {
+		return
+	}
+	delete(concurrencyGroups.groupOf, e.BuildId)
+	members := concurrencyGroups.members[group]
+	for i, id := range members {
+		if id == e.BuildId {
+			members = append(members[:i], members[i+1:]...)
+			break
+		}
+	}
+	if len(members) == 0 {
+		delete(concurrencyGroups.members, group)
+	} else {
+		concurrencyGroups.members[group] = members
+	}
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strconv"
+)
+
+// envInt reads an integer setting from the environment, falling back to def
+// when it is unset.
+func envInt(name string, def int) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		log.Fatalf("Invalid value for %s: %v", name, err)
+	}
+	return n
+}
@@ -0,0 +1,594 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// secretPlaceholder stands in for registry passwords, webhook secrets and
+// tokens, build arg values and the passwords in repository URLs in
+// exported configuration. Each must be replaced with the secret, or
+// removed, before the configuration is imported.
+const secretPlaceholder = "<secret>"
+
+// ServerConfig is the portable configuration of a server instance, to
+// copy to another instance. Secrets are exported as secretPlaceholder.
+type ServerConfig struct {
+	Dependencies []Dependency     `yaml:"dependencies"`
+	Schedules    []ScheduleConfig `yaml:"schedules"`
+	Projects     []ProjectConfig  `yaml:"projects"`
+	CostRates    *CostRates       `yaml:"costRates,omitempty"`
+}
+
+type ScheduleConfig struct {
+	BuildId string                 `yaml:"buildId"`
+	RunAt   time.Time              `yaml:"runAt"`
+	Request map[string]interface{} `yaml:"request"`
+}
+
+// ProjectConfig is one repository's settings. It is written in YAML with
+// the field names the settings have in the API.
+type ProjectConfig struct {
+	RepoUrl                 string            `json:"repoUrl"`
+	Parameters              []Parameter       `json:"parameters,omitempty"`
+	BuildArgs               map[string]string `json:"buildArgs,omitempty"`
+	Compression             *Compression      `json:"compression,omitempty"`
+	MetricRules             []MetricRule      `json:"metricRules,omitempty"`
+	TriggerFilters          *TriggerFilters   `json:"triggerFilters,omitempty"`
+	Webhook                 *WebhookSettings  `json:"webhook,omitempty"`
+	SizeLimit               *ImageSizeLimit   `json:"sizeLimit,omitempty"`
+	Registry                *RegistrySettings `json:"registry,omitempty"`
+	WorkerRequirements      map[string]string `json:"workerRequirements,omitempty"`
+	ImageNaming             *ImageNaming      `json:"imageNaming,omitempty"`
+	MaxGPUs                 *int              `json:"maxGpus,omitempty"`
+	WorkspaceRetentionHours int               `json:"workspaceRetentionHours,omitempty"`
+}
+
+func (p ProjectConfig) MarshalYAML() (interface{}, error) {
+	body, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+	var v map[string]interface{}
+	err = json.Unmarshal(body, &v)
+	return v, err
+}
+
+func (p *ProjectConfig) UnmarshalYAML(node *yaml.Node) error {
+	var v map[string]interface{}
+	if err := node.Decode(&v); err != nil {
+		return err
+	}
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(body, p)
+}
+
+// configuredRepos lists the repositories with settings of their own.
+func configuredRepos() ([]string, error) {
+	rows, err := db.Query(`SELECT repo_url FROM build_parameters
+        UNION SELECT repo_url FROM default_build_args
+        UNION SELECT repo_url FROM build_compression
+        UNION SELECT repo_url FROM build_metric_rules
+        UNION SELECT repo_url FROM trigger_filters
+        UNION SELECT repo_url FROM webhook_settings
+        UNION SELECT repo_url FROM image_size_limits
+        UNION SELECT repo_url FROM registry_settings
+        UNION SELECT repo_url FROM worker_requirements
+        UNION SELECT repo_url FROM image_naming
+        UNION SELECT repo_url FROM gpu_settings
+        UNION SELECT repo_url FROM workspace_retention
+        ORDER BY 1`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var repos []string
+	for rows.Next() {
+		var repo string
+		if err := rows.Scan(&repo); err != nil {
+			return nil, err
+		}
+		repos = append(repos, repo)
+	}
+	return repos, rows.Err()
+}
+
+// exportURL replaces the password in repoURL with secretPlaceholder.
+func exportURL(repoURL string) string {
+	return urlCredentials.ReplaceAllString(repoURL, "${1}"+secretPlaceholder+"@")
+}
+
+// exportBuildArgs replaces each build arg's value with secretPlaceholder,
+// as any of them may be a token.
+func exportBuildArgs(args map[string]string) map[string]string {
+	if args == nil {
+		return nil
+	}
+	masked := make(map[string]string, len(args))
+	for name := range args {
+		masked[name] = secretPlaceholder
+	}
+	return masked
+}
+
+// checkPlaceholders rejects a repository URL or build args of an import
+// that still have the placeholders of an export.
+func checkPlaceholders(repoURL string, buildArgs map[string]string) error {
+	if strings.Contains(repoURL, secretPlaceholder) {
+		return fmt.Errorf("repository URL %s has a placeholder for its password: replace it with the password or remove it", repoURL)
+	}
+	for name, value := range buildArgs {
+		if value == secretPlaceholder {
+			return fmt.Errorf("build arg %s of %s has a placeholder for its value: replace it with the value or remove it", name, exportURL(repoURL))
+		}
+	}
+	return nil
+}
+
+// exportProject returns repoURL's settings with its secrets replaced by
+// secretPlaceholder.
+func exportProject(repoURL string) (ProjectConfig, error) {
+	p := ProjectConfig{RepoUrl: exportURL(repoURL)}
+	var err error
+	if p.Parameters, err = getParameters(repoURL); err != nil && err != sql.ErrNoRows {
+		return p, err
+	}
+	args, err := getDefaultBuildArgs(repoURL)
+	if err != nil && err != sql.ErrNoRows {
+		return p, err
+	}
+	p.BuildArgs = exportBuildArgs(args)
+	if p.Compression, err = getCompression(repoURL); err != nil && err != sql.ErrNoRows {
+		return p, err
+	}
+	if p.MetricRules, err = getMetricRules(repoURL); err != nil && err != sql.ErrNoRows {
+		return p, err
+	}
+	if p.WorkerRequirements, err = getWorkerRequirements(repoURL); err != nil && err != sql.ErrNoRows {
+		return p, err
+	}
+	if p.WorkspaceRetentionHours, err = getWorkspaceRetention(repoURL); err != nil {
+		return p, err
+	}
+	filters, err := getTriggerFilters(repoURL)
+	if err != nil {
+		return p, err
+	}
+	if filters.AllowBots || len(filters.IgnoreAuthors) > 0 || len(filters.IgnoreMessages) > 0 {
+		p.TriggerFilters = &filters
+	}
+	webhook, err := getWebhookSettings(repoURL)
+	if err != nil && err != sql.ErrNoRows {
+		return p, err
+	}
+	if err == nil {
+		if webhook.Secret != "" {
+			webhook.Secret = secretPlaceholder
+		}
+		if webhook.Token != "" {
+			webhook.Token = secretPlaceholder
+		}
+		p.Webhook = &webhook
+	}
+	limit, err := getImageSizeLimit(repoURL)
+	if err != nil && err != sql.ErrNoRows {
+		return p, err
+	}
+	if err == nil {
+		p.SizeLimit = &limit
+	}
+	registry, err := getRegistrySettings(repoURL)
+	if err != nil && err != sql.ErrNoRows {
+		return p, err
+	}
+	if err == nil {
+		if registry.Password != "" {
+			registry.Password = secretPlaceholder
+		}
+		p.Registry = &registry
+	}
+	naming, err := getImageNaming(repoURL)
+	if err != nil && err != sql.ErrNoRows {
+		return p, err
+	}
+	if err == nil {
+		p.ImageNaming = &naming
+	}
+	gpu, err := getGPUSettings(repoURL)
+	if err != nil && err != sql.ErrNoRows {
+		return p, err
+	}
+	if err == nil {
+		p.MaxGPUs = &gpu.MaxGPUs
+	}
+	return p, nil
+}
+
+// validateProject checks an imported project's settings as the API
+// checks each of them when it is set.
+func validateProject(p *ProjectConfig) error {
+	if p.RepoUrl == "" {
+		return fmt.Errorf("project without repoUrl")
+	}
+	if err := validateRepoURL(p.RepoUrl); err != nil {
+		return err
+	}
+	if err := checkPlaceholders(p.RepoUrl, p.BuildArgs); err != nil {
+		return err
+	}
+	if err := validateSchema(p.Parameters); err != nil {
+		return err
+	}
+	if err := validateBuildArgs(p.BuildArgs); err != nil {
+		return err
+	}
+	if p.Compression != nil {
+		if err := validateCompression(*p.Compression); err != nil {
+			return err
+		}
+	}
+	if err := validateMetricRules(p.MetricRules); err != nil {
+		return err
+	}
+	if p.TriggerFilters != nil {
+		p.TriggerFilters.RepoUrl = p.RepoUrl
+		if err := validateTriggerFilters(*p.TriggerFilters); err != nil {
+			return err
+		}
+	}
+	if s := p.Webhook; s != nil {
+		s.RepoUrl = p.RepoUrl
+		if s.Secret == secretPlaceholder || s.Token == secretPlaceholder {
+			return fmt.Errorf("webhook of %s has a placeholder for its secret or token: replace it with the value or remove it", p.RepoUrl)
+		}
+		if s.Branch != "" {
+			if err := validateBranch(s.Branch); err != nil {
+				return err
+			}
+		}
+	}
+	if l := p.SizeLimit; l != nil {
+		l.RepoUrl = p.RepoUrl
+		if l.MaxSize < 0 {
+			return fmt.Errorf("maxSize of %s must not be negative", p.RepoUrl)
+		}
+		if err := validateSizeAction(l.Action); err != nil {
+			return err
+		}
+	}
+	if s := p.Registry; s != nil {
+		s.RepoUrl = p.RepoUrl
+		if s.Password == secretPlaceholder {
+			return fmt.Errorf("registry of %s has a placeholder for its password: replace it with the password or remove it", p.RepoUrl)
+		}
+		if err := validateRegistrySettings(*s); err != nil {
+			return err
+		}
+	}
+	if err := validateWorkerLabels(p.WorkerRequirements); err != nil {
+		return err
+	}
+	if n := p.ImageNaming; n != nil {
+		n.RepoUrl = p.RepoUrl
+		if err := validateImageNaming(*n); err != nil {
+			return err
+		}
+	}
+	if p.MaxGPUs != nil && *p.MaxGPUs < 0 {
+		return fmt.Errorf("maxGpus of %s must not be negative", p.RepoUrl)
+	}
+	if p.WorkspaceRetentionHours < 0 || p.WorkspaceRetentionHours > maxRetentionHours {
+		return fmt.Errorf("workspaceRetentionHours of %s must be between 0 and %d", p.RepoUrl, maxRetentionHours)
+	}
+	return nil
+}
+
+// scheduleRequest decodes the build request of a schedule.
+func scheduleRequest(s ScheduleConfig) (BuildRequest, string, error) {
+	var req BuildRequest
+	body, err := json.Marshal(s.Request)
+	if err != nil {
+		return req, "", err
+	}
+	err = json.Unmarshal(body, &req)
+	return req, string(body), err
+}
+
+// validateSchedule checks a schedule's build request as buildHandler
+// checks a request, and replaces it with the request as validated, which
+// is how scheduled builds are stored.
+func validateSchedule(s *ScheduleConfig) error {
+	req, _, err := scheduleRequest(*s)
+	if err != nil {
+		return fmt.Errorf("invalid request of schedule %s: %v", s.BuildId, err)
+	}
+	if err := checkPlaceholders(req.RepoUrl, req.BuildArgs); err != nil {
+		return err
+	}
+	if err := validateBuildRequest(&req); err != nil {
+		return fmt.Errorf("invalid request of schedule %s: %v", s.BuildId, err)
+	}
+	req.RunAt = nil
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	s.Request = nil
+	return json.Unmarshal(body, &s.Request)
+}
+
+func exportConfig() (ServerConfig, error) {
+	var cfg ServerConfig
+	var err error
+	if cfg.Dependencies, err = getDependencies(); err != nil {
+		return cfg, err
+	}
+	for i, d := range cfg.Dependencies {
+		cfg.Dependencies[i] = Dependency{Upstream: exportURL(d.Upstream), Downstream: exportURL(d.Downstream)}
+	}
+
+	rows, err := db.Query("SELECT build_id, run_at, request FROM scheduled_builds WHERE status = 'scheduled' ORDER BY run_at")
+	if err != nil {
+		return cfg, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var s ScheduleConfig
+		var body string
+		if err := rows.Scan(&s.BuildId, &s.RunAt, &body); err != nil {
+			return cfg, err
+		}
+		var req BuildRequest
+		if err := json.Unmarshal([]byte(body), &req); err != nil {
+			return cfg, err
+		}
+		req.RepoUrl = exportURL(req.RepoUrl)
+		req.BuildArgs = exportBuildArgs(req.BuildArgs)
+		masked, err := json.Marshal(req)
+		if err != nil {
+			return cfg, err
+		}
+		if err := json.Unmarshal(masked, &s.Request); err != nil {
+			return cfg, err
+		}
+		cfg.Schedules = append(cfg.Schedules, s)
+	}
+	if err := rows.Err(); err != nil {
+		return cfg, err
+	}
+
+	repos, err := configuredRepos()
+	if err != nil {
+		return cfg, err
+	}
+	for _, repo := range repos {
+		p, err := exportProject(repo)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.Projects = append(cfg.Projects, p)
+	}
+
+	rates, err := getCostRates()
+	if err != nil {
+		return cfg, err
+	}
+	if rates != (CostRates{}) {
+		cfg.CostRates = &rates
+	}
+	return cfg, nil
+}
+
+// importJSONSetting stores a setting kept as JSON in table's column,
+// unless repoURL already has one.
+func importJSONSetting(tx *sql.Tx, table, column, repoURL string, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT OR IGNORE INTO "+table+" (repo_url, "+column+") VALUES (?, ?)", repoURL, string(body))
+	return err
+}
+
+// importProject stores the settings of p that its repository doesn't
+// have yet.
+func importProject(tx *sql.Tx, p ProjectConfig) error {
+	repo := p.RepoUrl
+	if p.Parameters != nil {
+		if err := importJSONSetting(tx, "build_parameters", "parameters", repo, p.Parameters); err != nil {
+			return err
+		}
+	}
+	if p.BuildArgs != nil {
+		if err := importJSONSetting(tx, "default_build_args", "args", repo, p.BuildArgs); err != nil {
+			return err
+		}
+	}
+	if p.Compression != nil {
+		if err := importJSONSetting(tx, "build_compression", "compression", repo, p.Compression); err != nil {
+			return err
+		}
+	}
+	if p.MetricRules != nil {
+		if err := importJSONSetting(tx, "build_metric_rules", "rules", repo, p.MetricRules); err != nil {
+			return err
+		}
+	}
+	if p.TriggerFilters != nil {
+		if err := importJSONSetting(tx, "trigger_filters", "filters", repo, p.TriggerFilters); err != nil {
+			return err
+		}
+	}
+	if p.WorkerRequirements != nil {
+		if err := importJSONSetting(tx, "worker_requirements", "labels", repo, p.WorkerRequirements); err != nil {
+			return err
+		}
+	}
+	if s := p.Webhook; s != nil {
+		registerSecrets(s.Secret, s.Token)
+		_, err := tx.Exec("INSERT OR IGNORE INTO webhook_settings (repo_url, secret, branch, auto_build, token, dependency_bots, dependency_bot_scans, pull_requests) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+			repo, s.Secret, s.Branch, s.AutoBuild, s.Token, s.DependencyBots, s.DependencyBotScans, s.PullRequests)
+		if err != nil {
+			return err
+		}
+	}
+	if l := p.SizeLimit; l != nil {
+		if _, err := tx.Exec("INSERT OR IGNORE INTO image_size_limits (repo_url, max_size, action) VALUES (?, ?, ?)", repo, l.MaxSize, l.Action); err != nil {
+			return err
+		}
+	}
+	if s := p.Registry; s != nil {
+		registerSecrets(s.Password)
+		_, err := tx.Exec("INSERT OR IGNORE INTO registry_settings (repo_url, registry, repository, username, password, push) VALUES (?, ?, ?, ?, ?, ?)",
+			repo, s.Registry, s.Repository, s.Username, s.Password, s.Push)
+		if err != nil {
+			return err
+		}
+	}
+	if n := p.ImageNaming; n != nil {
+		if _, err := tx.Exec("INSERT OR IGNORE INTO image_naming (repo_url, name, tag_template) VALUES (?, ?, ?)", repo, n.Name, n.TagTemplate); err != nil {
+			return err
+		}
+	}
+	if p.MaxGPUs != nil {
+		if _, err := tx.Exec("INSERT OR IGNORE INTO gpu_settings (repo_url, max_gpus) VALUES (?, ?)", repo, *p.MaxGPUs); err != nil {
+			return err
+		}
+	}
+	if p.WorkspaceRetentionHours > 0 {
+		if _, err := tx.Exec("INSERT OR IGNORE INTO workspace_retention (repo_url, hours) VALUES (?, ?)", repo, p.WorkspaceRetentionHours); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// importConfig merges cfg into the database in one transaction. Entries
+// that already exist, down to each of a project's settings, are left
+// untouched.
+func importConfig(cfg ServerConfig) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, d := range cfg.Dependencies {
+		if _, err := tx.Exec("INSERT OR IGNORE INTO build_dependencies (upstream, downstream) VALUES (?, ?)", d.Upstream, d.Downstream); err != nil {
+			return err
+		}
+	}
+	for _, s := range cfg.Schedules {
+		req, body, err := scheduleRequest(s)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("INSERT OR IGNORE INTO scheduled_builds (build_id, repo_url, request, run_at, status) VALUES (?, ?, ?, ?, 'scheduled')", s.BuildId, req.RepoUrl, body, s.RunAt.UTC())
+		if err != nil {
+			return err
+		}
+	}
+	for _, p := range cfg.Projects {
+		if err := importProject(tx, p); err != nil {
+			return err
+		}
+	}
+	if cfg.CostRates != nil {
+		body, err := json.Marshal(cfg.CostRates)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec("INSERT OR IGNORE INTO cost_rates (id, rates) VALUES (1, ?)", string(body)); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// exportConfigHandler serves the server's configuration, which needs the
+// admin token.
+func exportConfigHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if !authorizeAdmin(w, r) {
+		return
+	}
+	cfg, err := exportConfig()
+	if err != nil {
+		http.Error(w, "Could not export configuration", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/yaml")
+	yaml.NewEncoder(w).Encode(cfg)
+}
+
+// importConfigHandler merges an exported configuration into the
+// server's, which needs the admin token.
+func importConfigHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if !authorizeAdmin(w, r) {
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Could not read request body", http.StatusBadRequest)
+		return
+	}
+	var cfg ServerConfig
+	if err := yaml.Unmarshal(body, &cfg); err != nil {
+		http.Error(w, "Invalid configuration: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	deps, err := getDependencies()
+	if err != nil {
+		http.Error(w, "Could not get dependencies", http.StatusInternalServerError)
+		return
+	}
+	for _, d := range cfg.Dependencies {
+		for _, repoURL := range []string{d.Upstream, d.Downstream} {
+			if err := validateRepoURL(repoURL); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := checkPlaceholders(repoURL, nil); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if createsCycle(deps, d) {
+			http.Error(w, "Imported dependencies would create a cycle", http.StatusConflict)
+			return
+		}
+		deps = append(deps, d)
+	}
+	for i := range cfg.Schedules {
+		if err := validateSchedule(&cfg.Schedules[i]); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	for i := range cfg.Projects {
+		if err := validateProject(&cfg.Projects[i]); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if rates := cfg.CostRates; rates != nil && (rates.PerBuildMinute < 0 || rates.PerGBMonth < 0) {
+		http.Error(w, "Rates must not be negative", http.StatusBadRequest)
+		return
+	}
+	if err := importConfig(cfg); err != nil {
+		http.Error(w, "Could not import configuration", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// monthFormat is how months are written in cost reports.
+const monthFormat = "2006-01"
+
+// hoursPerMonth is the average length of a month, over which storage is
+// billed per GiB.
+const hoursPerMonth = 730
+
+// CostRates price the server's use, for charging it back to the teams
+// whose repositories build on it.
+type CostRates struct {
+	// PerBuildMinute is charged for each minute a build runs, failed or
+	// not.
+	PerBuildMinute float64 `json:"perBuildMinute" yaml:"perBuildMinute"`
+	// PerGBMonth is charged for each GiB a repository keeps on the
+	// server for a month: its mirror and its images, as measured by
+	// periodic storage snapshots.
+	PerGBMonth float64 `json:"perGbMonth" yaml:"perGbMonth"`
+	Currency   string  `json:"currency,omitempty" yaml:"currency,omitempty"`
+}
+
+// ProjectCost is what one repository, or one organization's
+// repositories, used in a month and what it cost.
+type ProjectCost struct {
+	RepoUrl         string  `json:"repoUrl,omitempty"`
+	Org             string  `json:"org"`
+	Builds          int     `json:"builds"`
+	BuildMinutes    float64 `json:"buildMinutes"`
+	StorageGBMonths float64 `json:"storageGbMonths"`
+	Cost            float64 `json:"cost"`
+}
+
+// CostReport totals a month's costs per project and per organization.
+// Costs are worked out with the rates in force when each build finished
+// and each storage snapshot was taken.
+type CostReport struct {
+	Month    string        `json:"month"`
+	Rates    CostRates     `json:"rates"`
+	Projects []ProjectCost `json:"projects"`
+	Orgs     []ProjectCost `json:"orgs"`
+	Total    float64       `json:"total"`
+}
+
+// getCostRates returns the rates, which are zero until some are saved.
+func getCostRates() (CostRates, error) {
+	var rates CostRates
+	var body string
+	err := db.QueryRow("SELECT rates FROM cost_rates WHERE id = 1").Scan(&body)
+	if err == sql.ErrNoRows {
+		return rates, nil
+	}
+	if err != nil {
+		return rates, err
+	}
+	err = json.Unmarshal([]byte(body), &rates)
+	return rates, err
+}
+
+func saveCostRates(rates CostRates) error {
+	body, err := json.Marshal(rates)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("INSERT OR REPLACE INTO cost_rates (id, rates) VALUES (1, ?)", string(body))
+	return err
+}
+
+// repoOrg is the organization owning repoURL, the path element before
+// its name, such as "org" for https://github.com/org/app.git.
+func repoOrg(repoURL string) string {
+	u := strings.TrimSuffix(strings.TrimRight(repoURL, "/"), ".git")
+	// scp-like URLs separate the host with a colon: git@host:org/app
+	parts := strings.FieldsFunc(u, func(r rune) bool { return r == '/' || r == ':' })
+	if len(parts) < 2 {
+		return ""
+	}
+	return parts[len(parts)-2]
+}
+
+func roundCost(cost float64) float64 {
+	return math.Round(cost*100) / 100
+}
+
+// recordCost prices a finished build's run time with the current rates.
+func recordCost(e Event) {
+	if e.Type != EventBuildSucceeded && e.Type != EventBuildFailed {
+		return
+	}
+	go func() {
+		rates, err := getCostRates()
+		if err != nil {
+			log.Printf("Error getting cost rates: %v", err)
+			return
+		}
+		status, err := store.GetStatus(e.BuildId)
+		if err != nil {
+			log.Printf("Error getting status of %s for costs: %v", e.BuildId, err)
+			return
+		}
+		finished := time.Now().UTC()
+		if status.FinishedAt != nil {
+			finished = *status.FinishedAt
+		}
+		var seconds float64
+		if status.StartedAt != nil {
+			seconds = finished.Sub(*status.StartedAt).Seconds()
+		}
+		_, err = db.Exec("INSERT OR REPLACE INTO build_costs (build_id, repo_url, org, month, build_seconds, cost) VALUES (?, ?, ?, ?, ?, ?)",
+			e.BuildId, e.RepoUrl, repoOrg(e.RepoUrl), finished.UTC().Format(monthFormat), seconds, seconds/60*rates.PerBuildMinute)
+		if err != nil {
+			log.Printf("Error recording cost of %s: %v", e.BuildId, err)
+		}
+	}()
+}
+
+// snapshotStorageCosts measures each repository's storage and bills it
+// for the period since the last snapshot, so storage shared by many
+// builds is billed once, for as long as it is kept.
+func snapshotStorageCosts(period time.Duration) error {
+	rates, err := getCostRates()
+	if err != nil {
+		return err
+	}
+	images, err := store.BuiltImages("")
+	if err != nil {
+		return err
+	}
+	month := time.Now().UTC().Format(monthFormat)
+	for repo, repoImages := range images {
+		usage := repoStorage(repo, repoImages)
+		gbMonths := float64(usage.TotalBytes) / (1 << 30) * period.Hours() / hoursPerMonth
+		_, err := db.Exec(`INSERT INTO storage_costs (repo_url, org, month, gb_months, cost) VALUES (?, ?, ?, ?, ?)
+            ON CONFLICT (repo_url, month) DO UPDATE SET gb_months = gb_months + excluded.gb_months, cost = cost + excluded.cost`,
+			repo, repoOrg(repo), month, gbMonths, gbMonths*rates.PerGBMonth)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runStorageSnapshots bills storage every interval.
+func runStorageSnapshots(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := snapshotStorageCosts(interval); err != nil {
+			log.Printf("Error recording storage costs: %v", err)
+		}
+	}
+}
+
+// costReport totals the costs of builds that finished in month, limited
+// to org's repositories unless org is empty.
+func costReport(month, org string) (CostReport, error) {
+	report := CostReport{Month: month, Projects: []ProjectCost{}, Orgs: []ProjectCost{}}
+	var err error
+	if report.Rates, err = getCostRates(); err != nil {
+		return report, err
+	}
+	rows, err := db.Query(`SELECT repo_url, org, SUM(builds), SUM(build_seconds), SUM(gb_months), SUM(cost) FROM (
+            SELECT repo_url, org, 1 AS builds, build_seconds, 0 AS gb_months, cost FROM build_costs WHERE month = ?
+            UNION ALL
+            SELECT repo_url, org, 0, 0, gb_months, cost FROM storage_costs WHERE month = ?)
+        WHERE ? = '' OR org = ? GROUP BY repo_url, org ORDER BY SUM(cost) DESC, repo_url`, month, month, org, org)
+	if err != nil {
+		return report, err
+	}
+	defer rows.Close()
+
+	orgs := make(map[string]*ProjectCost)
+	for rows.Next() {
+		var p ProjectCost
+		var seconds float64
+		if err := rows.Scan(&p.RepoUrl, &p.Org, &p.Builds, &seconds, &p.StorageGBMonths, &p.Cost); err != nil {
+			return report, err
+		}
+		p.BuildMinutes = seconds / 60
+		o, ok := orgs[p.Org]
+		if !ok {
+			o = &ProjectCost{Org: p.Org}
+			orgs[p.Org] = o
+		}
+		o.Builds += p.Builds
+		o.BuildMinutes += p.BuildMinutes
+		o.StorageGBMonths += p.StorageGBMonths
+		o.Cost += p.Cost
+		report.Total += p.Cost
+		p.Cost = roundCost(p.Cost)
+		report.Projects = append(report.Projects, p)
+	}
+	for _, o := range orgs {
+		o.Cost = roundCost(o.Cost)
+		report.Orgs = append(report.Orgs, *o)
+	}
+	sort.Slice(report.Orgs, func(i, j int) bool {
+		if report.Orgs[i].Cost != report.Orgs[j].Cost {
+			return report.Orgs[i].Cost > report.Orgs[j].Cost
+		}
+		return report.Orgs[i].Org < report.Orgs[j].Org
+	})
+	report.Total = roundCost(report.Total)
+	return report, rows.Err()
+}
+
+func getCostRatesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	rates, err := getCostRates()
+	if err != nil {
+		http.Error(w, "Could not get cost rates", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(rates)
+}
+
+// setCostRatesHandler changes the rates of builds that finish from now
+// on; costs already recorded keep the rates they were worked out with.
+// It needs the admin token.
+func setCostRatesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if !authorizeAdmin(w, r) {
+		return
+	}
+	var rates CostRates
+	if err := json.NewDecoder(r.Body).Decode(&rates); err != nil {
+		http.Error(w, "Invalid cost rates", http.StatusBadRequest)
+		return
+	}
+	if rates.PerBuildMinute < 0 || rates.PerGBMonth < 0 {
+		http.Error(w, "Rates must not be negative", http.StatusBadRequest)
+		return
+	}
+	if err := saveCostRates(rates); err != nil {
+		http.Error(w, "Could not save cost rates", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(rates)
+}
+
+// costReportHandler reports the costs of ?month=YYYY-MM, by default the
+// current one, optionally for one ?org= only.
+func costReportHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	month := r.URL.Query().Get("month")
+	if month == "" {
+		month = time.Now().UTC().Format(monthFormat)
+	} else if _, err := time.Parse(monthFormat, month); err != nil {
+		http.Error(w, "month must look like 2006-01", http.StatusBadRequest)
+		return
+	}
+	report, err := costReport(month, r.URL.Query().Get("org"))
+	if err != nil {
+		log.Printf("Error building cost report: %v", err)
+		http.Error(w, "Could not build cost report", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	labelDebug          = "org.docker-build-server.debug"
+	defaultDebugImage   = "busybox"
+	defaultDebugTTL     = 30 * time.Minute
+	debugWorkspaceMount = "/workspace"
+)
+
+// DebugSession is a short-lived container with a failed build's
+// workspace mounted, which users can open a shell in.
+type DebugSession struct {
+	BuildId   string    `json:"buildId"`
+	Container string    `json:"container"`
+	Image     string    `json:"image"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	timer     *time.Timer
+}
+
+type DebugRequest struct {
+	// Image overrides the image the container runs, which defaults to
+	// the last base image of the build's Dockerfile.
+	Image string `json:"image"`
+}
+
+var debugSessions = struct {
+	sync.Mutex
+	sessions map[string]*DebugSession
+}{sessions: make(map[string]*DebugSession)}
+
+// debugToken gates debug sessions, which are disabled unless
+// DEBUG_SESSION_TOKEN is set.
+func debugToken() string {
+	return os.Getenv("DEBUG_SESSION_TOKEN")
+}
+
+// authorizeDebug checks the request carries the debug token, as a bearer
+// token or, since browsers cannot set headers on websockets, a token
+// query parameter.
+func authorizeDebug(w http.ResponseWriter, r *http.Request) bool {
+	token := debugToken()
+	if token == "" {
+		http.Error(w, "Debug sessions are disabled", http.StatusNotFound)
+		return false
+	}
+	given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if given == "" {
+		given = r.URL.Query().Get("token")
+	}
+	if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+		http.Error(w, "Invalid debug token", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// debugImage picks the image a debug container runs for the workspace
+// in dir: the last base image its Dockerfile builds FROM.
+func debugImage(dir string) string {
+	images := dockerfileBaseImages(filepath.Join(dir, "Dockerfile"))
+	for i := len(images) - 1; i >= 0; i-- {
+		if images[i] != "scratch" {
+			return images[i]
+		}
+	}
+	if image := os.Getenv("DEBUG_IMAGE"); image != "" {
+		return image
+	}
+	return defaultDebugImage
+}
+
+// startDebugSession runs a debug container for buildId that removes
+// itself after ttl, or when the workspace's retention runs out if sooner.
+func startDebugSession(buildId, image string) (*DebugSession, error) {
+	ws, err := getRetainedWorkspace(buildId)
+	if err != nil || !time.Now().Before(ws.ExpiresAt) {
+		return nil, fmt.Errorf("build %s has no retained workspace", buildId)
+	}
+	ttl := time.Duration(envInt("DEBUG_SESSION_TTL", int(defaultDebugTTL/time.Minute))) * time.Minute
+	if left := time.Until(ws.ExpiresAt); left < ttl {
+		ttl = left
+	}
+
+	debugSessions.Lock()
+	defer debugSessions.Unlock()
+	if s, ok := debugSessions.sessions[buildId]; ok {
+		return s, nil
+	}
+	dir := buildDir(buildId)
+	if image == "" {
+		image = debugImage(dir)
+	}
+	name := "dbs-debug-" + buildId
+	labels := imageLabels(ws.RepoUrl)
+	labels[labelDebug] = buildId
+	args := []string{"run", "--detach", "--rm", "--name", name, "--entrypoint", "sleep",
+		"--volume", dir + ":" + debugWorkspaceMount, "--workdir", debugWorkspaceMount}
+	args = append(args, labelFlags(labels)...)
+	args = append(args, image, fmt.Sprint(int(ttl.Seconds())))
+	if out, err := exec.Command("docker", args...).CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("starting debug container: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+
+	s := &DebugSession{BuildId: buildId, Container: name, Image: image, ExpiresAt: time.Now().UTC().Add(ttl)}
+	s.timer = time.AfterFunc(ttl, func() { stopDebugSession(buildId) })
+	debugSessions.sessions[buildId] = s
+	log.Printf("Started debug session %s for build %s with %s until %s", name, buildId, image, s.ExpiresAt.Format(time.RFC3339))
+	return s, nil
+}
+
+func getDebugSession(buildId string) (*DebugSession, bool) {
+	debugSessions.Lock()
+	defer debugSessions.Unlock()
+	s, ok := debugSessions.sessions[buildId]
+	return s, ok
+}
+
+// stopDebugSession removes buildId's debug container, ending any shells
+// open in it.
+func stopDebugSession(buildId string) bool {
+	debugSessions.Lock()
+	s, ok := debugSessions.sessions[buildId]
+	delete(debugSessions.sessions, buildId)
+	debugSessions.Unlock()
+	if !ok {
+		return false
+	}
+	s.timer.Stop()
+	if out, err := exec.Command("docker", "rm", "--force", s.Container).CombinedOutput(); err != nil {
+		log.Printf("Error removing debug container %s: %v: %s", s.Container, err, strings.TrimSpace(string(out)))
+	}
+	log.Printf("Stopped debug session %s for build %s", s.Container, buildId)
+	return true
+}
+
+func startDebugHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if !authorizeDebug(w, r) {
+		return
+	}
+	var req DebugRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+	s, err := startDebugSession(mux.Vars(r)["buildId"], req.Image)
+	if err != nil {
+		log.Printf("Error starting debug session: %v", err)
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	json.NewEncoder(w).Encode(s)
+}
+
+func getDebugHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if !authorizeDebug(w, r) {
+		return
+	}
+	s, ok := getDebugSession(mux.Vars(r)["buildId"])
+	if !ok {
+		http.Error(w, "No debug session for build", http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(s)
+}
+
+func stopDebugHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if !authorizeDebug(w, r) {
+		return
+	}
+	if !stopDebugSession(mux.Vars(r)["buildId"]) {
+		http.Error(w, "No debug session for build", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// debugExecHandler opens a shell in a build's debug container and
+// relays it over a websocket: messages from the client are written to
+// the shell's input and its output is sent back as text messages. The
+// shell has no TTY, so it echoes no input and programs needing a
+// terminal will not work.
+func debugExecHandler(w http.ResponseWriter, r *http.Request) {
+	if !authorizeDebug(w, r) {
+		return
+	}
+	buildId := mux.Vars(r)["buildId"]
+	s, ok := getDebugSession(buildId)
+	if !ok {
+		http.Error(w, "No debug session for build", http.StatusNotFound)
+		return
+	}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	cmd := exec.Command("docker", "exec", "--interactive", s.Container, "sh", "-i")
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return
+	}
+	out := &wsWriter{conn: conn}
+	cmd.Stdout = out
+	cmd.Stderr = out
+	if err := cmd.Start(); err != nil {
+		conn.WriteMessage(websocket.TextMessage, []byte("could not start shell: "+err.Error()+"\n"))
+		return
+	}
+	log.Printf("Opened debug shell in %s from %s", s.Container, r.RemoteAddr)
+
+	go func() {
+		defer stdin.Close()
+		for {
+			_, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if _, err := stdin.Write(msg); err != nil {
+				return
+			}
+		}
+	}()
+	err = cmd.Wait()
+	log.Printf("Closed debug shell in %s: %v", s.Container, err)
+	conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "shell exited"))
+}
+
+// wsWriter sends each write as a websocket text message.
+type wsWriter struct {
+	mu   sync.Mutex
+	conn *websocket.Conn
+}
+
+func (w *wsWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.conn.WriteMessage(websocket.TextMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
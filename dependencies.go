@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// Dependencies are declared between repositories: a successful build of
+// Upstream triggers a build of Downstream.
+type Dependency struct {
+	Upstream   string `json:"upstream" yaml:"upstream"`
+	Downstream string `json:"downstream" yaml:"downstream"`
+}
+
+type DependencyGraph struct {
+	Nodes []string     `json:"nodes"`
+	Edges []Dependency `json:"edges"`
+}
+
+func getDependencies() ([]Dependency, error) {
+	rows, err := db.Query("SELECT upstream, downstream FROM build_dependencies ORDER BY upstream, downstream")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deps []Dependency
+	for rows.Next() {
+		var d Dependency
+		if err := rows.Scan(&d.Upstream, &d.Downstream); err != nil {
+			return nil, err
+		}
+		deps = append(deps, d)
+	}
+	return deps, rows.Err()
+}
+
+func getDownstream(repoURL string) ([]string, error) {
+	rows, err := db.Query("SELECT downstream FROM build_dependencies WHERE upstream = ?", repoURL)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var downstream []string
+	for rows.Next() {
+		var d string
+		if err := rows.Scan(&d); err != nil {
+			return nil, err
+		}
+		downstream = append(downstream, d)
+	}
+	return downstream, rows.Err()
+}
+
+// createsCycle reports whether adding dep to deps would make a repository
+// (transitively) trigger itself.
+func createsCycle(deps []Dependency, dep Dependency) bool {
+	edges := make(map[string][]string)
+	for _, d := range deps {
+		edges[d.Upstream] = append(edges[d.Upstream], d.Downstream)
+	}
+	seen := make(map[string]bool)
+	stack := []string{dep.Downstream}
+	for len(stack) > 0 {
+		node := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if node == dep.Upstream {
+			return true
+		}
+		if seen[node] {
+			continue
+		}
+		seen[node] = true
+		stack = append(stack, edges[node]...)
+	}
+	return false
+}
+
+// triggerDownstream queues builds of every repository that depends on one
+// that just built successfully.
+func triggerDownstream(e Event) {
+	if e.Type != EventBuildSucceeded {
+		return
+	}
+	if buildsPaused() {
+		log.Printf("Not triggering downstream builds of %s while builds are paused", e.RepoUrl)
+		return
+	}
+	// Pull request builds are not on the branch downstream builds use.
+	if isPullRequestBuild(e.BuildId) {
+		return
+	}
+	downstream, err := getDownstream(e.RepoUrl)
+	if err != nil {
+		log.Printf("Error getting downstream dependencies: %v", err)
+		return
+	}
+	for _, repoURL := range downstream {
+		req := BuildRequest{RepoUrl: repoURL, Trigger: &Trigger{Source: TriggerDependency, UpstreamRepo: e.RepoUrl, UpstreamBuildId: e.BuildId}}
+		if err := validateBuildRequest(&req); err != nil {
+			log.Printf("Not triggering %s after %s: %v", repoURL, e.BuildId, err)
+			continue
+		}
+		buildId, ok := submitBuild(req)
+		if !ok {
+			log.Printf("Build queue full, not triggering %s after %s", repoURL, e.BuildId)
+			continue
+		}
+		log.Printf("Triggered build %s of %s after %s", buildId, repoURL, e.BuildId)
+	}
+}
+
+func saveDependency(dep Dependency) error {
+	_, err := db.Exec("INSERT OR IGNORE INTO build_dependencies (upstream, downstream) VALUES (?, ?)", dep.Upstream, dep.Downstream)
+	return err
+}
+
+func deleteDependency(dep Dependency) error {
+	_, err := db.Exec("DELETE FROM build_dependencies WHERE upstream = ? AND downstream = ?", dep.Upstream, dep.Downstream)
+	return err
+}
+
+func addDependencyHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	var dep Dependency
+	if err := json.NewDecoder(r.Body).Decode(&dep); err != nil || dep.Upstream == "" || dep.Downstream == "" {
+		http.Error(w, "Request must contain upstream and downstream", http.StatusBadRequest)
+		return
+	}
+	for _, repoURL := range []string{dep.Upstream, dep.Downstream} {
+		if err := validateRepoURL(repoURL); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	deps, err := getDependencies()
+	if err != nil {
+		http.Error(w, "Could not get dependencies", http.StatusInternalServerError)
+		return
+	}
+	if createsCycle(deps, dep) {
+		http.Error(w, "Dependency would create a cycle", http.StatusConflict)
+		return
+	}
+
+	if err := saveDependency(dep); err != nil {
+		http.Error(w, "Could not save dependency", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(dep)
+}
+
+func deleteDependencyHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	var dep Dependency
+	if err := json.NewDecoder(r.Body).Decode(&dep); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := deleteDependency(dep); err != nil {
+		http.Error(w, "Could not delete dependency", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// dependencyGraphHandler serves the dependency graph as JSON, or as
+// Graphviz DOT with ?format=dot.
+func dependencyGraphHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	deps, err := getDependencies()
+	if err != nil {
+		http.Error(w, "Could not get dependencies", http.StatusInternalServerError)
+		return
+	}
+
+	if r.URL.Query().Get("format") == "dot" {
+		var sb strings.Builder
+		sb.WriteString("digraph dependencies {\n")
+		for _, d := range deps {
+			fmt.Fprintf(&sb, "  %q -> %q;\n", d.Upstream, d.Downstream)
+		}
+		sb.WriteString("}\n")
+		w.Header().Set("Content-Type", "text/vnd.graphviz")
+		w.Write([]byte(sb.String()))
+		return
+	}
+
+	graph := DependencyGraph{Nodes: []string{}, Edges: deps}
+	seen := make(map[string]bool)
+	for _, d := range deps {
+		for _, node := range []string{d.Upstream, d.Downstream} {
+			if !seen[node] {
+				seen[node] = true
+				graph.Nodes = append(graph.Nodes, node)
+			}
+		}
+	}
+	json.NewEncoder(w).Encode(graph)
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Outcomes of a host check.
+const (
+	CheckOK      = "ok"
+	CheckFailed  = "failed"
+	CheckSkipped = "skipped"
+)
+
+const doctorTimeout = 10 * time.Second
+
+// HostCheck is one prerequisite of running builds on this host. Fix says
+// what to do about a failure.
+type HostCheck struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Detail string `json:"detail,omitempty"`
+	Fix    string `json:"fix,omitempty"`
+}
+
+// DoctorReport is the result of checking the host. Healthy is false if
+// any check failed.
+type DoctorReport struct {
+	Healthy   bool        `json:"healthy"`
+	Checks    []HostCheck `json:"checks"`
+	CheckedAt time.Time   `json:"checkedAt"`
+}
+
+func failedCheck(name, detail, fix string) HostCheck {
+	return HostCheck{Name: name, Status: CheckFailed, Detail: detail, Fix: fix}
+}
+
+func checkGit() HostCheck {
+	if _, err := exec.LookPath("git"); err != nil {
+		return failedCheck("git", "git is not on PATH", "install git")
+	}
+	v, err := toolVersion("git", "--version")
+	if err != nil {
+		return failedCheck("git", err.Error(), "reinstall git")
+	}
+	if err := checkToolVersion("git", v, "MIN_GIT_VERSION"); err != nil {
+		return failedCheck("git", err.Error(), "upgrade git or lower MIN_GIT_VERSION")
+	}
+	return HostCheck{Name: "git", Status: CheckOK, Detail: v}
+}
+
+// checkDocker checks that the Docker CLI can reach the daemon through its
+// socket, and the daemon's version.
+func checkDocker() []HostCheck {
+	if os.Getenv("EXECUTOR") == "fake" {
+		detail := "the fake executor does not use Docker"
+		return []HostCheck{{Name: "docker-socket", Status: CheckSkipped, Detail: detail}, {Name: "docker", Status: CheckSkipped, Detail: detail}}
+	}
+	if _, err := exec.LookPath("docker"); err != nil {
+		return []HostCheck{failedCheck("docker", "docker is not on PATH", "install the Docker CLI")}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), doctorTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, "docker", "version", "--format", "{{.Server.Version}}").CombinedOutput()
+	detail := strings.TrimSpace(string(out))
+	switch {
+	case ctx.Err() != nil:
+		return []HostCheck{failedCheck("docker-socket", fmt.Sprintf("the daemon did not answer within %s", doctorTimeout), "restart the Docker daemon")}
+	case err != nil && strings.Contains(detail, "permission denied"):
+		return []HostCheck{failedCheck("docker-socket", detail, "add the user running the server to the docker group, or set DOCKER_HOST to a daemon it may use")}
+	case err != nil:
+		return []HostCheck{failedCheck("docker-socket", detail, "start the Docker daemon, or set DOCKER_HOST to its address")}
+	}
+	checks := []HostCheck{{Name: "docker-socket", Status: CheckOK}}
+	v := versionPattern.FindString(detail)
+	if err := checkToolVersion("docker", v, "MIN_DOCKER_VERSION"); err != nil {
+		return append(checks, failedCheck("docker", err.Error(), "upgrade Docker or lower MIN_DOCKER_VERSION"))
+	}
+	return append(checks, HostCheck{Name: "docker", Status: CheckOK, Detail: v})
+}
+
+func checkBuildx() HostCheck {
+	if os.Getenv("EXECUTOR") == "fake" {
+		return HostCheck{Name: "buildx", Status: CheckSkipped, Detail: "the fake executor does not use Docker"}
+	}
+	if _, err := exec.LookPath("docker"); err != nil {
+		return HostCheck{Name: "buildx", Status: CheckSkipped, Detail: "docker is not on PATH"}
+	}
+	v, err := toolVersion("docker", "buildx", "version")
+	if err != nil {
+		return failedCheck("buildx", err.Error(), "install the docker-buildx plugin")
+	}
+	if err := checkToolVersion("buildx", v, "MIN_BUILDX_VERSION"); err != nil {
+		return failedCheck("buildx", err.Error(), "upgrade docker-buildx or lower MIN_BUILDX_VERSION")
+	}
+	return HostCheck{Name: "buildx", Status: CheckOK, Detail: v}
+}
+
+// checkDirectory checks that the server can write to dir, set by env,
+// and that its filesystem has at least MIN_FREE_DISK_MB free.
+func checkDirectory(name, dir, env string) HostCheck {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return failedCheck(name, err.Error(), fmt.Sprintf("create %s or set %s to a directory the server may write to", dir, env))
+	}
+	f, err := os.CreateTemp(dir, ".doctor-")
+	if err != nil {
+		return failedCheck(name, err.Error(), fmt.Sprintf("give the server write access to %s or set %s elsewhere", dir, env))
+	}
+	f.Close()
+	os.Remove(f.Name())
+
+	_, free := diskSpace(dir)
+	detail := fmt.Sprintf("%s, %s free", dir, formatSize(free))
+	if min := int64(envInt("MIN_FREE_DISK_MB", 5*1024)) << 20; free < min {
+		return failedCheck(name, fmt.Sprintf("%s, under %s", detail, formatSize(min)), fmt.Sprintf("free up space with POST /api/admin/cleanup or set %s to a larger disk", env))
+	}
+	return HostCheck{Name: name, Status: CheckOK, Detail: detail}
+}
+
+func checkDatabase() HostCheck {
+	if _, err := os.Stat("builds.db"); os.IsNotExist(err) {
+		return HostCheck{Name: "database", Status: CheckSkipped, Detail: "builds.db does not exist yet; the server creates it when it starts"}
+	}
+	// Opened apart from the server's handle, and without creating or
+	// migrating anything, so the check works before the server starts.
+	conn, err := sql.Open("sqlite3", "file:builds.db?mode=rw&_busy_timeout=5000")
+	if err != nil {
+		return failedCheck("database", err.Error(), "check builds.db in the working directory is readable")
+	}
+	defer conn.Close()
+	if err := conn.Ping(); err != nil {
+		return failedCheck("database", err.Error(), "check builds.db in the working directory is readable")
+	}
+	var n int
+	if err := conn.QueryRow("SELECT COUNT(*) FROM builds").Scan(&n); err != nil {
+		return failedCheck("database", err.Error(), "check builds.db is a build server database and not corrupt")
+	}
+	// An update that matches nothing still needs the write lock, which a
+	// read-only file or directory refuses.
+	if _, err := conn.Exec("UPDATE builds SET id = id WHERE 0"); err != nil {
+		return failedCheck("database", err.Error(), "give the server write access to builds.db and its directory")
+	}
+	return HostCheck{Name: "database", Status: CheckOK, Detail: fmt.Sprintf("%d builds", n)}
+}
+
+// checkFanout checks that FANOUT_URLS parses, which the server otherwise
+// refuses to start over.
+func checkFanout() HostCheck {
+	targets, err := fanoutTargetsFromEnv()
+	if err != nil {
+		return failedCheck("fanout", err.Error(), "correct FANOUT_URLS")
+	}
+	return HostCheck{Name: "fanout", Status: CheckOK, Detail: fmt.Sprintf("%d targets", len(targets))}
+}
+
+// runDoctor checks that the host has what builds need, so a broken setup
+// is reported with what to do about it rather than as a failed command
+// halfway through a build.
+func runDoctor() DoctorReport {
+	report := DoctorReport{Healthy: true, CheckedAt: time.Now().UTC()}
+	report.Checks = append(report.Checks, checkGit())
+	report.Checks = append(report.Checks, checkDocker()...)
+	report.Checks = append(report.Checks, checkBuildx())
+	report.Checks = append(report.Checks, checkDirectory("workspaces", workspaceRoot, "WORKSPACE_DIR"))
+	report.Checks = append(report.Checks, checkDirectory("logs", logDir, "LOG_DIR"))
+	if mirrorDir != "" {
+		report.Checks = append(report.Checks, checkDirectory("mirrors", mirrorDir, "MIRROR_DIR"))
+	}
+	report.Checks = append(report.Checks, checkDatabase())
+	if os.Getenv("FANOUT_URLS") != "" {
+		report.Checks = append(report.Checks, checkFanout())
+	}
+	for _, c := range report.Checks {
+		if c.Status == CheckFailed {
+			report.Healthy = false
+		}
+	}
+	return report
+}
+
+// logDoctor logs the failed checks of report.
+func logDoctor(report DoctorReport) {
+	for _, c := range report.Checks {
+		if c.Status == CheckFailed {
+			log.Printf("Host check %s failed: %s; to fix, %s", c.Name, c.Detail, c.Fix)
+		}
+	}
+}
+
+// doctorCommand runs the checks for the doctor subcommand, printing each
+// and exiting non-zero if any failed.
+func doctorCommand() {
+	report := runDoctor()
+	for _, c := range report.Checks {
+		line := fmt.Sprintf("%-8s %-14s %s", c.Status, c.Name, c.Detail)
+		if c.Fix != "" {
+			line += "\n         to fix, " + c.Fix
+		}
+		fmt.Println(line)
+	}
+	if !report.Healthy {
+		os.Exit(1)
+	}
+}
+
+// doctorHandler reports the host checks, with 503 if any failed.
+func doctorHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	report := runDoctor()
+	if !report.Healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// buildEnvironmentVars are the server settings that change how a build
+// runs. Values are recorded as set, so none of them may hold a secret.
+var buildEnvironmentVars = []string{
+	"BUILD_OVERRIDE_ALLOWLIST",
+	"BUILDX_BUILDER",
+	"BUILD_STALL_TIMEOUT",
+	"GPU_COUNT",
+	"INSTANCE_NAME",
+	"LICENSE_DENYLIST",
+	"LICENSE_SCAN",
+	"MIN_BUILDX_VERSION",
+	"MIN_DOCKER_VERSION",
+	"MIN_GIT_VERSION",
+	"MIRROR_DIR",
+	"PIN_BASE_IMAGES",
+	"PREPULL_BASE_IMAGES",
+	"SECRET_SCAN",
+	"SECRET_SCAN_FAIL",
+	"WORKER_LABELS",
+}
+
+// BuildEnvironment is the effective configuration a build ran with,
+// recorded once when it starts building so later changes to the
+// repository's settings or the server leave it explainable.
+type BuildEnvironment struct {
+	RepoUrl   string            `json:"repoUrl"`
+	CommitID  string            `json:"commitId"`
+	Tag       string            `json:"tag"`
+	Compose   bool              `json:"compose,omitempty"`
+	BuildArgs map[string]string `json:"buildArgs"`
+	Labels    map[string]string `json:"labels"`
+	Request   BuildRequest      `json:"request"`
+	Project   ProjectSettings   `json:"project"`
+	Policy    Policy            `json:"policy"`
+	Tools     ToolVersions      `json:"tools"`
+	Builder   BuilderInfo       `json:"builder"`
+	// Server holds the build-related environment variables that were set.
+	Server        map[string]string `json:"server"`
+	ServerVersion VersionInfo       `json:"serverVersion"`
+	RecordedAt    time.Time         `json:"recordedAt"`
+}
+
+// ProjectSettings are the per-repository settings in effect for a build.
+type ProjectSettings struct {
+	Parameters              []Parameter       `json:"parameters,omitempty"`
+	BuildArgs               map[string]string `json:"buildArgs,omitempty"`
+	Compression             *Compression      `json:"compression,omitempty"`
+	MetricRules             []MetricRule      `json:"metricRules,omitempty"`
+	WorkspaceRetentionHours int               `json:"workspaceRetentionHours"`
+	Upstreams               []string          `json:"upstreams,omitempty"`
+	Registry                *RegistrySettings `json:"registry,omitempty"`
+	WorkerRequirements      map[string]string `json:"workerRequirements,omitempty"`
+	ImageNaming             *ImageNaming      `json:"imageNaming,omitempty"`
+	MaxGPUs                 int               `json:"maxGpus,omitempty"`
+}
+
+// BuilderInfo identifies the buildx builder a build used.
+type BuilderInfo struct {
+	Name      string `json:"name,omitempty"`
+	Driver    string `json:"driver,omitempty"`
+	Platforms string `json:"platforms,omitempty"`
+}
+
+func projectSettings(repoURL string) (ProjectSettings, error) {
+	var p ProjectSettings
+	var err error
+	if p.Parameters, err = getParameters(repoURL); err != nil && err != sql.ErrNoRows {
+		return p, err
+	}
+	if p.BuildArgs, err = getDefaultBuildArgs(repoURL); err != nil && err != sql.ErrNoRows {
+		return p, err
+	}
+	p.BuildArgs = redactValues(p.BuildArgs)
+	if p.Compression, err = getCompression(repoURL); err != nil && err != sql.ErrNoRows {
+		return p, err
+	}
+	if p.MetricRules, err = getMetricRules(repoURL); err != nil && err != sql.ErrNoRows {
+		return p, err
+	}
+	if p.WorkerRequirements, err = getWorkerRequirements(repoURL); err != nil && err != sql.ErrNoRows {
+		return p, err
+	}
+	gpu, err := getGPUSettings(repoURL)
+	if err != nil && err != sql.ErrNoRows {
+		return p, err
+	}
+	p.MaxGPUs = gpu.MaxGPUs
+	naming, err := getImageNaming(repoURL)
+	if err != nil && err != sql.ErrNoRows {
+		return p, err
+	}
+	if err == nil {
+		p.ImageNaming = &naming
+	}
+	if p.WorkspaceRetentionHours, err = getWorkspaceRetention(repoURL); err != nil {
+		return p, err
+	}
+	deps, err := getDependencies()
+	if err != nil {
+		return p, err
+	}
+	for _, d := range deps {
+		if d.Downstream == repoURL {
+			p.Upstreams = append(p.Upstreams, d.Upstream)
+		}
+	}
+	registry, err := getRegistrySettings(repoURL)
+	if err != nil && err != sql.ErrNoRows {
+		return p, err
+	}
+	if err == nil {
+		registry.Password = ""
+		p.Registry = &registry
+	}
+	return p, nil
+}
+
+// currentBuilder describes the buildx builder from docker buildx inspect.
+func currentBuilder() BuilderInfo {
+	var b BuilderInfo
+	out, err := exec.Command("docker", "buildx", "inspect").Output()
+	if err != nil {
+		return b
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch strings.TrimSpace(key) {
+		case "Name":
+			if b.Name == "" {
+				b.Name = value
+			}
+		case "Driver":
+			b.Driver = value
+		case "Platforms":
+			b.Platforms = value
+		}
+	}
+	return b
+}
+
+func serverSettings() map[string]string {
+	settings := make(map[string]string)
+	for _, name := range buildEnvironmentVars {
+		if v, ok := os.LookupEnv(name); ok {
+			settings[name] = redact(v)
+		}
+	}
+	return settings
+}
+
+// saveBuildEnvironment records env for buildId. The record is never
+// replaced.
+func saveBuildEnvironment(buildId string, env BuildEnvironment) error {
+	body, err := json.Marshal(env)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("INSERT INTO build_environments (build_id, environment) VALUES (?, ?)", buildId, string(body))
+	return err
+}
+
+// getBuildEnvironment returns the environment recorded for buildId as
+// stored.
+func getBuildEnvironment(buildId string) (string, error) {
+	var body string
+	err := db.QueryRow("SELECT environment FROM build_environments WHERE build_id = ?", buildId).Scan(&body)
+	return body, err
+}
+
+func buildEnvironmentHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	body, err := getBuildEnvironment(mux.Vars(r)["buildId"])
+	if err == sql.ErrNoRows {
+		http.Error(w, "No environment recorded for build", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Could not get build environment", http.StatusInternalServerError)
+		return
+	}
+	// Served as stored, so the record reads the same however the types
+	// above change later.
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(body))
+}
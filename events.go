@@ -0,0 +1,60 @@
+package main
+
+import "sync"
+
+// Build lifecycle event types.
+const (
+	EventBuildStarted   = "build.started"
+	EventStageStarted   = "build.stage"
+	EventBuildSucceeded = "build.succeeded"
+	EventBuildFailed    = "build.failed"
+)
+
+// Event describes a step in a build's lifecycle.
+type Event struct {
+	Type     string
+	BuildId  string
+	RepoUrl  string
+	Branch   string
+	CommitID string
+	Commit   CommitInfo
+	// BaseCommit is the previously built commit ChangedFiles is relative to.
+	BaseCommit   string
+	ChangedFiles []string
+	Image        string
+	ImageDigest  string
+	Overrides    map[string]string
+	Parameters   map[string]interface{}
+	Compression  *Compression
+	Stage        string
+	Err          error
+	// Images lists each service's image for compose builds.
+	Images []BuiltImage
+	// Concurrency is the build limit daemon throttling set.
+	Concurrency int
+}
+
+// EventBus fans lifecycle events out to subscribers. Subscribers run
+// synchronously in registration order, so one that does slow work
+// should hand it off to its own goroutine.
+type EventBus struct {
+	mu          sync.RWMutex
+	subscribers []func(Event)
+}
+
+func (b *EventBus) Subscribe(fn func(Event)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subscribers = append(b.subscribers, fn)
+}
+
+func (b *EventBus) Publish(e Event) {
+	b.mu.RLock()
+	subscribers := b.subscribers
+	b.mu.RUnlock()
+	for _, fn := range subscribers {
+		fn(e)
+	}
+}
+
+var bus = &EventBus{}
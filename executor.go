@@ -0,0 +1,128 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	mathrand "math/rand"
+	"time"
+)
+
+// Executor runs a queued build, publishing its lifecycle events.
+type Executor interface {
+	Run(buildId string, req BuildRequest)
+}
+
+// dockerExecutor clones repositories and builds them with buildx.
+type dockerExecutor struct{}
+
+func (dockerExecutor) Run(buildId string, req BuildRequest) {
+	runBuild(buildId, req)
+}
+
+// fakeExecutor simulates builds without git or Docker, emitting synthetic
+// buildx output over the configured duration and failing at the
+// configured rate, so the API, queue and websocket layers can be load
+// tested anywhere.
+type fakeExecutor struct {
+	duration       time.Duration
+	failurePercent int
+	logLines       int
+}
+
+// executor runs every build, selected with EXECUTOR: "docker", the
+// default, or "fake".
+var executor Executor = dockerExecutor{}
+
+func newExecutor(kind string) (Executor, error) {
+	switch kind {
+	case "", "docker":
+		return dockerExecutor{}, nil
+	case "fake":
+		return fakeExecutor{
+			duration:       time.Duration(envInt("FAKE_EXECUTOR_DURATION_MS", 5000)) * time.Millisecond,
+			failurePercent: envInt("FAKE_EXECUTOR_FAILURE_PERCENT", 10),
+			logLines:       max(1, envInt("FAKE_EXECUTOR_LOG_LINES", 50)),
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown executor %q", kind)
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func (f fakeExecutor) Run(buildId string, req BuildRequest) {
+	bus.Publish(Event{Type: EventBuildStarted, BuildId: buildId, RepoUrl: req.RepoUrl})
+	if err := saveTrigger(buildId, req.Trigger); err != nil {
+		log.Printf("Error saving build trigger: %v", err)
+	}
+	commitID := randomHex(20)
+	fail := func(err error) {
+		bus.Publish(Event{Type: EventBuildFailed, BuildId: buildId, RepoUrl: req.RepoUrl, CommitID: commitID, Err: err})
+	}
+
+	// Spread the duration over the lines with up to 50% jitter either way.
+	jitter := 0.5 + mathrand.Float64()
+	pause := time.Duration(float64(f.duration) * jitter / float64(f.logLines+4))
+	out := &LogStreamer{buildId: buildId}
+	emit := func(format string, args ...interface{}) error {
+		if err := abortError(buildId); err != nil {
+			return err
+		}
+		time.Sleep(pause)
+		fmt.Fprintf(out, format+"\n", args...)
+		return nil
+	}
+
+	bus.Publish(Event{Type: EventStageStarted, BuildId: buildId, RepoUrl: req.RepoUrl, Stage: "clone"})
+	logStageMarker(buildId, "clone", "START")
+	err := emit("Cloning into '%s'...", buildDir(buildId))
+	if err == nil {
+		err = emit("HEAD is now at %s", commitID[:7])
+	}
+	logStageMarker(buildId, "clone", "END")
+	if err != nil {
+		fail(err)
+		return
+	}
+
+	bus.Publish(Event{Type: EventStageStarted, BuildId: buildId, RepoUrl: req.RepoUrl, CommitID: commitID, Stage: "build"})
+	logStageMarker(buildId, "build", "START")
+	err = emit(`#0 building with "fake" instance using fake driver`)
+	for i := 1; i <= f.logLines && err == nil; i++ {
+		if err = emit("#%d [%d/%d] RUN step %d", i, i, f.logLines, i); err != nil {
+			break
+		}
+		if mathrand.Intn(2) == 0 {
+			err = emit("#%d CACHED", i)
+		} else {
+			err = emit("#%d DONE %.1fs", i, pause.Seconds())
+		}
+	}
+	logStageMarker(buildId, "build", "END")
+	if err == nil && mathrand.Intn(100) < f.failurePercent {
+		err = errors.New("simulated build failure")
+	}
+	if err != nil {
+		fail(err)
+		return
+	}
+
+	bus.Publish(Event{
+		Type:        EventBuildSucceeded,
+		BuildId:     buildId,
+		RepoUrl:     req.RepoUrl,
+		Branch:      req.Branch,
+		CommitID:    commitID,
+		Commit:      CommitInfo{Author: "Fake Executor", AuthorEmail: "fake@example.invalid", Message: "Simulated commit", CommittedAt: time.Now().UTC()},
+		Image:       "myapp:" + commitID,
+		ImageDigest: "sha256:" + randomHex(32),
+		Overrides:   req.Overrides,
+		Parameters:  req.Parameters,
+	})
+}
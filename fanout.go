@@ -0,0 +1,443 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	fanoutQueueSize   = 4096
+	fanoutDialTimeout = 5 * time.Second
+	fanoutIOTimeout   = 10 * time.Second
+	// fanoutStreamMaxLen caps Redis streams so an idle consumer cannot
+	// fill the server's memory.
+	fanoutStreamMaxLen = 100000
+)
+
+// FanoutMessage is a build log line or lifecycle event as republished to
+// external consumers.
+type FanoutMessage struct {
+	Kind    string       `json:"kind"`
+	BuildId string       `json:"buildId"`
+	Time    time.Time    `json:"time"`
+	Line    string       `json:"line,omitempty"`
+	Event   *FanoutEvent `json:"event,omitempty"`
+}
+
+// FanoutEvent is the JSON form of an Event.
+type FanoutEvent struct {
+	Type        string       `json:"type"`
+	RepoUrl     string       `json:"repoUrl,omitempty"`
+	CommitID    string       `json:"commitId,omitempty"`
+	Stage       string       `json:"stage,omitempty"`
+	Image       string       `json:"image,omitempty"`
+	ImageDigest string       `json:"imageDigest,omitempty"`
+	Images      []BuiltImage `json:"images,omitempty"`
+	Error       string       `json:"error,omitempty"`
+	Concurrency int          `json:"concurrency,omitempty"`
+}
+
+// Kinds of fan-out message, which also name the NATS subject and Kafka
+// topic suffix they are published to.
+const (
+	FanoutKindLog   = "log"
+	FanoutKindEvent = "event"
+)
+
+// fanoutSink publishes messages to one external system.
+type fanoutSink interface {
+	publish(kind, buildId string, payload []byte) error
+	// reset drops the sink's connection after an error so the next
+	// publish reconnects.
+	reset()
+}
+
+// fanoutTarget queues messages for a sink so slow or unreachable
+// consumers never hold up a build.
+type fanoutTarget struct {
+	name    string
+	sink    fanoutSink
+	queue   chan FanoutMessage
+	sent    atomic.Int64
+	dropped atomic.Int64
+	failed  atomic.Int64
+}
+
+var fanoutTargets []*fanoutTarget
+
+// loadFanout configures a target for each URL in the comma-separated
+// FANOUT_URLS:
+//
+//	nats://[user:pass@]host:4222/subject     publishes to subject.log and subject.event
+//	redis://[:pass@]host:6379/stream         XADDs to stream
+//	kafka+http://host:8082/topic             produces to topic.log and topic.event
+//	                                         through a Kafka REST proxy
+//
+// The subject, stream and topic default to "builds".
+func loadFanout() error {
+	targets, err := fanoutTargetsFromEnv()
+	if err != nil {
+		return err
+	}
+	for _, t := range targets {
+		fanoutTargets = append(fanoutTargets, t)
+		go t.run()
+	}
+	return nil
+}
+
+// fanoutTargetsFromEnv parses FANOUT_URLS into targets that are not yet
+// running.
+func fanoutTargetsFromEnv() ([]*fanoutTarget, error) {
+	var targets []*fanoutTarget
+	for _, raw := range strings.Split(os.Getenv("FANOUT_URLS"), ",") {
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			continue
+		}
+		u, err := url.Parse(raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid fan-out URL: %v", err)
+		}
+		sink, err := newFanoutSink(u)
+		if err != nil {
+			return nil, fmt.Errorf("invalid fan-out URL %s: %v", u.Redacted(), err)
+		}
+		targets = append(targets, &fanoutTarget{name: u.Redacted(), sink: sink, queue: make(chan FanoutMessage, fanoutQueueSize)})
+	}
+	return targets, nil
+}
+
+func newFanoutSink(u *url.URL) (fanoutSink, error) {
+	name := strings.Trim(u.Path, "/")
+	if name == "" {
+		name = "builds"
+	}
+	switch u.Scheme {
+	case "nats":
+		return &natsSink{addr: hostWithPort(u, "4222"), user: u.User, subject: name}, nil
+	case "redis":
+		return &redisSink{addr: hostWithPort(u, "6379"), user: u.User, stream: name}, nil
+	case "kafka+http", "kafka+https":
+		proxy := strings.TrimPrefix(u.Scheme, "kafka+") + "://" + u.Host
+		return &kafkaRESTSink{proxy: proxy, topic: name}, nil
+	}
+	return nil, fmt.Errorf("unsupported scheme %q", u.Scheme)
+}
+
+func hostWithPort(u *url.URL, port string) string {
+	if u.Port() == "" {
+		return net.JoinHostPort(u.Hostname(), port)
+	}
+	return u.Host
+}
+
+func (t *fanoutTarget) enqueue(m FanoutMessage) {
+	select {
+	case t.queue <- m:
+	default:
+		t.dropped.Add(1)
+	}
+}
+
+func (t *fanoutTarget) run() {
+	for m := range t.queue {
+		payload, err := json.Marshal(m)
+		if err != nil {
+			log.Printf("Error encoding fan-out message: %v", err)
+			continue
+		}
+		// Retry once so a connection the consumer closed while idle is
+		// re-established without losing the message.
+		err = t.sink.publish(m.Kind, m.BuildId, payload)
+		if err != nil {
+			t.sink.reset()
+			err = t.sink.publish(m.Kind, m.BuildId, payload)
+		}
+		if err != nil {
+			t.sink.reset()
+			if t.failed.Add(1) == 1 {
+				log.Printf("Error publishing to %s: %v", t.name, err)
+			}
+			continue
+		}
+		if failed := t.failed.Swap(0); failed > 0 {
+			log.Printf("Publishing to %s recovered after %d failed messages", t.name, failed)
+		}
+		t.sent.Add(1)
+	}
+}
+
+func fanout(m FanoutMessage) {
+	for _, t := range fanoutTargets {
+		t.enqueue(m)
+	}
+}
+
+// fanoutLog republishes a build log line, already redacted.
+func fanoutLog(buildId, line string) {
+	if len(fanoutTargets) == 0 {
+		return
+	}
+	fanout(FanoutMessage{Kind: FanoutKindLog, BuildId: buildId, Time: time.Now().UTC(), Line: line})
+}
+
+// fanoutEvent republishes lifecycle events.
+func fanoutEvent(e Event) {
+	if len(fanoutTargets) == 0 {
+		return
+	}
+	fe := &FanoutEvent{
+		Type:        e.Type,
+		RepoUrl:     e.RepoUrl,
+		CommitID:    e.CommitID,
+		Stage:       e.Stage,
+		Image:       e.Image,
+		ImageDigest: e.ImageDigest,
+		Images:      e.Images,
+		Concurrency: e.Concurrency,
+	}
+	if e.Err != nil {
+		fe.Error = redact(e.Err.Error())
+	}
+	fanout(FanoutMessage{Kind: FanoutKindEvent, BuildId: e.BuildId, Time: time.Now().UTC(), Event: fe})
+}
+
+// natsSink publishes over the NATS client protocol, answering the
+// server's keepalive PINGs from a reader goroutine.
+type natsSink struct {
+	addr    string
+	user    *url.Userinfo
+	subject string
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+func (s *natsSink) connect() error {
+	conn, err := net.DialTimeout("tcp", s.addr, fanoutDialTimeout)
+	if err != nil {
+		return err
+	}
+	r := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(fanoutIOTimeout))
+	info, err := r.ReadString('\n')
+	if err != nil || !strings.HasPrefix(info, "INFO ") {
+		conn.Close()
+		return fmt.Errorf("unexpected NATS greeting %q: %v", strings.TrimSpace(info), err)
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	opts := map[string]interface{}{"verbose": false, "pedantic": false, "name": "docker-build-server"}
+	if s.user != nil {
+		opts["user"] = s.user.Username()
+		if pass, ok := s.user.Password(); ok {
+			opts["pass"] = pass
+		}
+	}
+	connect, _ := json.Marshal(opts)
+	if _, err := fmt.Fprintf(conn, "CONNECT %s\r\n", connect); err != nil {
+		conn.Close()
+		return err
+	}
+	s.conn = conn
+	go s.read(conn, r)
+	return nil
+}
+
+func (s *natsSink) read(conn net.Conn, r *bufio.Reader) {
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			s.mu.Lock()
+			if s.conn == conn {
+				s.conn.Close()
+				s.conn = nil
+			}
+			s.mu.Unlock()
+			return
+		}
+		switch {
+		case strings.HasPrefix(line, "PING"):
+			s.mu.Lock()
+			conn.Write([]byte("PONG\r\n"))
+			s.mu.Unlock()
+		case strings.HasPrefix(line, "-ERR"):
+			log.Printf("NATS server %s: %s", s.addr, strings.TrimSpace(line))
+		}
+	}
+}
+
+func (s *natsSink) publish(kind, buildId string, payload []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		if err := s.connect(); err != nil {
+			return err
+		}
+	}
+	s.conn.SetWriteDeadline(time.Now().Add(fanoutIOTimeout))
+	_, err := fmt.Fprintf(s.conn, "PUB %s.%s %d\r\n%s\r\n", s.subject, kind, len(payload), payload)
+	return err
+}
+
+func (s *natsSink) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+}
+
+// redisSink appends messages to a Redis stream with XADD, one entry per
+// message with kind, buildId and data fields.
+type redisSink struct {
+	addr   string
+	user   *url.Userinfo
+	stream string
+
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func (s *redisSink) connect() error {
+	conn, err := net.DialTimeout("tcp", s.addr, fanoutDialTimeout)
+	if err != nil {
+		return err
+	}
+	s.conn, s.r = conn, bufio.NewReader(conn)
+	if s.user != nil {
+		args := []string{"AUTH"}
+		if name := s.user.Username(); name != "" {
+			args = append(args, name)
+		}
+		pass, _ := s.user.Password()
+		if err := s.command(append(args, pass)...); err != nil {
+			s.reset()
+			return fmt.Errorf("redis AUTH: %v", err)
+		}
+	}
+	return nil
+}
+
+// command sends args as a RESP array and reads a simple, bulk or integer
+// reply, returning any error reply as an error.
+func (s *redisSink) command(args ...string) error {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(a), a)
+	}
+	s.conn.SetDeadline(time.Now().Add(fanoutIOTimeout))
+	if _, err := s.conn.Write(b.Bytes()); err != nil {
+		return err
+	}
+	reply, err := s.r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	reply = strings.TrimRight(reply, "\r\n")
+	switch {
+	case strings.HasPrefix(reply, "-"):
+		return errors.New(reply[1:])
+	case strings.HasPrefix(reply, "$"):
+		n, err := strconv.Atoi(reply[1:])
+		if err != nil {
+			return fmt.Errorf("unexpected reply %q", reply)
+		}
+		if n >= 0 {
+			_, err = io.CopyN(io.Discard, s.r, int64(n)+2)
+		}
+		return err
+	case strings.HasPrefix(reply, "+"), strings.HasPrefix(reply, ":"):
+		return nil
+	}
+	return fmt.Errorf("unexpected reply %q", reply)
+}
+
+func (s *redisSink) publish(kind, buildId string, payload []byte) error {
+	if s.conn == nil {
+		if err := s.connect(); err != nil {
+			return err
+		}
+	}
+	return s.command("XADD", s.stream, "MAXLEN", "~", strconv.Itoa(fanoutStreamMaxLen), "*",
+		"kind", kind, "buildId", buildId, "data", string(payload))
+}
+
+func (s *redisSink) reset() {
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn, s.r = nil, nil
+	}
+}
+
+// kafkaRESTSink produces to Kafka through a Confluent-compatible REST
+// proxy, keyed by build so each build's messages stay in order.
+type kafkaRESTSink struct {
+	proxy string
+	topic string
+}
+
+var fanoutClient = &http.Client{Timeout: fanoutIOTimeout}
+
+func (s *kafkaRESTSink) publish(kind, buildId string, payload []byte) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"records": []map[string]interface{}{{"key": buildId, "value": json.RawMessage(payload)}},
+	})
+	if err != nil {
+		return err
+	}
+	resp, err := fanoutClient.Post(s.proxy+"/topics/"+url.PathEscape(s.topic+"."+kind),
+		"application/vnd.kafka.json.v2+json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("kafka REST proxy returned %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+func (s *kafkaRESTSink) reset() {}
+
+type FanoutStatus struct {
+	Target  string `json:"target"`
+	Queued  int    `json:"queued"`
+	Sent    int64  `json:"sent"`
+	Dropped int64  `json:"dropped"`
+	// Failing counts messages lost since publishing last succeeded.
+	Failing int64 `json:"failing"`
+}
+
+func fanoutStatusHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	status := []FanoutStatus{}
+	for _, t := range fanoutTargets {
+		status = append(status, FanoutStatus{
+			Target:  t.name,
+			Queued:  len(t.queue),
+			Sent:    t.sent.Load(),
+			Dropped: t.dropped.Load(),
+			Failing: t.failed.Load(),
+		})
+	}
+	json.NewEncoder(w).Encode(status)
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// gpuPollInterval is how often a build waiting for GPUs checks for free
+// ones, and whether it was canceled.
+const gpuPollInterval = 500 * time.Millisecond
+
+// GPUSettings cap how many GPUs a repository's builds may ask for.
+type GPUSettings struct {
+	RepoUrl string `json:"repoUrl"`
+	MaxGPUs int    `json:"maxGpus"`
+}
+
+// GPUPool hands out the host's GPUs so that no two builds share one.
+type GPUPool struct {
+	mu   sync.Mutex
+	free []bool
+	// held is the indexes of the GPUs each build holds.
+	held map[string][]int
+}
+
+func NewGPUPool(n int) *GPUPool {
+	p := &GPUPool{free: make([]bool, n), held: make(map[string][]int)}
+	for i := range p.free {
+		p.free[i] = true
+	}
+	return p
+}
+
+// Total returns how many GPUs the host has and how many are free.
+func (p *GPUPool) Total() (total, free int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, f := range p.free {
+		if f {
+			free++
+		}
+	}
+	return len(p.free), free
+}
+
+// tryAcquire takes n free GPUs for buildId, or none if fewer are free.
+func (p *GPUPool) tryAcquire(buildId string, n int) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var taken []int
+	for i, f := range p.free {
+		if f && len(taken) < n {
+			taken = append(taken, i)
+		}
+	}
+	if len(taken) < n {
+		return false
+	}
+	for _, i := range taken {
+		p.free[i] = false
+	}
+	p.held[buildId] = taken
+	return true
+}
+
+// Acquire waits until n GPUs are free and takes them for buildId. It
+// gives up if buildId is aborted while it waits.
+func (p *GPUPool) Acquire(buildId string, n int) error {
+	if n == 0 {
+		return nil
+	}
+	if total, _ := p.Total(); n > total {
+		return fmt.Errorf("build needs %d GPUs but the host has %d", n, total)
+	}
+	for !p.tryAcquire(buildId, n) {
+		if err := abortError(buildId); err != nil {
+			return err
+		}
+		time.Sleep(gpuPollInterval)
+	}
+	return nil
+}
+
+// Held returns the indexes of the GPUs buildId holds.
+func (p *GPUPool) Held(buildId string) []int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.held[buildId]
+}
+
+// Release gives back the GPUs buildId took with Acquire.
+func (p *GPUPool) Release(buildId string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, i := range p.held[buildId] {
+		p.free[i] = true
+	}
+	delete(p.held, buildId)
+}
+
+var gpus = NewGPUPool(0)
+
+// hostGPUs counts the host's GPUs: GPU_COUNT if set, or else those
+// nvidia-smi lists.
+func hostGPUs() int {
+	if v := os.Getenv("GPU_COUNT"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			log.Printf("Ignoring invalid GPU_COUNT %q", v)
+			return 0
+		}
+		return n
+	}
+	out, err := exec.Command("nvidia-smi", "--list-gpus").Output()
+	if err != nil {
+		return 0
+	}
+	n := 0
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) > 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// gpuFlags give a build the GPUs with these indexes as CDI devices, which
+// RUN steps that ask for them with --device can use.
+func gpuFlags(indexes []int) []string {
+	var flags []string
+	for _, i := range indexes {
+		flags = append(flags, "--device", fmt.Sprintf("nvidia.com/gpu=%d", i))
+	}
+	return flags
+}
+
+// getGPUSettings returns the repository's GPU limit, or sql.ErrNoRows if
+// it may not use GPUs.
+func getGPUSettings(repoURL string) (GPUSettings, error) {
+	s := GPUSettings{RepoUrl: repoURL}
+	err := db.QueryRow("SELECT max_gpus FROM gpu_settings WHERE repo_url = ?", repoURL).Scan(&s.MaxGPUs)
+	return s, err
+}
+
+func saveGPUSettings(s GPUSettings) error {
+	_, err := db.Exec("INSERT OR REPLACE INTO gpu_settings (repo_url, max_gpus) VALUES (?, ?)", s.RepoUrl, s.MaxGPUs)
+	return err
+}
+
+// checkGPURequest holds a build's GPU request to its repository's limit
+// and the host's GPUs.
+func checkGPURequest(req *BuildRequest) error {
+	if req.GPUs == 0 {
+		return nil
+	}
+	if req.GPUs < 0 {
+		return fmt.Errorf("gpus must not be negative")
+	}
+	s, err := getGPUSettings(req.RepoUrl)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if req.GPUs > s.MaxGPUs {
+		return fmt.Errorf("build asks for %d GPUs but the repository may use %d", req.GPUs, s.MaxGPUs)
+	}
+	if total, _ := gpus.Total(); req.GPUs > total {
+		return fmt.Errorf("build asks for %d GPUs but this server has %d", req.GPUs, total)
+	}
+	return nil
+}
+
+func setGPUSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	var s GPUSettings
+	if err := json.NewDecoder(r.Body).Decode(&s); err != nil || s.RepoUrl == "" {
+		http.Error(w, "Request must contain repoUrl and maxGpus", http.StatusBadRequest)
+		return
+	}
+	if err := validateRepoURL(s.RepoUrl); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if s.MaxGPUs < 0 {
+		http.Error(w, "maxGpus must not be negative", http.StatusBadRequest)
+		return
+	}
+	if err := saveGPUSettings(s); err != nil {
+		http.Error(w, "Could not save GPU settings", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(s)
+}
+
+func getGPUSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	repoURL := r.URL.Query().Get("repo")
+	if err := validateRepoURL(repoURL); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s, err := getGPUSettings(repoURL)
+	if err == sql.ErrNoRows {
+		http.Error(w, "No GPU settings configured for repository", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Could not get GPU settings", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(s)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// maxHistoryLimit caps how many builds one page of history returns.
+const maxHistoryLimit = 100
+
+// BuildSummary is one build in the build history.
+type BuildSummary struct {
+	BuildId    string      `json:"buildId"`
+	RepoUrl    string      `json:"repoUrl"`
+	Status     string      `json:"status"`
+	CommitID   string      `json:"commitId,omitempty"`
+	Commit     *CommitInfo `json:"commit,omitempty"`
+	Image      string      `json:"image,omitempty"`
+	Error      string      `json:"error,omitempty"`
+	Trigger    *Trigger    `json:"trigger,omitempty"`
+	QueuedAt   *time.Time  `json:"queuedAt,omitempty"`
+	StartedAt  *time.Time  `json:"startedAt,omitempty"`
+	FinishedAt *time.Time  `json:"finishedAt,omitempty"`
+	// DurationSeconds is how long the build ran, once it has finished.
+	DurationSeconds *float64 `json:"durationSeconds,omitempty"`
+}
+
+// BuildHistory is a page of builds, newest first.
+type BuildHistory struct {
+	Builds []BuildSummary `json:"builds"`
+	Total  int            `json:"total"`
+	Limit  int            `json:"limit"`
+	Offset int            `json:"offset"`
+}
+
+var historyStates = map[string]bool{
+	StateQueued: true, StateStarting: true, StateCloning: true, StateScanning: true,
+	StateBuilding: true, StatePushing: true, StateSucceeded: true, StateFailed: true,
+}
+
+// queryInt reads a non-negative integer query parameter, or def if it is
+// not given.
+func queryInt(r *http.Request, name string, def int) (int, bool) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return def, true
+	}
+	n, err := strconv.Atoi(v)
+	return n, err == nil && n >= 0
+}
+
+// buildHistoryHandler lists builds newest first, optionally only those of
+// ?repo= or in ?status=, a page of ?limit= at a time from ?offset=.
+func buildHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	limit, ok := queryInt(r, "limit", 20)
+	if !ok || limit == 0 || limit > maxHistoryLimit {
+		http.Error(w, "limit must be between 1 and "+strconv.Itoa(maxHistoryLimit), http.StatusBadRequest)
+		return
+	}
+	offset, ok := queryInt(r, "offset", 0)
+	if !ok {
+		http.Error(w, "offset must be a non-negative number", http.StatusBadRequest)
+		return
+	}
+	status := r.URL.Query().Get("status")
+	if status != "" && !historyStates[status] {
+		http.Error(w, "Unknown status "+strconv.Quote(status), http.StatusBadRequest)
+		return
+	}
+
+	history, err := store.History(r.URL.Query().Get("repo"), status, limit, offset)
+	if err != nil {
+		log.Printf("Error getting build history: %v", err)
+		http.Error(w, "Could not get build history", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(history)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+)
+
+// idempotencyRetention is how long, in seconds, an Idempotency-Key maps
+// to the build it first created.
+var idempotencyRetention int
+
+func retentionModifier() string {
+	return fmt.Sprintf("-%d seconds", idempotencyRetention)
+}
+
+// lookupIdempotencyKey returns the build created for key within the
+// retention window.
+func lookupIdempotencyKey(key string) (string, bool) {
+	var buildId string
+	err := db.QueryRow("SELECT build_id FROM idempotency_keys WHERE key = ? AND created_at > datetime('now', ?)", key, retentionModifier()).Scan(&buildId)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("Error looking up idempotency key: %v", err)
+		}
+		return "", false
+	}
+	return buildId, true
+}
+
+// claimIdempotencyKey associates key with buildId unless another request
+// claimed it first, and returns the build that owns the key.
+func claimIdempotencyKey(key, buildId string) (string, error) {
+	if _, err := db.Exec("DELETE FROM idempotency_keys WHERE created_at <= datetime('now', ?)", retentionModifier()); err != nil {
+		return "", err
+	}
+	if _, err := db.Exec("INSERT OR IGNORE INTO idempotency_keys (key, build_id) VALUES (?, ?)", key, buildId); err != nil {
+		return "", err
+	}
+	var owner string
+	err := db.QueryRow("SELECT build_id FROM idempotency_keys WHERE key = ?", key).Scan(&owner)
+	return owner, err
+}
+
+// releaseIdempotencyKey forgets key if it still points at a build that was
+// never started, so a retry can create it afresh.
+func releaseIdempotencyKey(key, buildId string) {
+	if key == "" {
+		return
+	}
+	if _, err := db.Exec("DELETE FROM idempotency_keys WHERE key = ? AND build_id = ?", key, buildId); err != nil {
+		log.Printf("Error releasing idempotency key: %v", err)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// imageDigest returns the content-addressed ID of a local image, which
+// unlike its tag cannot be moved to different content.
+func imageDigest(image string) (string, error) {
+	out, err := exec.Command("docker", "image", "inspect", "--format", "{{.Id}}", image).Output()
+	if err != nil {
+		return "", err
+	}
+	digest := strings.TrimSpace(string(out))
+	if !strings.HasPrefix(digest, "sha256:") {
+		return "", fmt.Errorf("unexpected image ID %q", digest)
+	}
+	return digest, nil
+}
+
+// BuiltImage is an image a build produced. Service names the compose
+// service it was built for, if any.
+type BuiltImage struct {
+	Service string `json:"service,omitempty"`
+	Image   string `json:"image"`
+	Digest  string `json:"digest"`
+	// BaseImages are the images its Dockerfile builds FROM.
+	BaseImages []string `json:"baseImages,omitempty"`
+	// BaseDigests maps each base image to the digest it was pinned to,
+	// when PIN_BASE_IMAGES is set.
+	BaseDigests map[string]string `json:"baseDigests,omitempty"`
+	// FromImages are all the images its Dockerfile builds FROM as
+	// written, including those pinned to a digest, for policy checks.
+	FromImages []string `json:"-"`
+}
+
+// buildImage builds the Dockerfile in context with buildx for platforms,
+// or the builder's own if none, and loads the result into the local image
+// store as image, labeled with labels. The GPUs in gpuIndexes are handed
+// to the build.
+func buildImage(buildId, context, dockerfile, image string, compression *Compression, buildArgs, labels map[string]string, platforms []string, gpuIndexes []int) (BuiltImage, error) {
+	built := BuiltImage{Image: image}
+	path := dockerfile
+	if path == "" {
+		path = filepath.Join(context, "Dockerfile")
+	}
+	built.FromImages = dockerfileFromImages(path, buildArgs)
+	built.BaseImages = dockerfileBaseImages(path)
+	if pinBaseImagesEnabled() && len(built.BaseImages) > 0 {
+		pins, err := pinBaseImages(buildId, path, built.BaseImages)
+		if err != nil {
+			return built, fmt.Errorf("pinning base images: %v", err)
+		}
+		built.BaseDigests = pins
+	}
+
+	args := []string{"buildx", "build", context, "--tag", image, outputFlag(compression), "--progress=plain"}
+	if dockerfile != "" {
+		args = append(args, "--file", dockerfile)
+	}
+	args = append(args, buildArgFlags(buildArgs)...)
+	args = append(args, labelFlags(labels)...)
+	args = append(args, platformFlags(platforms)...)
+	args = append(args, gpuFlags(gpuIndexes)...)
+	stopSampling := sampleBuildKit(buildId)
+	err := runCommand(buildId, exec.Command("docker", args...))
+	stopSampling()
+	if err != nil {
+		return built, err
+	}
+	digest, err := imageDigest(image)
+	if err != nil {
+		return built, fmt.Errorf("resolving digest of %s: %v", image, err)
+	}
+	built.Digest = digest
+	return built, nil
+}
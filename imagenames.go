@@ -0,0 +1,179 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultImageName names the images of Dockerfile builds of repositories
+// without image naming settings.
+const defaultImageName = "myapp"
+
+// defaultTagTemplate tags images with the full commit ID.
+const defaultTagTemplate = "{commit}"
+
+// maxTagLength is the longest tag a registry accepts.
+const maxTagLength = 128
+
+var (
+	placeholderPattern = regexp.MustCompile(`\{[^{}]*\}`)
+	nonTagChars        = regexp.MustCompile(`[^A-Za-z0-9_.-]+`)
+)
+
+// tagPlaceholders are what tag templates may contain, each replaced with
+// a value about the build.
+var tagPlaceholders = map[string]bool{
+	"{branch}":       true,
+	"{tag}":          true,
+	"{commit}":       true,
+	"{commit:short}": true,
+	"{build_number}": true,
+	"{date}":         true,
+}
+
+// ImageNaming says how a repository's images are named and tagged.
+type ImageNaming struct {
+	RepoUrl string `json:"repoUrl"`
+	// Name is the image name, such as org/app. Compose builds name each
+	// service's image <name>-<service>. By default Dockerfile builds use
+	// "myapp" and compose builds the repository's name.
+	Name string `json:"name,omitempty"`
+	// TagTemplate is the image tag with placeholders: {branch}, {tag},
+	// {commit}, {commit:short}, {build_number} and {date}. It defaults
+	// to {commit}.
+	TagTemplate string `json:"tagTemplate,omitempty"`
+}
+
+// TagValues are what a tag template's placeholders stand for.
+type TagValues struct {
+	Branch      string
+	Tag         string
+	Commit      string
+	BuildNumber int
+	Date        time.Time
+}
+
+func validateImageNaming(n ImageNaming) error {
+	if n.Name != "" && !repositoryPattern.MatchString(n.Name) {
+		return fmt.Errorf("invalid image name %q: must be a lowercase name such as org/app", n.Name)
+	}
+	for _, p := range placeholderPattern.FindAllString(n.TagTemplate, -1) {
+		if !tagPlaceholders[p] {
+			return fmt.Errorf("unknown placeholder %s in tag template", p)
+		}
+	}
+	if rest := placeholderPattern.ReplaceAllString(n.TagTemplate, ""); strings.ContainsAny(rest, "{}") {
+		return fmt.Errorf("unbalanced braces in tag template %q", n.TagTemplate)
+	}
+	return nil
+}
+
+func getImageNaming(repoURL string) (ImageNaming, error) {
+	n := ImageNaming{RepoUrl: repoURL}
+	err := db.QueryRow("SELECT name, tag_template FROM image_naming WHERE repo_url = ?", repoURL).Scan(&n.Name, &n.TagTemplate)
+	return n, err
+}
+
+func saveImageNaming(n ImageNaming) error {
+	_, err := db.Exec("INSERT OR REPLACE INTO image_naming (repo_url, name, tag_template) VALUES (?, ?, ?)", n.RepoUrl, n.Name, n.TagTemplate)
+	return err
+}
+
+// nextBuildNumber counts the builds of repoURL that asked for a number.
+func nextBuildNumber(repoURL string) (int, error) {
+	var n int
+	err := db.QueryRow("INSERT INTO build_numbers (repo_url, last) VALUES (?, 1) ON CONFLICT (repo_url) DO UPDATE SET last = last + 1 RETURNING last", repoURL).Scan(&n)
+	return n, err
+}
+
+// usesBuildNumber reports whether template needs a build number, which
+// is only taken when it does.
+func usesBuildNumber(template string) bool {
+	return strings.Contains(template, "{build_number}")
+}
+
+// renderTag fills in template, turning characters a tag can't hold into
+// dashes. A template that renders empty falls back to the commit ID.
+func renderTag(template string, v TagValues) string {
+	if template == "" {
+		template = defaultTagTemplate
+	}
+	short := v.Commit
+	if len(short) > 7 {
+		short = short[:7]
+	}
+	tag := strings.NewReplacer(
+		"{branch}", v.Branch,
+		"{tag}", v.Tag,
+		"{commit}", v.Commit,
+		"{commit:short}", short,
+		"{build_number}", strconv.Itoa(v.BuildNumber),
+		"{date}", v.Date.UTC().Format("20060102"),
+	).Replace(template)
+	tag = strings.TrimLeft(nonTagChars.ReplaceAllString(tag, "-"), ".-")
+	if len(tag) > maxTagLength {
+		tag = tag[:maxTagLength]
+	}
+	if tag == "" {
+		return v.Commit
+	}
+	return tag
+}
+
+// imageName returns the name of repoURL's images, before the tag.
+func imageName(n ImageNaming, repoURL string, compose bool) string {
+	switch {
+	case n.Name != "":
+		return n.Name
+	case compose:
+		return composeProject(repoURL)
+	}
+	return defaultImageName
+}
+
+func setImageNamingHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	var n ImageNaming
+	if err := json.NewDecoder(r.Body).Decode(&n); err != nil || n.RepoUrl == "" {
+		http.Error(w, "Request must contain repoUrl", http.StatusBadRequest)
+		return
+	}
+	if err := validateRepoURL(n.RepoUrl); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validateImageNaming(n); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := saveImageNaming(n); err != nil {
+		http.Error(w, "Could not save image naming", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(n)
+}
+
+func getImageNamingHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	repoURL := r.URL.Query().Get("repo")
+	if err := validateRepoURL(repoURL); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	n, err := getImageNaming(repoURL)
+	if err == sql.ErrNoRows {
+		http.Error(w, "No image naming configured for repository", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Could not get image naming", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(n)
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// What exceeding an image size limit does.
+const (
+	SizeActionFail = "fail"
+	SizeActionWarn = "warn"
+)
+
+// ImageSizeLimit is a repository's own limit on the size of its images,
+// on top of the policy's.
+type ImageSizeLimit struct {
+	RepoUrl string `json:"repoUrl"`
+	// MaxSize is the largest image in bytes.
+	MaxSize int64 `json:"maxSize"`
+	// Action is "fail", the default, or "warn".
+	Action string `json:"action,omitempty"`
+}
+
+// AppliedSizeLimit is one limit an image was checked against.
+type AppliedSizeLimit struct {
+	// Source is "policy" or "repository".
+	Source   string `json:"source"`
+	MaxSize  int64  `json:"maxSize"`
+	Action   string `json:"action"`
+	Exceeded bool   `json:"exceeded"`
+}
+
+// LayerSize is one layer of an image and the instruction that made it.
+type LayerSize struct {
+	Size      int64  `json:"size"`
+	CreatedBy string `json:"createdBy"`
+}
+
+// ImageSizeReport breaks down an image checked against size limits, its
+// largest layers first, to show where to cut.
+type ImageSizeReport struct {
+	Image  string             `json:"image"`
+	Size   int64              `json:"size"`
+	Limits []AppliedSizeLimit `json:"limits"`
+	Layers []LayerSize        `json:"layers,omitempty"`
+}
+
+func validateSizeAction(action string) error {
+	switch action {
+	case "", SizeActionFail, SizeActionWarn:
+		return nil
+	}
+	return fmt.Errorf("unknown image size action %q", action)
+}
+
+func getImageSizeLimit(repoURL string) (ImageSizeLimit, error) {
+	l := ImageSizeLimit{RepoUrl: repoURL}
+	err := db.QueryRow("SELECT max_size, action FROM image_size_limits WHERE repo_url = ?", repoURL).Scan(&l.MaxSize, &l.Action)
+	return l, err
+}
+
+func saveImageSizeLimit(l ImageSizeLimit) error {
+	_, err := db.Exec("INSERT OR REPLACE INTO image_size_limits (repo_url, max_size, action) VALUES (?, ?, ?)", l.RepoUrl, l.MaxSize, l.Action)
+	return err
+}
+
+// imageLayers lists an image's non-empty layers, largest first.
+func imageLayers(image string) ([]LayerSize, error) {
+	out, err := exec.Command("docker", "image", "history", "--no-trunc", "--human=false", "--format", "{{.Size}}\t{{.CreatedBy}}", image).Output()
+	if err != nil {
+		return nil, err
+	}
+	var layers []LayerSize
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		sizeField, createdBy, _ := strings.Cut(scanner.Text(), "\t")
+		size, err := strconv.ParseInt(strings.TrimSpace(sizeField), 10, 64)
+		if err != nil || size == 0 {
+			continue
+		}
+		layers = append(layers, LayerSize{Size: size, CreatedBy: strings.TrimSpace(createdBy)})
+	}
+	sort.SliceStable(layers, func(i, j int) bool { return layers[i].Size > layers[j].Size })
+	return layers, scanner.Err()
+}
+
+func saveImageSizeReports(buildId string, reports []ImageSizeReport) error {
+	body, err := json.Marshal(reports)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("INSERT OR REPLACE INTO build_image_sizes (build_id, reports) VALUES (?, ?)", buildId, string(body))
+	return err
+}
+
+func getImageSizeReports(buildId string) ([]ImageSizeReport, error) {
+	var body string
+	if err := db.QueryRow("SELECT reports FROM build_image_sizes WHERE build_id = ?", buildId).Scan(&body); err != nil {
+		return nil, err
+	}
+	var reports []ImageSizeReport
+	err := json.Unmarshal([]byte(body), &reports)
+	return reports, err
+}
+
+// checkImageSizes checks images against the policy's size limit and the
+// repository's, and records a report for each. Limits set to fail
+// return violations; those set to warn are written to the build log.
+func checkImageSizes(buildId, repoURL string, p Policy, images []BuiltImage) ([]PolicyViolation, error) {
+	var limits []AppliedSizeLimit
+	if p.MaxImageSize > 0 {
+		limits = append(limits, AppliedSizeLimit{Source: "policy", MaxSize: p.MaxImageSize, Action: p.ImageSizeAction})
+	}
+	repoLimit, err := getImageSizeLimit(repoURL)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	if err == nil && repoLimit.MaxSize > 0 {
+		limits = append(limits, AppliedSizeLimit{Source: "repository", MaxSize: repoLimit.MaxSize, Action: repoLimit.Action})
+	}
+	if len(limits) == 0 {
+		return nil, nil
+	}
+
+	var violations []PolicyViolation
+	var reports []ImageSizeReport
+	for _, image := range images {
+		size, ok := imageSize(image.Image)
+		if !ok {
+			return nil, fmt.Errorf("could not get size of %s", image.Image)
+		}
+		report := ImageSizeReport{Image: image.Image, Size: size}
+		for _, l := range limits {
+			if l.Action == "" {
+				l.Action = SizeActionFail
+			}
+			l.Exceeded = size > l.MaxSize
+			report.Limits = append(report.Limits, l)
+			if !l.Exceeded {
+				continue
+			}
+			detail := fmt.Sprintf("%s is %s, over the %s limit of %s", image.Image, formatSize(size), l.Source, formatSize(l.MaxSize))
+			if l.Action == SizeActionWarn {
+				logLine(buildId, "==> warning: "+detail)
+				continue
+			}
+			violations = append(violations, PolicyViolation{Rule: RuleMaxImageSize, Image: image.Image, Detail: detail})
+		}
+		if report.Layers, err = imageLayers(image.Image); err != nil {
+			logLine(buildId, fmt.Sprintf("==> could not list layers of %s: %v", image.Image, err))
+		}
+		reports = append(reports, report)
+	}
+	return violations, saveImageSizeReports(buildId, reports)
+}
+
+func setImageSizeLimitHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	var l ImageSizeLimit
+	if err := json.NewDecoder(r.Body).Decode(&l); err != nil || l.RepoUrl == "" {
+		http.Error(w, "Request must contain repoUrl and maxSize", http.StatusBadRequest)
+		return
+	}
+	if err := validateRepoURL(l.RepoUrl); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if l.MaxSize < 0 {
+		http.Error(w, "maxSize must not be negative", http.StatusBadRequest)
+		return
+	}
+	if err := validateSizeAction(l.Action); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := saveImageSizeLimit(l); err != nil {
+		http.Error(w, "Could not save image size limit", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(l)
+}
+
+func getImageSizeLimitHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	repoURL := r.URL.Query().Get("repo")
+	if err := validateRepoURL(repoURL); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	l, err := getImageSizeLimit(repoURL)
+	if err == sql.ErrNoRows {
+		http.Error(w, "No image size limit configured for repository", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Could not get image size limit", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(l)
+}
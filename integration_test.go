@@ -0,0 +1,256 @@
+//go:build integration
+
+// Integration tests drive the server over HTTP and websockets against a
+// throwaway database and workspace:
+//
+//	go test -tags integration ./...
+//
+// The Docker build test runs against whatever daemon the docker CLI
+// reaches, and is skipped when there is none. To keep it off the host
+// daemon, start a Docker-in-Docker one and point DOCKER_HOST at it:
+//
+//	docker run -d --privileged --name dbs-dind -p 2375:2375 -e DOCKER_TLS_CERTDIR= docker:dind
+//	DOCKER_HOST=tcp://localhost:2375 go test -tags integration ./...
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var server *httptest.Server
+
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "dbs-integration-")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	// initDB opens builds.db in the working directory.
+	if err := os.Chdir(dir); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	initDB()
+	queue = NewBuildQueue(2, 20)
+	logDir = filepath.Join(dir, "logs")
+	workspaceRoot = filepath.Join(dir, "workspaces")
+	os.MkdirAll(workspaceRoot, 0755)
+	subscribeEventHandlers()
+	server = httptest.NewServer(CorsMiddleware(ReadOnlyMiddleware(newRouter())))
+
+	code := m.Run()
+	server.Close()
+	db.Close()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// fixtureRepo creates a git repository holding files, committed on main.
+func fixtureRepo(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, args := range [][]string{
+		{"init", "--quiet", "--initial-branch", "main"},
+		{"add", "."},
+		{"-c", "user.name=Fixture", "-c", "user.email=fixture@example.invalid", "commit", "--quiet", "-m", "Fixture commit"},
+	} {
+		if out, err := exec.Command("git", append([]string{"-C", dir}, args...)...).CombinedOutput(); err != nil {
+			t.Fatalf("git %s: %v\n%s", args[0], err, out)
+		}
+	}
+	return dir
+}
+
+func startBuild(t *testing.T, req BuildRequest) string {
+	t.Helper()
+	body, _ := json.Marshal(req)
+	resp, err := http.Post(server.URL+"/api/build", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("POST /api/build: %s", resp.Status)
+	}
+	var build BuildResponse
+	if err := json.NewDecoder(resp.Body).Decode(&build); err != nil {
+		t.Fatal(err)
+	}
+	return build.BuildId
+}
+
+// followLogs reads the build's websocket until it completes or fails,
+// returning the log lines and the final message.
+func followLogs(t *testing.T, buildId string, timeout time.Duration) ([]string, Message) {
+	t.Helper()
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/api/logs/" + buildId
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(timeout))
+
+	var lines []string
+	for {
+		var msg Message
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatalf("reading logs of build %s: %v", buildId, err)
+		}
+		switch msg.Type {
+		case MessageLog:
+			line, _ := msg.Data.(string)
+			lines = append(lines, line)
+		case MessageComplete:
+			return lines, msg
+		case MessageStatus:
+			if data, _ := msg.Data.(map[string]interface{}); data["status"] == "failed" {
+				return lines, msg
+			}
+		}
+	}
+}
+
+func getStatus(t *testing.T, buildId string) BuildStatus {
+	t.Helper()
+	resp, err := http.Get(server.URL + "/api/builds/" + buildId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /api/builds/%s: %s", buildId, resp.Status)
+	}
+	var status BuildStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+	return status
+}
+
+// waitForState polls the status API until the build reaches a finished
+// state, since subscribers record it after the websocket is told.
+func waitForState(t *testing.T, buildId string) BuildStatus {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		status := getStatus(t, buildId)
+		if status.State == StateSucceeded || status.State == StateFailed || time.Now().After(deadline) {
+			return status
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func getLogTail(t *testing.T, buildId string) string {
+	t.Helper()
+	resp, err := http.Get(server.URL + "/api/builds/" + buildId + "/logs/tail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var buf bytes.Buffer
+	buf.ReadFrom(resp.Body)
+	return buf.String()
+}
+
+func TestFakeBuildSucceeds(t *testing.T) {
+	executor = fakeExecutor{duration: 300 * time.Millisecond, logLines: 5}
+	defer func() { executor = dockerExecutor{} }()
+
+	buildId := startBuild(t, BuildRequest{RepoUrl: "https://example.invalid/fixture.git"})
+	lines, final := followLogs(t, buildId, 30*time.Second)
+	if final.Type != MessageComplete {
+		t.Fatalf("build ended with %s message %v", final.Type, final.Data)
+	}
+	if !strings.Contains(strings.Join(lines, "\n"), "#0 building") {
+		t.Errorf("streamed logs have no buildx output: %q", lines)
+	}
+
+	status := waitForState(t, buildId)
+	if status.State != StateSucceeded {
+		t.Fatalf("state = %q, want %q (error %q)", status.State, StateSucceeded, status.Error)
+	}
+	if status.Build == nil || !strings.HasPrefix(status.Build.ImageDigest, "sha256:") {
+		t.Errorf("succeeded build has no image digest: %+v", status.Build)
+	}
+	if tail := getLogTail(t, buildId); !strings.Contains(tail, "DONE") && !strings.Contains(tail, "CACHED") {
+		t.Errorf("persisted log is missing build steps: %q", tail)
+	}
+
+	resp, err := http.Get(server.URL + "/api/builds?status=succeeded&limit=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var history BuildHistory
+	if err := json.NewDecoder(resp.Body).Decode(&history); err != nil {
+		t.Fatal(err)
+	}
+	if len(history.Builds) != 1 || history.Builds[0].BuildId != buildId {
+		t.Errorf("history = %+v, want build %s first", history.Builds, buildId)
+	}
+}
+
+func TestFakeBuildFails(t *testing.T) {
+	executor = fakeExecutor{duration: 100 * time.Millisecond, failurePercent: 100, logLines: 2}
+	defer func() { executor = dockerExecutor{} }()
+
+	buildId := startBuild(t, BuildRequest{RepoUrl: "https://example.invalid/fixture.git"})
+	_, final := followLogs(t, buildId, 30*time.Second)
+	if final.Type != MessageStatus {
+		t.Fatalf("build ended with %s message %v, want failure status", final.Type, final.Data)
+	}
+
+	status := waitForState(t, buildId)
+	if status.State != StateFailed || status.Error != "simulated build failure" {
+		t.Fatalf("state = %q, error = %q", status.State, status.Error)
+	}
+}
+
+func TestDockerBuild(t *testing.T) {
+	if err := exec.Command("docker", "info").Run(); err != nil {
+		t.Skip("no Docker daemon reachable:", err)
+	}
+	repo := fixtureRepo(t, map[string]string{
+		// scratch needs no pull, so the test runs without a registry.
+		"Dockerfile": "FROM scratch\nCOPY hello.txt /hello.txt\n",
+		"hello.txt":  "hello\n",
+	})
+
+	buildId := startBuild(t, BuildRequest{RepoUrl: repo})
+	lines, final := followLogs(t, buildId, 5*time.Minute)
+	if final.Type != MessageComplete {
+		t.Fatalf("build ended with %s message %v\n%s", final.Type, final.Data, strings.Join(lines, "\n"))
+	}
+
+	status := waitForState(t, buildId)
+	if status.State != StateSucceeded {
+		t.Fatalf("state = %q, want %q (error %q)", status.State, StateSucceeded, status.Error)
+	}
+	image := status.Build.Image
+	defer exec.Command("docker", "image", "rm", "--force", image).Run()
+	if status.Build.Commit == nil || status.Build.Commit.Message != "Fixture commit" {
+		t.Errorf("commit = %+v, want the fixture commit", status.Build.Commit)
+	}
+	if out, err := exec.Command("docker", "image", "inspect", image).CombinedOutput(); err != nil {
+		t.Errorf("built image %s not found: %v\n%s", image, err, out)
+	}
+}
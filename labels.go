@@ -0,0 +1,51 @@
+package main
+
+import (
+	"os"
+	"sort"
+)
+
+// Labels put on every image the server builds, so listing and cleanup can
+// leave other workloads on a shared Docker host alone.
+const (
+	labelInstance = "org.docker-build-server.instance"
+	labelRepo     = "org.docker-build-server.repo"
+	labelService  = "org.docker-build-server.service"
+)
+
+// instanceName tells apart servers sharing a Docker host: INSTANCE_NAME,
+// or "default" if unset.
+func instanceName() string {
+	if name := os.Getenv("INSTANCE_NAME"); name != "" {
+		return name
+	}
+	return "default"
+}
+
+// imageLabels are the labels for images built from repoURL.
+func imageLabels(repoURL string) map[string]string {
+	return map[string]string{
+		labelInstance: instanceName(),
+		labelRepo:     redact(repoURL),
+	}
+}
+
+// labelFlags turns labels into --label flags in a stable order.
+func labelFlags(labels map[string]string) []string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var flags []string
+	for _, name := range names {
+		flags = append(flags, "--label", name+"="+labels[name])
+	}
+	return flags
+}
+
+// instanceFilter is the docker --filter value matching this server's
+// resources.
+func instanceFilter() string {
+	return "label=" + labelInstance + "=" + instanceName()
+}
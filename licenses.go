@@ -0,0 +1,146 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// PackageLicenses is one package found in an image and its licenses.
+type PackageLicenses struct {
+	Name     string   `json:"name"`
+	Version  string   `json:"version"`
+	Type     string   `json:"type"`
+	Licenses []string `json:"licenses"`
+}
+
+type LicenseReport struct {
+	Packages []PackageLicenses `json:"packages"`
+	// Denied lists the denied licenses found, if any.
+	Denied []string `json:"denied,omitempty"`
+}
+
+// syftDocument is the part of syft's JSON output the scan needs. Licenses
+// are plain strings in older syft releases and objects in newer ones.
+type syftDocument struct {
+	Artifacts []struct {
+		Name     string            `json:"name"`
+		Version  string            `json:"version"`
+		Type     string            `json:"type"`
+		Licenses []json.RawMessage `json:"licenses"`
+	} `json:"artifacts"`
+}
+
+// licenseScanEnabled reports whether builds should inventory licenses,
+// which needs LICENSE_SCAN set and syft installed.
+func licenseScanEnabled() bool {
+	if os.Getenv("LICENSE_SCAN") == "" {
+		return false
+	}
+	_, err := exec.LookPath("syft")
+	return err == nil
+}
+
+// licenseDenylist is the set of licenses, from the comma-separated
+// LICENSE_DENYLIST, that fail a build.
+func licenseDenylist() map[string]bool {
+	denied := make(map[string]bool)
+	for _, l := range strings.Split(os.Getenv("LICENSE_DENYLIST"), ",") {
+		if l = strings.TrimSpace(l); l != "" {
+			denied[l] = true
+		}
+	}
+	return denied
+}
+
+func parseLicense(raw json.RawMessage) string {
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		return s
+	}
+	var l struct {
+		Value          string `json:"value"`
+		SPDXExpression string `json:"spdxExpression"`
+	}
+	json.Unmarshal(raw, &l)
+	if l.SPDXExpression != "" {
+		return l.SPDXExpression
+	}
+	return l.Value
+}
+
+// scanLicenses inventories the packages in images with syft and checks
+// their licenses against the deny list.
+func scanLicenses(images ...string) (LicenseReport, error) {
+	report := LicenseReport{Packages: []PackageLicenses{}}
+	denylist := licenseDenylist()
+	denied := make(map[string]bool)
+	for _, image := range images {
+		out, err := exec.Command("syft", "docker:"+image, "-o", "syft-json", "-q").Output()
+		if err != nil {
+			return report, fmt.Errorf("syft: %v", err)
+		}
+		var doc syftDocument
+		if err := json.Unmarshal(out, &doc); err != nil {
+			return report, fmt.Errorf("could not parse syft output: %v", err)
+		}
+
+		for _, a := range doc.Artifacts {
+			pkg := PackageLicenses{Name: a.Name, Version: a.Version, Type: a.Type, Licenses: []string{}}
+			for _, raw := range a.Licenses {
+				l := parseLicense(raw)
+				if l == "" {
+					continue
+				}
+				pkg.Licenses = append(pkg.Licenses, l)
+				if denylist[l] {
+					denied[l] = true
+				}
+			}
+			report.Packages = append(report.Packages, pkg)
+		}
+	}
+	for l := range denied {
+		report.Denied = append(report.Denied, l)
+	}
+	sort.Strings(report.Denied)
+	return report, nil
+}
+
+func saveLicenseReport(buildId string, report LicenseReport) error {
+	body, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("INSERT INTO build_licenses (build_id, report) VALUES (?, ?)", buildId, string(body))
+	return err
+}
+
+// getLicenseReport returns the license report of buildId as stored.
+func getLicenseReport(buildId string) (string, error) {
+	var report string
+	err := db.QueryRow("SELECT report FROM build_licenses WHERE build_id = ?", buildId).Scan(&report)
+	return report, err
+}
+
+func licensesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	buildId := mux.Vars(r)["buildId"]
+	report, err := getLicenseReport(buildId)
+	if err == sql.ErrNoRows {
+		http.Error(w, "No license report for build", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Could not get license report", http.StatusInternalServerError)
+		return
+	}
+	w.Write([]byte(report))
+}
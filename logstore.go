@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// logDir holds each build's log as <buildId>.log: LOG_DIR, or "logs" in
+// the working directory if unset.
+var logDir string
+
+const (
+	defaultTailLines = 200
+	maxTailLines     = 10000
+	followInterval   = 500 * time.Millisecond
+)
+
+// buildLogs holds the open log file of each build that is writing one.
+var buildLogs = struct {
+	sync.Mutex
+	files map[string]*os.File
+}{files: make(map[string]*os.File)}
+
+func logPath(buildId string) string {
+	return filepath.Join(logDir, buildId+".log")
+}
+
+// appendLog stores text, already timestamped and redacted, in buildId's
+// log file.
+func appendLog(buildId, text string) {
+	buildLogs.Lock()
+	defer buildLogs.Unlock()
+	f, ok := buildLogs.files[buildId]
+	if !ok {
+		if err := os.MkdirAll(logDir, 0755); err != nil {
+			log.Printf("Error creating log directory: %v", err)
+			return
+		}
+		var err error
+		f, err = os.OpenFile(logPath(buildId), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			log.Printf("Error opening build log: %v", err)
+			return
+		}
+		buildLogs.files[buildId] = f
+	}
+	if _, err := f.WriteString(text); err != nil {
+		log.Printf("Error writing build log: %v", err)
+	}
+}
+
+// closeBuildLog closes a build's log file once it has finished.
+func closeBuildLog(e Event) {
+	if e.Type != EventBuildSucceeded && e.Type != EventBuildFailed {
+		return
+	}
+	buildLogs.Lock()
+	defer buildLogs.Unlock()
+	if f, ok := buildLogs.files[e.BuildId]; ok {
+		f.Close()
+		delete(buildLogs.files, e.BuildId)
+	}
+}
+
+// lastLines returns the last n lines of f and leaves f at its end.
+func lastLines(f *os.File, n int) ([]string, error) {
+	if n == 0 {
+		_, err := f.Seek(0, io.SeekEnd)
+		return nil, err
+	}
+	lines := make([]string, 0, n)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if len(lines) == n {
+			lines = lines[1:]
+		}
+		lines = append(lines, scanner.Text())
+	}
+	return lines, scanner.Err()
+}
+
+// acceptsGzip reports whether the client asked for gzip, and didn't rule
+// it out with q=0.
+func acceptsGzip(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(part, ";")
+		if strings.TrimSpace(name) != "gzip" {
+			continue
+		}
+		q, ok := strings.CutPrefix(strings.TrimSpace(params), "q=")
+		if !ok {
+			return true
+		}
+		weight, err := strconv.ParseFloat(q, 64)
+		return err == nil && weight > 0
+	}
+	return false
+}
+
+// logWriter writes a log response, gzipped if the client accepts it;
+// verbose buildx output runs to tens of MB and compresses well.
+type logWriter struct {
+	w  http.ResponseWriter
+	gz *gzip.Writer
+}
+
+// newLogWriter must be called before anything is written to w, as it
+// sets the response's encoding.
+func newLogWriter(w http.ResponseWriter, r *http.Request) *logWriter {
+	w.Header().Add("Vary", "Accept-Encoding")
+	lw := &logWriter{w: w}
+	if acceptsGzip(r) {
+		w.Header().Set("Content-Encoding", "gzip")
+		lw.gz, _ = gzip.NewWriterLevel(w, gzip.BestSpeed)
+	}
+	return lw
+}
+
+func (lw *logWriter) Write(p []byte) (int, error) {
+	if lw.gz != nil {
+		return lw.gz.Write(p)
+	}
+	return lw.w.Write(p)
+}
+
+// Flush sends the client everything written so far.
+func (lw *logWriter) Flush() {
+	if lw.gz != nil {
+		lw.gz.Flush()
+	}
+	if flusher, ok := lw.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Close ends the gzip stream, if there is one.
+func (lw *logWriter) Close() error {
+	if lw.gz != nil {
+		return lw.gz.Close()
+	}
+	return nil
+}
+
+// openRequestLog opens buildId's log for a request, answering it with an
+// error if it can't.
+func openRequestLog(w http.ResponseWriter, buildId string) (*os.File, bool) {
+	if _, err := uuid.Parse(buildId); err != nil {
+		http.Error(w, "Invalid build ID", http.StatusBadRequest)
+		return nil, false
+	}
+	f, err := os.Open(logPath(buildId))
+	if os.IsNotExist(err) {
+		http.Error(w, "No log for build", http.StatusNotFound)
+		return nil, false
+	}
+	if err != nil {
+		http.Error(w, "Could not open build log", http.StatusInternalServerError)
+		return nil, false
+	}
+	return f, true
+}
+
+// logDownloadHandler serves a build's whole log as a file.
+func logDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	buildId := mux.Vars(r)["buildId"]
+	f, ok := openRequestLog(w, buildId)
+	if !ok {
+		return
+	}
+	defer f.Close()
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+buildId+`.log"`)
+	lw := newLogWriter(w, r)
+	defer lw.Close()
+	if _, err := io.Copy(lw, f); err != nil {
+		log.Printf("Error sending log of %s: %v", buildId, err)
+	}
+}
+
+// logTailHandler writes the last ?lines= lines of a build's log as plain
+// text. With ?follow=true it keeps the response open, streaming new output
+// until the build finishes, like tail -f.
+func logTailHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	buildId := mux.Vars(r)["buildId"]
+	n := defaultTailLines
+	if v := r.URL.Query().Get("lines"); v != "" {
+		var err error
+		if n, err = strconv.Atoi(v); err != nil || n < 0 || n > maxTailLines {
+			http.Error(w, "lines must be between 0 and "+strconv.Itoa(maxTailLines), http.StatusBadRequest)
+			return
+		}
+	}
+	follow, _ := strconv.ParseBool(r.URL.Query().Get("follow"))
+
+	f, ok := openRequestLog(w, buildId)
+	if !ok {
+		return
+	}
+	defer f.Close()
+	lines, err := lastLines(f, n)
+	if err != nil {
+		http.Error(w, "Could not read build log", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	lw := newLogWriter(w, r)
+	defer lw.Close()
+	for _, line := range lines {
+		io.WriteString(lw, line+"\n")
+	}
+	if !follow {
+		return
+	}
+
+	ticker := time.NewTicker(followInterval)
+	defer ticker.Stop()
+	for {
+		// Output read after the build is seen to have finished is all
+		// there will be.
+		active := isBuildActive(buildId)
+		if _, err := io.Copy(lw, f); err != nil {
+			return
+		}
+		lw.Flush()
+		if !active {
+			return
+		}
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -1,8 +1,11 @@
 package main
 
 import (
+	"bytes"
+	"compress/flate"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -10,6 +13,7 @@ import (
 	"os/exec"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
@@ -18,6 +22,8 @@ import (
 )
 
 var upgrader = websocket.Upgrader{
+	// Negotiate permessage-deflate; buildx output compresses very well.
+	EnableCompression: true,
 	CheckOrigin: func(r *http.Request) bool {
 		return true
 	},
@@ -27,25 +33,182 @@ var clients = make(map[string]*websocket.Conn)
 var mu sync.Mutex
 
 type BuildRequest struct {
-	RepoUrl string `json:"repoUrl"`
+	RepoUrl string     `json:"repoUrl"`
+	RunAt   *time.Time `json:"runAt,omitempty"`
+	// Overrides are experimental build args, limited to the names in
+	// BUILD_OVERRIDE_ALLOWLIST.
+	Overrides map[string]string `json:"overrides,omitempty"`
+	// Parameters are values for the parameters the repository declares.
+	Parameters map[string]interface{} `json:"parameters,omitempty"`
+	// BuildArgs are passed to buildx as --build-arg, over the
+	// repository's default build args. Declared parameters must be set
+	// through Parameters instead.
+	BuildArgs map[string]string `json:"buildArgs,omitempty"`
+	// Builds sharing a ConcurrencyGroup can supersede each other: with
+	// CancelInProgress, queued and running builds of the group are canceled.
+	ConcurrencyGroup string `json:"concurrencyGroup,omitempty"`
+	CancelInProgress bool   `json:"cancelInProgress,omitempty"`
+	// Compose builds every service with a build section in the
+	// repository's compose file instead of its Dockerfile.
+	Compose bool `json:"compose,omitempty"`
+	// Trigger is set by the server; any value a client sends is replaced.
+	Trigger *Trigger `json:"trigger,omitempty"`
+	// Branch or Tag to build, defaulting to the repository's default
+	// branch. Only one of them may be set.
+	Branch string `json:"branch,omitempty"`
+	Tag    string `json:"tag,omitempty"`
+	// Platforms to build for, such as linux/amd64 and linux/arm64,
+	// defaulting to the builder's own.
+	Platforms []string `json:"platforms,omitempty"`
+	// Commit checks out this commit instead of the head of the branch,
+	// fetching it if no branch or tag contains it.
+	Commit string `json:"commit,omitempty"`
+	// Push pushes the images to the repository's registry, which
+	// registry settings can also do for every build.
+	Push bool `json:"push,omitempty"`
+	// GPUs are handed to the build for its exclusive use, up to the
+	// repository's limit. The build waits until enough are free.
+	GPUs int `json:"gpus,omitempty"`
+	// SkipScans leaves out the secret and license scans. Only the server
+	// sets it, for dependency bot pull requests.
+	SkipScans bool `json:"-"`
 }
 
 type BuildResponse struct {
-	BuildId  string `json:"buildId"`
-	CommitID string `json:"commitId"`
+	BuildId     string                 `json:"buildId"`
+	RepoUrl     string                 `json:"repoUrl,omitempty"`
+	CommitID    string                 `json:"commitId"`
+	Status      string                 `json:"status,omitempty"`
+	Image       string                 `json:"image,omitempty"`
+	ImageDigest string                 `json:"imageDigest,omitempty"`
+	Overrides   map[string]string      `json:"overrides,omitempty"`
+	Parameters  map[string]interface{} `json:"parameters,omitempty"`
+	Compression *Compression           `json:"compression,omitempty"`
+	Commit      *CommitInfo            `json:"commit,omitempty"`
+	// BaseCommit is the previously built commit that ChangedFiles is
+	// relative to.
+	BaseCommit   string   `json:"baseCommit,omitempty"`
+	ChangedFiles []string `json:"changedFiles,omitempty"`
+	// Images lists each service's image for compose builds.
+	Images  []BuiltImage `json:"images,omitempty"`
+	Trigger *Trigger     `json:"trigger,omitempty"`
+	// Stream tells whether a websocket client followed the build's logs.
+	Stream *StreamState `json:"stream,omitempty"`
 }
 
+// protocolVersion is sent with every websocket message so clients can
+// detect changes to the envelope format.
+const protocolVersion = 1
+
+// Websocket message types.
+const (
+	MessageLog      = "log"
+	MessageStage    = "stage"
+	MessageStatus   = "status"
+	MessageComplete = "complete"
+)
+
+// Message is the JSON envelope written to the logs websocket.
+type Message struct {
+	Version int         `json:"v"`
+	Type    string      `json:"type"`
+	Data    interface{} `json:"data"`
+}
+
+type StageData struct {
+	Stage string `json:"stage"`
+}
+
+type StatusData struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// LogStreamer splits command output into lines and streams each one,
+// prefixed with the time it was received, to the build's client.
 type LogStreamer struct {
 	buildId string
+	partial []byte
 }
 
 func (ls *LogStreamer) Write(p []byte) (n int, err error) {
+	touchBuild(ls.buildId)
+	ls.partial = append(ls.partial, p...)
+	for {
+		i := bytes.IndexByte(ls.partial, '\n')
+		if i < 0 {
+			break
+		}
+		logLine(ls.buildId, strings.TrimSuffix(string(ls.partial[:i]), "\r"))
+		ls.partial = ls.partial[i+1:]
+	}
+	return len(p), nil
+}
+
+// Flush streams any trailing output that did not end in a newline.
+func (ls *LogStreamer) Flush() {
+	if len(ls.partial) > 0 {
+		logLine(ls.buildId, string(ls.partial))
+		ls.partial = nil
+	}
+}
+
+func logLine(buildId, line string) {
+	ts := time.Now().UTC().Format("2006-01-02T15:04:05.000Z07:00")
+	line = redact(line)
+	text := ts + " " + line + "\n"
+	sendMessage(buildId, MessageLog, text)
+	appendLog(buildId, text)
+	fanoutLog(buildId, line)
+}
+
+// logStageMarker writes a boundary such as "==> CLONE START" into the build
+// log so consumers can time and fold stages.
+func logStageMarker(buildId, stage, edge string) {
+	logLine(buildId, "==> "+strings.ToUpper(stage)+" "+edge)
+}
+
+// sendMessage writes a typed message to the client following buildId, if
+// any, dropping the client if the write fails.
+func sendMessage(buildId, msgType string, data interface{}) {
 	mu.Lock()
 	defer mu.Unlock()
-	if conn, ok := clients[ls.buildId]; ok {
-		conn.WriteMessage(websocket.TextMessage, p)
+	conn, ok := clients[buildId]
+	if msgType == MessageLog {
+		countStreamedLine(buildId, ok)
+	}
+	if !ok {
+		return
+	}
+	if err := conn.WriteJSON(Message{Version: protocolVersion, Type: msgType, Data: data}); err != nil {
+		dropClient(buildId, conn)
+	}
+}
+
+// closeClient closes and forgets the websocket following buildId, if any.
+func closeClient(buildId string) {
+	mu.Lock()
+	defer mu.Unlock()
+	if conn, ok := clients[buildId]; ok {
+		conn.Close()
+		delete(clients, buildId)
+	}
+}
+
+// notifyClient forwards lifecycle events to the build's websocket client.
+func notifyClient(e Event) {
+	switch e.Type {
+	case EventStageStarted:
+		sendMessage(e.BuildId, MessageStage, StageData{Stage: e.Stage})
+	case EventBuildStalled:
+		sendMessage(e.BuildId, MessageStatus, StatusData{Status: "stalled"})
+	case EventBuildFailed:
+		sendMessage(e.BuildId, MessageStatus, StatusData{Status: "failed", Error: redact(e.Err.Error())})
+		closeClient(e.BuildId)
+	case EventBuildSucceeded:
+		sendMessage(e.BuildId, MessageComplete, BuildResponse{BuildId: e.BuildId, CommitID: e.CommitID, Image: e.Image, ImageDigest: e.ImageDigest, Commit: &e.Commit})
+		closeClient(e.BuildId)
 	}
-	return len(p), nil
 }
 
 var db *sql.DB
@@ -63,87 +226,819 @@ func initDB() {
         commit_id TEXT,
         timestamp DATETIME DEFAULT CURRENT_TIMESTAMP
     );
+    CREATE TABLE IF NOT EXISTS idempotency_keys (
+        key TEXT PRIMARY KEY,
+        build_id TEXT,
+        created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+    );
+    CREATE TABLE IF NOT EXISTS batch_builds (
+        batch_id TEXT,
+        build_id TEXT PRIMARY KEY,
+        repo_url TEXT,
+        status TEXT,
+        error TEXT DEFAULT ''
+    );
+    CREATE TABLE IF NOT EXISTS build_dependencies (
+        upstream TEXT,
+        downstream TEXT,
+        PRIMARY KEY (upstream, downstream)
+    );
+    CREATE TABLE IF NOT EXISTS scheduled_builds (
+        build_id TEXT PRIMARY KEY,
+        repo_url TEXT,
+        request TEXT,
+        run_at DATETIME,
+        status TEXT
+    );
+    CREATE TABLE IF NOT EXISTS build_compression (
+        repo_url TEXT PRIMARY KEY,
+        compression TEXT
+    );
+    CREATE TABLE IF NOT EXISTS build_parameters (
+        repo_url TEXT PRIMARY KEY,
+        parameters TEXT
+    );
+    CREATE TABLE IF NOT EXISTS build_provenance (
+        build_id TEXT PRIMARY KEY,
+        statement TEXT
+    );
+    CREATE TABLE IF NOT EXISTS build_licenses (
+        build_id TEXT PRIMARY KEY,
+        report TEXT
+    );
+    CREATE TABLE IF NOT EXISTS build_secret_findings (
+        build_id TEXT PRIMARY KEY,
+        findings TEXT
+    );
+    CREATE TABLE IF NOT EXISTS build_resources (
+        build_id TEXT PRIMARY KEY,
+        cpu_seconds REAL,
+        wall_seconds REAL,
+        peak_memory_bytes INTEGER,
+        read_bytes INTEGER,
+        write_bytes INTEGER
+    );
+    CREATE TABLE IF NOT EXISTS build_triggers (
+        build_id TEXT PRIMARY KEY,
+        trigger TEXT
+    );
+    CREATE TABLE IF NOT EXISTS build_metric_rules (
+        repo_url TEXT PRIMARY KEY,
+        rules TEXT
+    );
+    CREATE TABLE IF NOT EXISTS build_metrics (
+        build_id TEXT,
+        name TEXT,
+        value TEXT,
+        number REAL,
+        PRIMARY KEY (build_id, name)
+    );
+    CREATE TABLE IF NOT EXISTS base_images (
+        repo_url TEXT,
+        image TEXT,
+        digest TEXT,
+        PRIMARY KEY (repo_url, image)
+    );
+    CREATE TABLE IF NOT EXISTS build_base_digests (
+        build_id TEXT,
+        image TEXT,
+        digest TEXT,
+        PRIMARY KEY (build_id, image)
+    );
+    CREATE TABLE IF NOT EXISTS base_advisories (
+        digest TEXT PRIMARY KEY,
+        cves TEXT
+    );
+    CREATE TABLE IF NOT EXISTS build_cache_stats (
+        build_id TEXT PRIMARY KEY,
+        repo_url TEXT,
+        steps INTEGER,
+        cached INTEGER,
+        details TEXT,
+        timestamp DATETIME DEFAULT CURRENT_TIMESTAMP
+    );
+    CREATE TABLE IF NOT EXISTS workspace_retention (
+        repo_url TEXT PRIMARY KEY,
+        hours INTEGER
+    );
+    CREATE TABLE IF NOT EXISTS retained_workspaces (
+        build_id TEXT PRIMARY KEY,
+        repo_url TEXT,
+        expires_at DATETIME
+    );
+    CREATE TABLE IF NOT EXISTS build_streams (
+        build_id TEXT PRIMARY KEY,
+        state TEXT,
+        connected_at DATETIME,
+        disconnected_at DATETIME,
+        lines INTEGER,
+        missed_lines INTEGER
+    );
+    CREATE TABLE IF NOT EXISTS build_environments (
+        build_id TEXT PRIMARY KEY,
+        environment TEXT
+    );
+    CREATE TABLE IF NOT EXISTS default_branches (
+        repo_url TEXT PRIMARY KEY,
+        branch TEXT,
+        checked_at DATETIME
+    );
+    CREATE TABLE IF NOT EXISTS build_status (
+        build_id TEXT PRIMARY KEY,
+        repo_url TEXT,
+        state TEXT,
+        stage TEXT,
+        error TEXT,
+        queued_at DATETIME,
+        started_at DATETIME,
+        finished_at DATETIME
+    );
+    CREATE TABLE IF NOT EXISTS trigger_filters (
+        repo_url TEXT PRIMARY KEY,
+        filters TEXT
+    );
+    CREATE TABLE IF NOT EXISTS skipped_triggers (
+        repo_url TEXT,
+        source TEXT,
+        commit_id TEXT,
+        author TEXT,
+        message TEXT,
+        reason TEXT,
+        timestamp DATETIME
+    );
+    CREATE TABLE IF NOT EXISTS webhook_settings (
+        repo_url TEXT PRIMARY KEY,
+        secret TEXT,
+        branch TEXT,
+        auto_build BOOLEAN
+    );
+    CREATE TABLE IF NOT EXISTS pull_request_builds (
+        build_id TEXT PRIMARY KEY,
+        provider TEXT,
+        repository TEXT,
+        number INTEGER,
+        base_branch TEXT
+    );
+    CREATE TABLE IF NOT EXISTS pull_request_comments (
+        provider TEXT,
+        repository TEXT,
+        number INTEGER,
+        comment_id INTEGER,
+        PRIMARY KEY (provider, repository, number)
+    );
+    CREATE TABLE IF NOT EXISTS org_policy (
+        id INTEGER PRIMARY KEY CHECK (id = 1),
+        policy TEXT
+    );
+    CREATE TABLE IF NOT EXISTS build_policy_violations (
+        build_id TEXT PRIMARY KEY,
+        violations TEXT
+    );
+    CREATE TABLE IF NOT EXISTS default_build_args (
+        repo_url TEXT PRIMARY KEY,
+        args TEXT
+    );
+    CREATE TABLE IF NOT EXISTS image_size_limits (
+        repo_url TEXT PRIMARY KEY,
+        max_size INTEGER,
+        action TEXT
+    );
+    CREATE TABLE IF NOT EXISTS build_image_sizes (
+        build_id TEXT PRIMARY KEY,
+        reports TEXT
+    );
+    CREATE TABLE IF NOT EXISTS registry_settings (
+        repo_url TEXT PRIMARY KEY,
+        registry TEXT,
+        repository TEXT,
+        username TEXT,
+        password TEXT,
+        push BOOLEAN
+    );
+    CREATE TABLE IF NOT EXISTS build_pushes (
+        build_id TEXT PRIMARY KEY,
+        images TEXT
+    );
+    CREATE TABLE IF NOT EXISTS worker_requirements (
+        repo_url TEXT PRIMARY KEY,
+        labels TEXT
+    );
+    CREATE TABLE IF NOT EXISTS image_naming (
+        repo_url TEXT PRIMARY KEY,
+        name TEXT,
+        tag_template TEXT
+    );
+    CREATE TABLE IF NOT EXISTS build_numbers (
+        repo_url TEXT PRIMARY KEY,
+        last INTEGER
+    );
+    CREATE TABLE IF NOT EXISTS gpu_settings (
+        repo_url TEXT PRIMARY KEY,
+        max_gpus INTEGER
+    );
+    CREATE TABLE IF NOT EXISTS cost_rates (
+        id INTEGER PRIMARY KEY,
+        rates TEXT
+    );
+    CREATE TABLE IF NOT EXISTS build_costs (
+        build_id TEXT PRIMARY KEY,
+        repo_url TEXT,
+        org TEXT,
+        month TEXT,
+        build_seconds REAL,
+        cost REAL
+    );
+    CREATE TABLE IF NOT EXISTS storage_costs (
+        repo_url TEXT,
+        org TEXT,
+        month TEXT,
+        gb_months REAL,
+        cost REAL,
+        PRIMARY KEY (repo_url, month)
+    );
+    CREATE TABLE IF NOT EXISTS maintenance_state (
+        id INTEGER PRIMARY KEY,
+        state TEXT
+    );
+    CREATE TABLE IF NOT EXISTS build_tools (
+        build_id TEXT PRIMARY KEY,
+        git TEXT,
+        docker TEXT,
+        buildx TEXT
+    );
     `
 	_, err = db.Exec(createTable)
 	if err != nil {
 		log.Fatal(err)
 	}
+
+	// Columns added after the tables were first created; older databases
+	// get them here and already-migrated ones report duplicates.
+	migrations := []string{
+		"ALTER TABLE builds ADD COLUMN image TEXT DEFAULT ''",
+		"UPDATE builds SET image = 'myapp:' || commit_id WHERE image = ''",
+		"ALTER TABLE builds ADD COLUMN overrides TEXT DEFAULT ''",
+		"ALTER TABLE builds ADD COLUMN commit_author TEXT DEFAULT ''",
+		"ALTER TABLE builds ADD COLUMN commit_author_email TEXT DEFAULT ''",
+		"ALTER TABLE builds ADD COLUMN commit_message TEXT DEFAULT ''",
+		"ALTER TABLE builds ADD COLUMN committed_at DATETIME",
+		"ALTER TABLE builds ADD COLUMN base_commit TEXT DEFAULT ''",
+		"ALTER TABLE builds ADD COLUMN changed_files TEXT DEFAULT ''",
+		"ALTER TABLE builds ADD COLUMN parameters TEXT DEFAULT ''",
+		"ALTER TABLE builds ADD COLUMN image_digest TEXT DEFAULT ''",
+		"ALTER TABLE builds ADD COLUMN compression TEXT DEFAULT ''",
+		"ALTER TABLE builds ADD COLUMN images TEXT DEFAULT ''",
+		"ALTER TABLE builds ADD COLUMN branch TEXT DEFAULT ''",
+		// Builds saved before status was tracked all succeeded.
+		"INSERT OR IGNORE INTO build_status (build_id, repo_url, state, finished_at) SELECT id, repo_url, 'succeeded', timestamp FROM builds",
+		"ALTER TABLE webhook_settings ADD COLUMN token TEXT DEFAULT ''",
+		"ALTER TABLE webhook_settings ADD COLUMN dependency_bots BOOLEAN DEFAULT 0",
+		"ALTER TABLE webhook_settings ADD COLUMN dependency_bot_scans BOOLEAN DEFAULT 0",
+		"ALTER TABLE webhook_settings ADD COLUMN pull_requests BOOLEAN DEFAULT 0",
+	}
+	for _, m := range migrations {
+		if _, err := db.Exec(m); err != nil && !strings.Contains(err.Error(), "duplicate column name") {
+			log.Fatal(err)
+		}
+	}
+	store = sqliteBuildStore{db}
+}
+
+// encodeJSONColumn encodes v for a TEXT column, storing nil as "".
+func encodeJSONColumn(v interface{}) (string, error) {
+	b, err := json.Marshal(v)
+	if err != nil || string(b) == "null" {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func decodeJSONColumn(s string, v interface{}) error {
+	if s == "" {
+		return nil
+	}
+	return json.Unmarshal([]byte(s), v)
+}
+
+// recordBuild saves successful builds to the database.
+func recordBuild(e Event) {
+	if e.Type != EventBuildSucceeded {
+		return
+	}
+	if err := store.SaveBuild(e); err != nil {
+		log.Printf("Error saving build details: %v", err)
+	}
+}
+
+// rowScanner is satisfied by both *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...interface{}) error
 }
 
-func saveBuild(buildID, repoURL, commitID string) error {
-	_, err := db.Exec("INSERT INTO builds (id, repo_url, commit_id) VALUES (?, ?, ?)", buildID, repoURL, commitID)
-	return err
+// withBuildDetails adds what is recorded about build outside the builds
+// table.
+func withBuildDetails(build BuildResponse, err error) (BuildResponse, error) {
+	if err != nil {
+		return build, err
+	}
+	if build.Trigger, err = getTrigger(build.BuildId); err != nil && err != sql.ErrNoRows {
+		return build, err
+	}
+	if build.Stream, err = getStreamState(build.BuildId); err != nil && err != sql.ErrNoRows {
+		return build, err
+	}
+	return build, nil
 }
 
 func getLastBuild() (BuildResponse, error) {
+	return withBuildDetails(store.LastBuild())
+}
+
+// getBuild returns a successful build by ID.
+func getBuild(buildId string) (BuildResponse, error) {
+	return withBuildDetails(store.GetBuild(buildId))
+}
 
-	var build BuildResponse
-	row := db.QueryRow("SELECT id, commit_id FROM builds ORDER BY timestamp DESC LIMIT 1")
-	err := row.Scan(&build.BuildId, &build.CommitID)
-	return build, err
+// validateBuildRequest checks req's overrides and resolves its parameters
+// against the repository's schema, filling in defaults.
+func validateBuildRequest(req *BuildRequest) error {
+	if err := validateRepoURL(req.RepoUrl); err != nil {
+		return err
+	}
+	if req.Branch != "" && req.Tag != "" {
+		return errors.New("only one of branch and tag may be set")
+	}
+	if req.Branch != "" {
+		if err := validateBranch(req.Branch); err != nil {
+			return err
+		}
+	}
+	if req.Tag != "" {
+		if err := validateTag(req.Tag); err != nil {
+			return err
+		}
+	}
+	if req.Commit != "" {
+		req.Commit = strings.ToLower(req.Commit)
+		if err := validateCommit(req.Commit); err != nil {
+			return err
+		}
+	}
+	if err := validateOverrides(req.Overrides); err != nil {
+		return err
+	}
+	if err := validateBuildArgs(req.BuildArgs); err != nil {
+		return err
+	}
+	if err := validatePlatforms(req.Platforms); err != nil {
+		return err
+	}
+	if err := checkBuildArgsAgainstParameters(req.RepoUrl, req.BuildArgs); err != nil {
+		return err
+	}
+	if err := checkPushRequest(req); err != nil {
+		return err
+	}
+	if err := matchWorker(req.RepoUrl); err != nil {
+		return err
+	}
+	if err := checkGPURequest(req); err != nil {
+		return err
+	}
+	args, err := resolveParameters(req.RepoUrl, req.Parameters)
+	if err != nil {
+		return err
+	}
+	req.Parameters = nil
+	for name, value := range args {
+		if req.Parameters == nil {
+			req.Parameters = make(map[string]interface{})
+		}
+		req.Parameters[name] = value
+	}
+	return nil
 }
 
 func buildHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	var req BuildRequest
 	json.NewDecoder(r.Body).Decode(&req)
+	if err := validateBuildRequest(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req.Trigger = &Trigger{Source: TriggerAPI, Client: r.RemoteAddr}
+	if draining.Load() {
+		rejectDraining(w)
+		return
+	}
+
+	// Replays of a key we have already seen get the original build back.
+	key := r.Header.Get("Idempotency-Key")
+	if key != "" {
+		if buildId, ok := lookupIdempotencyKey(key); ok {
+			json.NewEncoder(w).Encode(BuildResponse{BuildId: buildId})
+			return
+		}
+	}
+
+	buildId := uuid.New().String()
+	if key != "" {
+		owner, err := claimIdempotencyKey(key, buildId)
+		if err != nil {
+			http.Error(w, "Could not record idempotency key", http.StatusInternalServerError)
+			return
+		}
+		if owner != buildId {
+			json.NewEncoder(w).Encode(BuildResponse{BuildId: owner})
+			return
+		}
+	}
+
+	if req.RunAt != nil && req.RunAt.After(time.Now()) {
+		req.Trigger.Source = TriggerSchedule
+		if err := scheduleBuild(buildId, req); err != nil {
+			releaseIdempotencyKey(key, buildId)
+			http.Error(w, "Could not schedule build", http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(BuildResponse{BuildId: buildId, Status: "scheduled"})
+		return
+	}
+
+	if !enqueueBuild(buildId, req) {
+		releaseIdempotencyKey(key, buildId)
+		rejectQueueFull(w)
+		return
+	}
+
+	resp := BuildResponse{BuildId: buildId}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// enqueueBuild queues req under buildId, returning false if the queue is
+// full.
+func enqueueBuild(buildId string, req BuildRequest) bool {
+	if !queue.Reserve() {
+		return false
+	}
+	joinConcurrencyGroup(buildId, req)
+	bus.Publish(Event{Type: EventBuildQueued, BuildId: buildId, RepoUrl: req.RepoUrl})
+	go runQueued(buildId, req)
+	return true
+}
+
+// runQueued waits for the GPUs req needs, then for a free slot, and runs
+// the build in it. A build waiting for GPUs holds no slot and, not having
+// started, is not mistaken for a stalled one by the watchdog. If it can't
+// get them it fails as soon as it starts.
+func runQueued(buildId string, req BuildRequest) {
+	if err := gpus.Acquire(buildId, req.GPUs); err != nil {
+		log.Printf("Error acquiring GPUs for %s: %v", buildId, err)
+	}
+	defer gpus.Release(buildId)
+	queue.Run(func() { executor.Run(buildId, req) })
+}
 
+// submitBuild queues req under a new build ID, returning false if the
+// queue is full.
+func submitBuild(req BuildRequest) (string, bool) {
 	buildId := uuid.New().String()
+	return buildId, enqueueBuild(buildId, req)
+}
 
+// runBuild clones, builds and records a single build.
+func runBuild(buildId string, req BuildRequest) {
 	var commitID string
+	started := time.Now()
 
-	go func() {
-		// Clone the repository
-		repoDir := fmt.Sprintf("/tmp/%s", buildId)
-		cmd := exec.Command("git", "clone", req.RepoUrl, repoDir)
-		cmd.Stdout = &LogStreamer{buildId: buildId}
-		cmd.Stderr = &LogStreamer{buildId: buildId}
-		if err := cmd.Run(); err != nil {
-			log.Printf("Error cloning repository: %v", err)
-			return
+	bus.Publish(Event{Type: EventBuildStarted, BuildId: buildId, RepoUrl: req.RepoUrl})
+	if err := saveTrigger(buildId, req.Trigger); err != nil {
+		log.Printf("Error saving build trigger: %v", err)
+	}
+	if err := abortError(buildId); err != nil {
+		bus.Publish(Event{Type: EventBuildFailed, BuildId: buildId, RepoUrl: req.RepoUrl, Err: err})
+		return
+	}
+	// Requirements may have changed since a scheduled build was accepted
+	if err := matchWorker(req.RepoUrl); err != nil {
+		bus.Publish(Event{Type: EventBuildFailed, BuildId: buildId, RepoUrl: req.RepoUrl, Err: err})
+		return
+	}
+	if held := len(gpus.Held(buildId)); held < req.GPUs {
+		err := fmt.Errorf("build needs %d GPUs but could only get %d", req.GPUs, held)
+		bus.Publish(Event{Type: EventBuildFailed, BuildId: buildId, RepoUrl: req.RepoUrl, Err: err})
+		return
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Build %s panicked: %v", buildId, r)
+			bus.Publish(Event{Type: EventBuildFailed, BuildId: buildId, RepoUrl: req.RepoUrl, Err: fmt.Errorf("internal error: %v", r)})
 		}
+	}()
 
-		// Get the latest commit ID
-		cmd = exec.Command("git", "-C", repoDir, "rev-parse", "HEAD")
-		commitIDBytes, err := cmd.Output()
+	// Record the host tooling and refuse to build with outdated versions
+	tools, err := detectToolVersions()
+	if err == nil {
+		if err := saveToolVersions(buildId, tools); err != nil {
+			log.Printf("Error saving tool versions: %v", err)
+		}
+		err = checkToolVersions(tools)
+	}
+	if err != nil {
+		log.Printf("Error checking tool versions: %v", err)
+		bus.Publish(Event{Type: EventBuildFailed, BuildId: buildId, RepoUrl: req.RepoUrl, Err: err})
+		return
+	}
+
+	// Hold the build to the administrator's policy, which it cannot relax
+	policy, err := getPolicy()
+	if err != nil {
+		log.Printf("Error reading policy: %v", err)
+		bus.Publish(Event{Type: EventBuildFailed, BuildId: buildId, RepoUrl: req.RepoUrl, Err: fmt.Errorf("reading policy: %v", err)})
+		return
+	}
+	if violations := checkScanPolicy(policy); len(violations) > 0 {
+		bus.Publish(Event{Type: EventBuildFailed, BuildId: buildId, RepoUrl: req.RepoUrl, Err: policyFailure(buildId, violations)})
+		return
+	}
+	if req.SkipScans && policy.RequireScans {
+		logLine(buildId, "==> secret and license scans required by policy")
+		req.SkipScans = false
+	}
+
+	// Clone the repository
+	bus.Publish(Event{Type: EventStageStarted, BuildId: buildId, RepoUrl: req.RepoUrl, Stage: "clone"})
+	logStageMarker(buildId, "clone", "START")
+	if req.Branch == "" && req.Tag == "" {
+		if branch, err := defaultBranch(req.RepoUrl); err != nil {
+			log.Printf("Error getting default branch, building remote HEAD: %v", err)
+		} else {
+			req.Branch = branch
+		}
+	}
+	repoDir := buildDir(buildId)
+	ref := req.Branch
+	if req.Tag != "" {
+		ref = req.Tag
+	}
+	var pull *prePull
+	if prePullEnabled() && currentBuilder().Driver == "docker" {
+		rev := req.Commit
+		if rev == "" {
+			rev = ref
+		}
+		if rev == "" {
+			rev = "HEAD"
+		}
+		pull = startPrePull(buildId, prePullImages(req.RepoUrl, rev, req.Compose))
+	}
+	cloneStart := time.Now()
+	err = cloneRepo(buildId, req.RepoUrl, ref, req.Commit, repoDir)
+	pull.wait(buildId, time.Since(cloneStart))
+	logStageMarker(buildId, "clone", "END")
+	if err != nil {
+		log.Printf("Error cloning repository: %v", err)
+		bus.Publish(Event{Type: EventBuildFailed, BuildId: buildId, RepoUrl: req.RepoUrl, CommitID: commitID, Err: err})
+		return
+	}
+
+	// Get the latest commit ID
+	cmd := exec.Command("git", "-C", repoDir, "rev-parse", "HEAD")
+	commitIDBytes, err := cmd.Output()
+	if err != nil {
+		log.Printf("Error getting latest commit ID: %v", err)
+		bus.Publish(Event{Type: EventBuildFailed, BuildId: buildId, RepoUrl: req.RepoUrl, CommitID: commitID, Err: err})
+		return
+	}
+	commitID = strings.TrimSpace(string(commitIDBytes))
+
+	commit, err := commitInfo(repoDir)
+	if err != nil {
+		log.Printf("Error reading commit metadata: %v", err)
+	}
+
+	// Work out what changed since the last successful build of this branch
+	var changed []string
+	baseCommit, ok := lastBuiltCommit(req.RepoUrl, req.Branch)
+	if ok {
+		if changed, err = changedFiles(repoDir, baseCommit); err != nil {
+			log.Printf("Error listing changed files since %s: %v", baseCommit, err)
+			baseCommit = ""
+		}
+	}
+
+	if req.SkipScans {
+		logLine(buildId, "==> secret and license scans skipped for dependency update")
+	}
+
+	// Look for secrets that would be baked into the image
+	if secretScanEnabled() && !req.SkipScans {
+		bus.Publish(Event{Type: EventStageStarted, BuildId: buildId, RepoUrl: req.RepoUrl, CommitID: commitID, Stage: "secret-scan"})
+		logStageMarker(buildId, "secret-scan", "START")
+		findings, err := scanSecrets(buildId, repoDir)
+		if err == nil {
+			if err := saveSecretFindings(buildId, findings); err != nil {
+				log.Printf("Error saving secret scan findings: %v", err)
+			}
+			err = checkSecretFindings(findings)
+		}
+		logStageMarker(buildId, "secret-scan", "END")
 		if err != nil {
-			log.Printf("Error getting latest commit ID: %v", err)
+			log.Printf("Error scanning for secrets: %v", err)
+			bus.Publish(Event{Type: EventBuildFailed, BuildId: buildId, RepoUrl: req.RepoUrl, CommitID: commitID, Err: err})
 			return
 		}
-		commitID = strings.TrimSpace(string(commitIDBytes))
+	}
 
-		// Build the Docker image using Buildx
-		imageName := fmt.Sprintf("myapp:%s", commitID)
-		cmd = exec.Command("docker", "buildx", "build", repoDir, "--tag", imageName, "--output=type=docker")
-		cmd.Stdout = &LogStreamer{buildId: buildId}
-		cmd.Stderr = &LogStreamer{buildId: buildId}
-		if err := cmd.Run(); err != nil {
-			log.Printf("Error building Docker image: %v", err)
+	// Build the Docker image using Buildx
+	bus.Publish(Event{Type: EventStageStarted, BuildId: buildId, RepoUrl: req.RepoUrl, CommitID: commitID, Stage: "build"})
+	naming, err := getImageNaming(req.RepoUrl)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("Error reading image naming: %v", err)
+	}
+	values := TagValues{Branch: req.Branch, Tag: req.Tag, Commit: commitID, Date: started}
+	if usesBuildNumber(naming.TagTemplate) {
+		if values.BuildNumber, err = nextBuildNumber(req.RepoUrl); err != nil {
+			log.Printf("Error numbering build: %v", err)
+			bus.Publish(Event{Type: EventBuildFailed, BuildId: buildId, RepoUrl: req.RepoUrl, CommitID: commitID, Err: err})
 			return
 		}
+	}
+	tag := renderTag(naming.TagTemplate, values)
+	if len(req.Overrides) > 0 {
+		// Keep experimental images from replacing the standard one.
+		suffix := "-exp-" + buildId[:8]
+		tag = tag[:min(len(tag), maxTagLength-len(suffix))] + suffix
+	}
+	buildArgs, err := getDefaultBuildArgs(req.RepoUrl)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("Error reading default build args: %v", err)
+	}
+	if buildArgs == nil {
+		buildArgs = make(map[string]string)
+	}
+	for name, value := range req.BuildArgs {
+		buildArgs[name] = value
+	}
+	for name, value := range req.Parameters {
+		buildArgs[name] = fmt.Sprint(value)
+	}
+	for name, value := range req.Overrides {
+		buildArgs[name] = value
+	}
+	compression, err := getCompression(req.RepoUrl)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("Error reading compression settings: %v", err)
+	}
+	labels := imageLabels(req.RepoUrl)
+	policyLabels(policy, labels)
 
-		// Notify frontend that the build process is complete
-		mu.Lock()
-		if conn, ok := clients[buildId]; ok {
-			conn.WriteMessage(websocket.TextMessage, []byte("BUILD_COMPLETE"))
-			conn.Close()
-			delete(clients, buildId)
-		}
-		mu.Unlock()
+	// Record the effective configuration before building, so failed
+	// builds can be explained too
+	project, err := projectSettings(req.RepoUrl)
+	if err != nil {
+		log.Printf("Error reading project settings: %v", err)
+	}
+	recordedReq := req
+	recordedReq.BuildArgs = redactValues(req.BuildArgs)
+	env := BuildEnvironment{
+		RepoUrl:       req.RepoUrl,
+		CommitID:      commitID,
+		Tag:           tag,
+		Compose:       req.Compose,
+		BuildArgs:     redactValues(buildArgs),
+		Labels:        labels,
+		Request:       recordedReq,
+		Project:       project,
+		Policy:        policy,
+		Tools:         tools,
+		Builder:       currentBuilder(),
+		Server:        serverSettings(),
+		ServerVersion: versionInfo(),
+		RecordedAt:    time.Now().UTC(),
+	}
+	if err := saveBuildEnvironment(buildId, env); err != nil {
+		log.Printf("Error saving build environment: %v", err)
+	}
+
+	if err := checkPlatforms(req.Platforms); err != nil {
+		log.Printf("Error checking platforms: %v", err)
+		bus.Publish(Event{Type: EventBuildFailed, BuildId: buildId, RepoUrl: req.RepoUrl, CommitID: commitID, Err: err})
+		return
+	}
+
+	gpuIndexes := gpus.Held(buildId)
+	var images []BuiltImage
+	logStageMarker(buildId, "build", "START")
+	if req.Compose {
+		images, err = buildComposeImages(buildId, repoDir, imageName(naming, req.RepoUrl, true), tag, compression, buildArgs, labels, req.Platforms, gpuIndexes)
+	} else {
+		var image BuiltImage
+		image, err = buildImage(buildId, repoDir, "", imageName(naming, req.RepoUrl, false)+":"+tag, compression, buildArgs, labels, req.Platforms, gpuIndexes)
+		images = []BuiltImage{image}
+	}
+	logStageMarker(buildId, "build", "END")
+	if err != nil {
+		log.Printf("Error building Docker image: %v", err)
+		bus.Publish(Event{Type: EventBuildFailed, BuildId: buildId, RepoUrl: req.RepoUrl, CommitID: commitID, Err: err})
+		return
+	}
+	imageNames := make([]string, len(images))
+	var baseImages []string
+	for i, image := range images {
+		imageNames[i] = image.Image
+		baseImages = append(baseImages, image.BaseImages...)
+	}
+	if err := saveBaseImages(req.RepoUrl, baseImages); err != nil {
+		log.Printf("Error saving base images: %v", err)
+	}
+	if err := saveBaseDigests(buildId, images); err != nil {
+		log.Printf("Error saving base image digests: %v", err)
+	}
 
-		// Save build details to the database
-		if err := saveBuild(buildId, req.RepoUrl, commitID); err != nil {
-			log.Printf("Error saving build details: %v", err)
+	// Check the images against the policy's rules
+	bus.Publish(Event{Type: EventStageStarted, BuildId: buildId, RepoUrl: req.RepoUrl, CommitID: commitID, Stage: "policy"})
+	logStageMarker(buildId, "policy", "START")
+	violations, err := checkImagePolicy(policy, images)
+	if err == nil {
+		var sizeViolations []PolicyViolation
+		sizeViolations, err = checkImageSizes(buildId, req.RepoUrl, policy, images)
+		violations = append(violations, sizeViolations...)
+	}
+	if err == nil && len(violations) > 0 {
+		err = policyFailure(buildId, violations)
+	}
+	logStageMarker(buildId, "policy", "END")
+	if err != nil {
+		log.Printf("Error checking policy: %v", err)
+		bus.Publish(Event{Type: EventBuildFailed, BuildId: buildId, RepoUrl: req.RepoUrl, CommitID: commitID, Err: err})
+		return
+	}
+
+	// Inventory the image's licenses and refuse denied ones
+	if licenseScanEnabled() && !req.SkipScans {
+		bus.Publish(Event{Type: EventStageStarted, BuildId: buildId, RepoUrl: req.RepoUrl, CommitID: commitID, Stage: "license-scan"})
+		logStageMarker(buildId, "license-scan", "START")
+		report, err := scanLicenses(imageNames...)
+		if err == nil {
+			if err := saveLicenseReport(buildId, report); err != nil {
+				log.Printf("Error saving license report: %v", err)
+			}
+			if len(report.Denied) > 0 {
+				err = fmt.Errorf("image contains denied licenses: %s", strings.Join(report.Denied, ", "))
+			}
+		}
+		logStageMarker(buildId, "license-scan", "END")
+		if err != nil {
+			log.Printf("Error scanning licenses: %v", err)
+			bus.Publish(Event{Type: EventBuildFailed, BuildId: buildId, RepoUrl: req.RepoUrl, CommitID: commitID, Err: err})
+			return
 		}
+	}
+
+	provenance := newProvenance(buildId, req, commitID, images, tools, started)
 
-		// Clean up: delete the repository directory
-		if err := os.RemoveAll(repoDir); err != nil {
-			log.Printf("Error removing repository directory: %v", err)
+	// Push the images to the repository's registry
+	registry, push, err := buildRegistry(req)
+	if err != nil {
+		log.Printf("Error reading registry settings: %v", err)
+		bus.Publish(Event{Type: EventBuildFailed, BuildId: buildId, RepoUrl: req.RepoUrl, CommitID: commitID, Err: err})
+		return
+	}
+	if push {
+		bus.Publish(Event{Type: EventStageStarted, BuildId: buildId, RepoUrl: req.RepoUrl, CommitID: commitID, Stage: "push"})
+		logStageMarker(buildId, "push", "START")
+		pushed, err := pushImages(buildId, registry, images, tag, &provenance)
+		logStageMarker(buildId, "push", "END")
+		if len(pushed) > 0 {
+			if err := savePushedImages(buildId, pushed); err != nil {
+				log.Printf("Error saving pushed images: %v", err)
+			}
 		}
-	}()
+		if err != nil {
+			log.Printf("Error pushing images: %v", err)
+			bus.Publish(Event{Type: EventBuildFailed, BuildId: buildId, RepoUrl: req.RepoUrl, CommitID: commitID, Err: err})
+			return
+		}
+	}
 
-	resp := BuildResponse{BuildId: buildId, CommitID: commitID}
-	json.NewEncoder(w).Encode(resp)
+	if err := saveProvenance(buildId, provenance); err != nil {
+		log.Printf("Error saving provenance: %v", err)
+	}
+
+	// The first image stands for the build; compose builds also record
+	// every service's image.
+	succeeded := Event{Type: EventBuildSucceeded, BuildId: buildId, RepoUrl: req.RepoUrl, Branch: req.Branch, CommitID: commitID, Image: images[0].Image, ImageDigest: images[0].Digest, Overrides: req.Overrides, Parameters: req.Parameters, Compression: compression, Commit: commit, BaseCommit: baseCommit, ChangedFiles: changed}
+	if req.Compose {
+		succeeded.Images = images
+	}
+	bus.Publish(succeeded)
+
+	// Clean up: delete the repository directory
+	if err := os.RemoveAll(repoDir); err != nil {
+		log.Printf("Error removing repository directory: %v", err)
+	}
 }
 
 func lastBuildHandler(w http.ResponseWriter, r *http.Request) {
@@ -165,10 +1060,13 @@ func logsHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Could not open websocket connection", http.StatusBadRequest)
 		return
 	}
+	conn.SetCompressionLevel(flate.BestSpeed)
 
 	mu.Lock()
 	clients[buildId] = conn
+	clientConnected(buildId)
 	mu.Unlock()
+	go watchClient(buildId, conn)
 }
 func CorsMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -186,15 +1084,177 @@ func CorsMiddleware(next http.Handler) http.Handler {
 	})
 }
 
-func main() {
-	initDB()
-	defer db.Close()
+// subscribeEventHandlers registers the subscribers that react to build
+// lifecycle events, in the order they must run.
+func subscribeEventHandlers() {
+	bus.Subscribe(leaveConcurrencyGroup)
+	bus.Subscribe(trackActiveBuild)
+	bus.Subscribe(notifyClient)
+	bus.Subscribe(recordBuild)
+	bus.Subscribe(recordBuildStatus)
+	bus.Subscribe(recordBatchStatus)
+	bus.Subscribe(triggerDownstream)
+	bus.Subscribe(retainWorkspace)
+	bus.Subscribe(trackStream)
+	bus.Subscribe(closeBuildLog)
+	bus.Subscribe(recordMetrics)
+	bus.Subscribe(recordCacheStats)
+	bus.Subscribe(recordCost)
+	bus.Subscribe(commentPullRequest)
+	bus.Subscribe(fanoutEvent)
+}
+
+func newRouter() *mux.Router {
 	r := mux.NewRouter()
 	r.HandleFunc("/api/build", buildHandler).Methods("POST")
+	r.HandleFunc("/api/builds", buildHistoryHandler).Methods("GET")
+	r.HandleFunc("/api/builds/batch", batchBuildHandler).Methods("POST")
+	r.HandleFunc("/api/builds/batch/{batchId}", batchStatusHandler).Methods("GET")
+	r.HandleFunc("/api/dependencies", addDependencyHandler).Methods("POST")
+	r.HandleFunc("/api/dependencies", deleteDependencyHandler).Methods("DELETE")
+	r.HandleFunc("/api/dependencies/graph", dependencyGraphHandler).Methods("GET")
+	r.HandleFunc("/api/builds/{buildId}/licenses", licensesHandler).Methods("GET")
+	r.HandleFunc("/api/builds/{buildId}/provenance", provenanceHandler).Methods("GET")
+	r.HandleFunc("/api/builds/{buildId}/logs", logDownloadHandler).Methods("GET")
+	r.HandleFunc("/api/builds/{buildId}/logs/tail", logTailHandler).Methods("GET")
+	r.HandleFunc("/api/builds/compare", compareBuildsHandler).Methods("GET")
+	r.HandleFunc("/api/builds/{buildId}", buildStatusHandler).Methods("GET")
+	r.HandleFunc("/api/builds/{buildId}/sarif", sarifHandler).Methods("GET")
+	r.HandleFunc("/api/builds/{buildId}/workspace", workspaceHandler).Methods("GET")
+	r.HandleFunc("/api/builds/{buildId}/debug", startDebugHandler).Methods("POST")
+	r.HandleFunc("/api/builds/{buildId}/debug", getDebugHandler).Methods("GET")
+	r.HandleFunc("/api/builds/{buildId}/debug", stopDebugHandler).Methods("DELETE")
+	r.HandleFunc("/api/builds/{buildId}/debug/exec", debugExecHandler)
+	r.HandleFunc("/api/builds/{buildId}/stream", streamStateHandler).Methods("GET")
+	r.HandleFunc("/api/builds/{buildId}/cache", cacheStatsHandler).Methods("GET")
+	r.HandleFunc("/api/builds/{buildId}/metrics", metricsHandler).Methods("GET")
+	r.HandleFunc("/api/builds/{buildId}/trigger", triggerHandler).Methods("GET")
+	r.HandleFunc("/api/builds/{buildId}/resources", resourcesHandler).Methods("GET")
+	r.HandleFunc("/api/builds/{buildId}/secrets", secretFindingsHandler).Methods("GET")
+	r.HandleFunc("/api/builds/{buildId}/tools", buildToolsHandler).Methods("GET")
+	r.HandleFunc("/api/builds/{buildId}/environment", buildEnvironmentHandler).Methods("GET")
+	r.HandleFunc("/api/admin/storage", storageHandler).Methods("GET")
+	r.HandleFunc("/api/admin/fanout", fanoutStatusHandler).Methods("GET")
+	r.HandleFunc("/api/admin/capacity", capacityHandler).Methods("GET")
+	r.HandleFunc("/api/admin/doctor", doctorHandler).Methods("GET")
+	r.HandleFunc("/api/version", versionHandler).Methods("GET")
+	r.HandleFunc("/api/admin/update", updateHandler).Methods("POST")
+	r.HandleFunc("/api/admin/maintenance", getMaintenanceHandler).Methods("GET")
+	r.HandleFunc("/api/admin/maintenance", setMaintenanceHandler).Methods("PUT")
+	r.HandleFunc("/readyz", readyzHandler).Methods("GET")
+	r.HandleFunc("/api/admin/cleanup", cleanupHandler).Methods("POST")
+	r.HandleFunc("/api/admin/config", exportConfigHandler).Methods("GET")
+	r.HandleFunc("/api/admin/config", importConfigHandler).Methods("POST")
+	r.HandleFunc("/api/admin/policy", getPolicyHandler).Methods("GET")
+	r.HandleFunc("/api/admin/policy", setPolicyHandler).Methods("PUT")
+	r.HandleFunc("/api/admin/builder", getBuilderHandler).Methods("GET")
+	r.HandleFunc("/api/admin/builder", setUpBuilderHandler).Methods("POST")
+	r.HandleFunc("/api/admin/cost-rates", getCostRatesHandler).Methods("GET")
+	r.HandleFunc("/api/admin/cost-rates", setCostRatesHandler).Methods("PUT")
+	r.HandleFunc("/api/admin/costs", costReportHandler).Methods("GET")
+	r.HandleFunc("/api/parameters", getParametersHandler).Methods("GET")
+	r.HandleFunc("/api/parameters", setParametersHandler).Methods("PUT")
+	r.HandleFunc("/api/build-args", getBuildArgsHandler).Methods("GET")
+	r.HandleFunc("/api/build-args", setBuildArgsHandler).Methods("PUT")
+	r.HandleFunc("/api/registry", getRegistrySettingsHandler).Methods("GET")
+	r.HandleFunc("/api/registry", setRegistrySettingsHandler).Methods("PUT")
+	r.HandleFunc("/api/image-naming", getImageNamingHandler).Methods("GET")
+	r.HandleFunc("/api/image-naming", setImageNamingHandler).Methods("PUT")
+	r.HandleFunc("/api/gpus", getGPUSettingsHandler).Methods("GET")
+	r.HandleFunc("/api/gpus", setGPUSettingsHandler).Methods("PUT")
+	r.HandleFunc("/api/worker-requirements", getWorkerRequirementsHandler).Methods("GET")
+	r.HandleFunc("/api/worker-requirements", setWorkerRequirementsHandler).Methods("PUT")
+	r.HandleFunc("/api/image-size-limit", getImageSizeLimitHandler).Methods("GET")
+	r.HandleFunc("/api/image-size-limit", setImageSizeLimitHandler).Methods("PUT")
+	r.HandleFunc("/api/metrics/rules", getMetricRulesHandler).Methods("GET")
+	r.HandleFunc("/api/metrics/rules", setMetricRulesHandler).Methods("PUT")
+	r.HandleFunc("/api/trigger-filters", getTriggerFiltersHandler).Methods("GET")
+	r.HandleFunc("/api/trigger-filters", setTriggerFiltersHandler).Methods("PUT")
+	r.HandleFunc("/api/triggers/skipped", skippedTriggersHandler).Methods("GET")
+	r.HandleFunc("/api/webhook-settings", getWebhookSettingsHandler).Methods("GET")
+	r.HandleFunc("/api/webhook-settings", setWebhookSettingsHandler).Methods("PUT")
+	r.HandleFunc("/api/webhooks/github", githubWebhookHandler).Methods("POST")
+	r.HandleFunc("/api/webhooks/bitbucket", bitbucketWebhookHandler).Methods("POST")
+	r.HandleFunc("/api/secrets/verify", verifySecretsHandler).Methods("POST")
+	r.HandleFunc("/api/base-images/advisories", setBaseAdvisoryHandler).Methods("PUT")
+	r.HandleFunc("/api/base-images/vulnerable", vulnerableBuildsHandler).Methods("GET")
+	r.HandleFunc("/api/cache/trend", cacheTrendHandler).Methods("GET")
+	r.HandleFunc("/api/default-branch", defaultBranchHandler).Methods("GET")
+	r.HandleFunc("/api/compression", getCompressionHandler).Methods("GET")
+	r.HandleFunc("/api/compression", setCompressionHandler).Methods("PUT")
+	r.HandleFunc("/api/workspace-retention", getWorkspaceRetentionHandler).Methods("GET")
+	r.HandleFunc("/api/workspace-retention", setWorkspaceRetentionHandler).Methods("PUT")
 	r.HandleFunc("/api/last-build", lastBuildHandler).Methods("GET")
 	r.HandleFunc("/api/logs/{buildId}", logsHandler)
+	r.HandleFunc("/api/queue", queueHandler).Methods("GET")
+	r.HandleFunc("/api/queue/scheduled/{buildId}", cancelScheduledHandler).Methods("DELETE")
+	return r
+}
+
+func main() {
+	loadSecretValues()
+	log.SetOutput(redactWriter{os.Stderr})
+	mirrorDir = os.Getenv("MIRROR_DIR")
+	if logDir = os.Getenv("LOG_DIR"); logDir == "" {
+		logDir = "logs"
+	}
+	if workspaceRoot = os.Getenv("WORKSPACE_DIR"); workspaceRoot == "" {
+		workspaceRoot = os.TempDir()
+	}
+	// The doctor reports a broken fan-out configuration or database, so
+	// it runs before either is loaded.
+	if len(os.Args) > 1 && os.Args[1] == "doctor" {
+		doctorCommand()
+		return
+	}
+	if err := loadFanout(); err != nil {
+		log.Fatal(err)
+	}
+	initDB()
+	defer db.Close()
+	registerStoredSecrets()
+	if err := loadMaintenanceState(); err != nil {
+		log.Fatalf("Could not load maintenance state: %v", err)
+	}
+
+	var err error
+	if executor, err = newExecutor(os.Getenv("EXECUTOR")); err != nil {
+		log.Fatal(err)
+	}
+
+	// With no slot a build could ever take, every build would wait forever.
+	concurrency := envInt("BUILD_CONCURRENCY", 2)
+	if concurrency < 1 {
+		log.Fatalf("BUILD_CONCURRENCY must be at least 1, not %d", concurrency)
+	}
+	queue = NewBuildQueue(concurrency, envInt("BUILD_QUEUE_DEPTH", 20))
+	gpus = NewGPUPool(hostGPUs())
+	queueRetryAfter = envInt("BUILD_QUEUE_RETRY_AFTER", 30)
+	idempotencyRetention = envInt("IDEMPOTENCY_RETENTION", 24*60*60)
+	logDoctor(runDoctor())
+
+	go runScheduler()
+	go runWorkspaceSweeper()
+	go runWatchdog(time.Duration(envInt("BUILD_STALL_TIMEOUT", 30)) * time.Minute)
+	// The fake executor needs no Docker daemon to watch.
+	if interval := envInt("DAEMON_PROBE_INTERVAL", 30); interval > 0 && os.Getenv("EXECUTOR") != "fake" {
+		slow := time.Duration(envInt("DAEMON_SLOW_THRESHOLD", 5)) * time.Second
+		go runDaemonThrottle(time.Duration(interval)*time.Second, slow)
+	}
+	if interval := envInt("DEFAULT_BRANCH_REFRESH_INTERVAL", 24); interval > 0 {
+		go runDefaultBranchRefresher(time.Duration(interval) * time.Hour)
+	}
+	if interval := envInt("STORAGE_SNAPSHOT_INTERVAL", 60); interval > 0 {
+		go runStorageSnapshots(time.Duration(interval) * time.Minute)
+	}
+	if interval := envInt("BASE_IMAGE_CHECK_INTERVAL", 0); interval > 0 {
+		go runBaseImageWatcher(time.Duration(interval) * time.Minute)
+	}
+
+	subscribeEventHandlers()
+	r := newRouter()
 
 	http.Handle("/", r)
 	fmt.Println("Running server on 8080 ")
-	log.Fatal(http.ListenAndServe(":8080", CorsMiddleware(r)))
+	log.Fatal(http.ListenAndServe(":8080", CorsMiddleware(ReadOnlyMiddleware(r))))
 }
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// MaintenanceState is the API's read-only switch, flipped by admins for
+// maintenance windows such as database migrations.
+type MaintenanceState struct {
+	ReadOnly bool       `json:"readOnly"`
+	Message  string     `json:"message,omitempty"`
+	Since    *time.Time `json:"since,omitempty"`
+}
+
+var maintenance struct {
+	sync.RWMutex
+	state MaintenanceState
+}
+
+func maintenanceState() MaintenanceState {
+	maintenance.RLock()
+	defer maintenance.RUnlock()
+	return maintenance.state
+}
+
+// loadMaintenanceState restores the state saved before the server last
+// stopped, so a restart during a maintenance window keeps the API
+// read-only.
+func loadMaintenanceState() error {
+	var body string
+	err := db.QueryRow("SELECT state FROM maintenance_state WHERE id = 1").Scan(&body)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	maintenance.Lock()
+	defer maintenance.Unlock()
+	return json.Unmarshal([]byte(body), &maintenance.state)
+}
+
+func saveMaintenanceState(state MaintenanceState) error {
+	body, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("INSERT OR REPLACE INTO maintenance_state (id, state) VALUES (1, ?)", string(body))
+	return err
+}
+
+// buildsPaused reports whether nothing should start new builds, because
+// the API is read-only or the server is restarting for an update.
+func buildsPaused() bool {
+	return draining.Load() || maintenanceState().ReadOnly
+}
+
+// ReadOnlyMiddleware rejects every request that could change state while
+// the API is read-only, except the one that switches it back.
+func ReadOnlyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+		default:
+			if state := maintenanceState(); state.ReadOnly && r.URL.Path != "/api/admin/maintenance" {
+				message := "API is read-only for maintenance"
+				if state.Message != "" {
+					message += ": " + state.Message
+				}
+				w.Header().Set("Access-Control-Allow-Origin", "*")
+				w.Header().Set("Retry-After", strconv.Itoa(queueRetryAfter))
+				http.Error(w, message, http.StatusServiceUnavailable)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func getMaintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	json.NewEncoder(w).Encode(maintenanceState())
+}
+
+// setMaintenanceHandler switches read-only mode on or off, which needs
+// the admin token.
+func setMaintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if !authorizeAdmin(w, r) {
+		return
+	}
+	var req MaintenanceState
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Request must contain readOnly", http.StatusBadRequest)
+		return
+	}
+	maintenance.Lock()
+	defer maintenance.Unlock()
+	state := MaintenanceState{}
+	if req.ReadOnly {
+		state = maintenance.state
+		if !state.ReadOnly {
+			now := time.Now().UTC()
+			state.Since = &now
+		}
+		state.ReadOnly = true
+		state.Message = req.Message
+	}
+	if err := saveMaintenanceState(state); err != nil {
+		log.Printf("Error saving maintenance state: %v", err)
+		http.Error(w, "Could not save maintenance state", http.StatusInternalServerError)
+		return
+	}
+	maintenance.state = state
+	json.NewEncoder(w).Encode(state)
+}
+
+type Readiness struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+	MaintenanceState
+	// Draining is set while the server waits to restart for an update.
+	Draining bool `json:"draining,omitempty"`
+}
+
+// readyzHandler reports whether the server can serve requests. A
+// read-only server is still ready, since reads are served.
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	readiness := Readiness{Status: "ready", MaintenanceState: maintenanceState(), Draining: draining.Load()}
+	if err := db.Ping(); err != nil {
+		readiness.Status = "unavailable"
+		readiness.Error = err.Error()
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(readiness)
+}
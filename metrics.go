@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// MetricRule extracts a named value from a repository's build logs, either
+// the first capture group of Regex or the value at the dotted JSON path
+// in log lines that are JSON objects. The last match in the log wins.
+type MetricRule struct {
+	Name  string `json:"name"`
+	Regex string `json:"regex,omitempty"`
+	JSON  string `json:"json,omitempty"`
+}
+
+type MetricRules struct {
+	RepoUrl string       `json:"repoUrl"`
+	Rules   []MetricRule `json:"rules"`
+}
+
+// BuildMetric is a value extracted from a build's log. Number is set when
+// the value parses as one.
+type BuildMetric struct {
+	Name   string   `json:"name"`
+	Value  string   `json:"value"`
+	Number *float64 `json:"number,omitempty"`
+}
+
+func validateMetricRules(rules []MetricRule) error {
+	seen := make(map[string]bool)
+	for _, rule := range rules {
+		if rule.Name == "" {
+			return fmt.Errorf("metric name is required")
+		}
+		if seen[rule.Name] {
+			return fmt.Errorf("metric %s is declared twice", rule.Name)
+		}
+		seen[rule.Name] = true
+		if (rule.Regex == "") == (rule.JSON == "") {
+			return fmt.Errorf("metric %s needs exactly one of regex or json", rule.Name)
+		}
+		if rule.Regex != "" {
+			re, err := regexp.Compile(rule.Regex)
+			if err != nil {
+				return fmt.Errorf("metric %s: %v", rule.Name, err)
+			}
+			if re.NumSubexp() < 1 {
+				return fmt.Errorf("metric %s regex needs a capture group", rule.Name)
+			}
+		}
+	}
+	return nil
+}
+
+func getMetricRules(repoURL string) ([]MetricRule, error) {
+	var body string
+	err := db.QueryRow("SELECT rules FROM build_metric_rules WHERE repo_url = ?", repoURL).Scan(&body)
+	if err != nil {
+		return nil, err
+	}
+	var rules []MetricRule
+	err = json.Unmarshal([]byte(body), &rules)
+	return rules, err
+}
+
+func saveMetricRules(repoURL string, rules []MetricRule) error {
+	body, err := json.Marshal(rules)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("INSERT OR REPLACE INTO build_metric_rules (repo_url, rules) VALUES (?, ?)", repoURL, string(body))
+	return err
+}
+
+// buildxOutput matches the step number and elapsed seconds buildx plain
+// progress output puts before a RUN step's output, e.g. "#9 1.042 ".
+var buildxOutput = regexp.MustCompile(`^#\d+ \d+\.\d+ `)
+
+// jsonPath looks up a dotted path such as "summary.tests" in v.
+func jsonPath(v interface{}, path string) (interface{}, bool) {
+	for _, key := range strings.Split(path, ".") {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if v, ok = m[key]; !ok {
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// extractMetrics applies rules to each line of a build log.
+func extractMetrics(buildId string, rules []MetricRule) ([]BuildMetric, error) {
+	f, err := os.Open(logPath(buildId))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	patterns := make([]*regexp.Regexp, len(rules))
+	for i, rule := range rules {
+		if rule.Regex != "" {
+			patterns[i] = regexp.MustCompile(rule.Regex)
+		}
+	}
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		// Drop the timestamp logLine prefixes each line with.
+		_, line, _ := strings.Cut(scanner.Text(), " ")
+		output := buildxOutput.ReplaceAllString(line, "")
+		var doc interface{}
+		isJSON := strings.HasPrefix(output, "{") && json.Unmarshal([]byte(output), &doc) == nil
+		for i, rule := range rules {
+			if patterns[i] != nil {
+				if m := patterns[i].FindStringSubmatch(line); m != nil {
+					values[rule.Name] = m[1]
+				}
+			} else if isJSON {
+				if v, ok := jsonPath(doc, rule.JSON); ok {
+					if s, ok := v.(string); ok {
+						values[rule.Name] = s
+					} else if b, err := json.Marshal(v); err == nil {
+						values[rule.Name] = string(b)
+					}
+				}
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	metrics := []BuildMetric{}
+	for _, rule := range rules {
+		value, ok := values[rule.Name]
+		if !ok {
+			continue
+		}
+		metric := BuildMetric{Name: rule.Name, Value: value}
+		if n, err := strconv.ParseFloat(value, 64); err == nil {
+			metric.Number = &n
+		}
+		metrics = append(metrics, metric)
+	}
+	return metrics, nil
+}
+
+func saveMetrics(buildId string, metrics []BuildMetric) error {
+	for _, m := range metrics {
+		if _, err := db.Exec("INSERT INTO build_metrics (build_id, name, value, number) VALUES (?, ?, ?, ?)", buildId, m.Name, m.Value, m.Number); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func getMetrics(buildId string) ([]BuildMetric, error) {
+	rows, err := db.Query("SELECT name, value, number FROM build_metrics WHERE build_id = ? ORDER BY name", buildId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	metrics := []BuildMetric{}
+	for rows.Next() {
+		var m BuildMetric
+		var number sql.NullFloat64
+		if err := rows.Scan(&m.Name, &m.Value, &number); err != nil {
+			return nil, err
+		}
+		if number.Valid {
+			m.Number = &number.Float64
+		}
+		metrics = append(metrics, m)
+	}
+	return metrics, rows.Err()
+}
+
+// recordMetrics extracts a finished build's metrics from its log using
+// its repository's rules.
+func recordMetrics(e Event) {
+	if e.Type != EventBuildSucceeded && e.Type != EventBuildFailed {
+		return
+	}
+	go func() {
+		rules, err := getMetricRules(e.RepoUrl)
+		if err != nil {
+			if err != sql.ErrNoRows {
+				log.Printf("Error getting metric rules: %v", err)
+			}
+			return
+		}
+		metrics, err := extractMetrics(e.BuildId, rules)
+		if err == nil {
+			err = saveMetrics(e.BuildId, metrics)
+		}
+		if err != nil {
+			log.Printf("Error extracting metrics for %s: %v", e.BuildId, err)
+		}
+	}()
+}
+
+func setMetricRulesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	var rules MetricRules
+	if err := json.NewDecoder(r.Body).Decode(&rules); err != nil || rules.RepoUrl == "" {
+		http.Error(w, "Request must contain repoUrl and rules", http.StatusBadRequest)
+		return
+	}
+	if err := validateRepoURL(rules.RepoUrl); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validateMetricRules(rules.Rules); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := saveMetricRules(rules.RepoUrl, rules.Rules); err != nil {
+		http.Error(w, "Could not save rules", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(rules)
+}
+
+func getMetricRulesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	repoURL := r.URL.Query().Get("repo")
+	if err := validateRepoURL(repoURL); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rules, err := getMetricRules(repoURL)
+	if err == sql.ErrNoRows {
+		http.Error(w, "No metric rules for repository", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Could not get metric rules", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(MetricRules{RepoUrl: repoURL, Rules: rules})
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	metrics, err := getMetrics(mux.Vars(r)["buildId"])
+	if err != nil {
+		http.Error(w, "Could not get build metrics", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(metrics)
+}
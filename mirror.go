@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+)
+
+// mirrorDir holds a persistent bare mirror per repository so repeat builds
+// only fetch new objects. Mirroring is disabled when it is empty.
+var mirrorDir string
+
+var (
+	mirrorLocksMu sync.Mutex
+	mirrorLocks   = make(map[string]*sync.Mutex)
+)
+
+func mirrorLock(repoURL string) *sync.Mutex {
+	mirrorLocksMu.Lock()
+	defer mirrorLocksMu.Unlock()
+	l, ok := mirrorLocks[repoURL]
+	if !ok {
+		l = &sync.Mutex{}
+		mirrorLocks[repoURL] = l
+	}
+	return l
+}
+
+func mirrorPath(repoURL string) string {
+	sum := sha256.Sum256([]byte(repoURL))
+	return filepath.Join(mirrorDir, hex.EncodeToString(sum[:]))
+}
+
+func runGit(buildId string, args ...string) error {
+	return runCommand(buildId, exec.Command("git", args...))
+}
+
+// updateMirror fetches repoURL into its mirror, recreating the mirror from
+// scratch if it is missing or the fetch fails.
+func updateMirror(buildId, repoURL string) (string, error) {
+	dir := mirrorPath(repoURL)
+	if _, err := os.Stat(dir); err == nil {
+		err := runGit(buildId, "-C", dir, "fetch", "--prune", "origin", "+refs/*:refs/*")
+		if err == nil {
+			return dir, nil
+		}
+		log.Printf("Error fetching mirror of %s, recloning: %v", repoURL, err)
+		if err := os.RemoveAll(dir); err != nil {
+			return "", err
+		}
+	}
+	if err := os.MkdirAll(mirrorDir, 0755); err != nil {
+		return "", err
+	}
+	if err := runGit(buildId, "clone", "--mirror", "--", repoURL, dir); err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	return dir, nil
+}
+
+// cloneRepo checks ref, a branch or tag, of repoURL out into repoDir,
+// going through the repository's mirror when mirroring is enabled. An
+// empty ref checks out the remote HEAD. If commit is set, that commit is
+// checked out instead of the ref's head.
+func cloneRepo(buildId, repoURL, ref, commit, repoDir string) error {
+	args := []string{"clone"}
+	if ref != "" {
+		args = append(args, "--branch", ref)
+	}
+	args = append(args, "--")
+	if mirrorDir == "" {
+		if err := runGit(buildId, append(args, repoURL, repoDir)...); err != nil {
+			return err
+		}
+		return checkoutCommit(buildId, repoDir, commit)
+	}
+
+	lock := mirrorLock(repoURL)
+	lock.Lock()
+	defer lock.Unlock()
+
+	mirror, err := updateMirror(buildId, repoURL)
+	if err != nil {
+		return err
+	}
+	if err := runGit(buildId, append(args, mirror, repoDir)...); err != nil {
+		return err
+	}
+	// Check out while origin is still the mirror, which also has refs
+	// such as pull request heads that a clone leaves out.
+	if err := checkoutCommit(buildId, repoDir, commit); err != nil {
+		return err
+	}
+	return runGit(buildId, "-C", repoDir, "remote", "set-url", "--", "origin", repoURL)
+}
+
+// checkoutCommit detaches repoDir at commit, fetching it from origin if
+// the clone does not have it. An empty commit leaves the clone as is.
+func checkoutCommit(buildId, repoDir, commit string) error {
+	if commit == "" {
+		return nil
+	}
+	if runGit(buildId, "-C", repoDir, "checkout", "--detach", commit) == nil {
+		return nil
+	}
+	if err := runGit(buildId, "-C", repoDir, "fetch", "origin", commit); err != nil {
+		return fmt.Errorf("commit %s not found: %v", commit, err)
+	}
+	return runGit(buildId, "-C", repoDir, "checkout", "--detach", "FETCH_HEAD")
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// overrideAllowed reports whether key may be overridden per build. The
+// BUILD_OVERRIDE_ALLOWLIST setting is a comma-separated list of names,
+// where a trailing "*" matches any suffix.
+func overrideAllowed(key string) bool {
+	for _, pattern := range strings.Split(os.Getenv("BUILD_OVERRIDE_ALLOWLIST"), ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+			if strings.HasPrefix(key, prefix) {
+				return true
+			}
+		} else if key == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+func validateOverrides(overrides map[string]string) error {
+	for key := range overrides {
+		if !overrideAllowed(key) {
+			return fmt.Errorf("override of %s is not allowed", key)
+		}
+	}
+	return nil
+}
+
+// buildArgFlags turns args into --build-arg flags in a stable order.
+func buildArgFlags(args map[string]string) []string {
+	keys := make([]string, 0, len(args))
+	for key := range args {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var flags []string
+	for _, key := range keys {
+		flags = append(flags, "--build-arg", key+"="+args[key])
+	}
+	return flags
+}
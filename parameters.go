@@ -0,0 +1,197 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// Parameter types.
+const (
+	ParamString  = "string"
+	ParamChoice  = "choice"
+	ParamBoolean = "boolean"
+)
+
+// Parameter declares a typed value a repository's builds accept. Supplied
+// values are passed to buildx as build args.
+type Parameter struct {
+	Name     string   `json:"name"`
+	Type     string   `json:"type"`
+	Choices  []string `json:"choices,omitempty"`
+	Default  string   `json:"default,omitempty"`
+	Required bool     `json:"required,omitempty"`
+}
+
+type ParameterSchema struct {
+	RepoUrl    string      `json:"repoUrl"`
+	Parameters []Parameter `json:"parameters"`
+}
+
+func getParameters(repoURL string) ([]Parameter, error) {
+	var body string
+	err := db.QueryRow("SELECT parameters FROM build_parameters WHERE repo_url = ?", repoURL).Scan(&body)
+	if err != nil {
+		return nil, err
+	}
+	var params []Parameter
+	err = json.Unmarshal([]byte(body), &params)
+	return params, err
+}
+
+func saveParameters(repoURL string, params []Parameter) error {
+	body, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("INSERT OR REPLACE INTO build_parameters (repo_url, parameters) VALUES (?, ?)", repoURL, string(body))
+	return err
+}
+
+func validateSchema(params []Parameter) error {
+	seen := make(map[string]bool)
+	for _, p := range params {
+		if p.Name == "" {
+			return fmt.Errorf("parameter name is required")
+		}
+		if seen[p.Name] {
+			return fmt.Errorf("parameter %s is declared twice", p.Name)
+		}
+		seen[p.Name] = true
+		switch p.Type {
+		case ParamString, ParamBoolean:
+		case ParamChoice:
+			if len(p.Choices) == 0 {
+				return fmt.Errorf("choice parameter %s has no choices", p.Name)
+			}
+		default:
+			return fmt.Errorf("parameter %s has unknown type %q", p.Name, p.Type)
+		}
+		if p.Default != "" {
+			if _, err := checkParameter(p, p.Default); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkParameter validates value against p and returns it as a build arg.
+func checkParameter(p Parameter, value interface{}) (string, error) {
+	switch p.Type {
+	case ParamBoolean:
+		switch v := value.(type) {
+		case bool:
+			return strconv.FormatBool(v), nil
+		case string:
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return "", fmt.Errorf("parameter %s must be a boolean", p.Name)
+			}
+			return strconv.FormatBool(b), nil
+		}
+		return "", fmt.Errorf("parameter %s must be a boolean", p.Name)
+	case ParamChoice:
+		v, ok := value.(string)
+		if ok {
+			for _, c := range p.Choices {
+				if v == c {
+					return v, nil
+				}
+			}
+		}
+		return "", fmt.Errorf("parameter %s must be one of %v", p.Name, p.Choices)
+	default:
+		v, ok := value.(string)
+		if !ok {
+			return "", fmt.Errorf("parameter %s must be a string", p.Name)
+		}
+		return v, nil
+	}
+}
+
+// resolveParameters validates supplied values against the repository's
+// schema, filling in defaults, and returns them as build args.
+func resolveParameters(repoURL string, supplied map[string]interface{}) (map[string]string, error) {
+	params, err := getParameters(repoURL)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	if err == sql.ErrNoRows && len(supplied) == 0 {
+		// No schema and nothing supplied: the build takes no parameters.
+		return nil, nil
+	}
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%s declares no parameters", repoURL)
+	}
+
+	args := make(map[string]string)
+	declared := make(map[string]bool)
+	for _, p := range params {
+		declared[p.Name] = true
+		value, ok := supplied[p.Name]
+		if !ok {
+			if p.Required && p.Default == "" {
+				return nil, fmt.Errorf("parameter %s is required", p.Name)
+			}
+			if p.Default != "" {
+				args[p.Name] = p.Default
+			}
+			continue
+		}
+		arg, err := checkParameter(p, value)
+		if err != nil {
+			return nil, err
+		}
+		args[p.Name] = arg
+	}
+	for name := range supplied {
+		if !declared[name] {
+			return nil, fmt.Errorf("unknown parameter %s", name)
+		}
+	}
+	return args, nil
+}
+
+func setParametersHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	var schema ParameterSchema
+	if err := json.NewDecoder(r.Body).Decode(&schema); err != nil || schema.RepoUrl == "" {
+		http.Error(w, "Request must contain repoUrl and parameters", http.StatusBadRequest)
+		return
+	}
+	if err := validateRepoURL(schema.RepoUrl); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validateSchema(schema.Parameters); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := saveParameters(schema.RepoUrl, schema.Parameters); err != nil {
+		http.Error(w, "Could not save parameters", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(schema)
+}
+
+func getParametersHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	repoURL := r.URL.Query().Get("repo")
+	if err := validateRepoURL(repoURL); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	params, err := getParameters(repoURL)
+	if err == sql.ErrNoRows {
+		http.Error(w, "No parameters declared for repository", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Could not get parameters", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(ParameterSchema{RepoUrl: repoURL, Parameters: params})
+}
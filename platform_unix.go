@@ -0,0 +1,58 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"runtime"
+	"syscall"
+)
+
+// setProcessGroup starts cmd in a process group of its own, so the
+// commands it spawns can be killed along with it.
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// Negative PIDs signal the whole process group.
+func killProcessGroup(p *os.Process) {
+	syscall.Kill(-p.Pid, syscall.SIGKILL)
+}
+
+// processUsage returns the peak resident memory and block I/O of a
+// finished command.
+func processUsage(state *os.ProcessState) (peakMemory, readBytes, writeBytes int64) {
+	ru, ok := state.SysUsage().(*syscall.Rusage)
+	if !ok {
+		return 0, 0, 0
+	}
+	// maxrss is in bytes on macOS and KiB elsewhere; block I/O is counted
+	// in 512-byte units.
+	peakMemory = int64(ru.Maxrss)
+	if runtime.GOOS != "darwin" {
+		peakMemory *= 1024
+	}
+	return peakMemory, int64(ru.Inblock) * 512, int64(ru.Oublock) * 512
+}
+
+// replaceExecutable moves newPath over exe; the running process keeps its
+// open copy of the old binary.
+func replaceExecutable(exe, newPath string) error {
+	return os.Rename(newPath, exe)
+}
+
+// restartSelf replaces the running process with exe, keeping its PID,
+// arguments and environment.
+func restartSelf(exe string) error {
+	return syscall.Exec(exe, os.Args, os.Environ())
+}
+
+// diskSpace returns the size and free space of the filesystem holding dir.
+func diskSpace(dir string) (total, free int64) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, 0
+	}
+	return int64(st.Blocks) * int64(st.Bsize), int64(st.Bavail) * int64(st.Bsize)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+// setProcessGroup starts cmd in a process group of its own, so the
+// commands it spawns can be killed along with it.
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP}
+}
+
+// killProcessGroup kills p and every process it started.
+func killProcessGroup(p *os.Process) {
+	exec.Command("taskkill", "/T", "/F", "/PID", strconv.Itoa(p.Pid)).Run()
+}
+
+// processUsage returns the peak resident memory and block I/O of a
+// finished command, which Windows does not report once it has exited.
+func processUsage(state *os.ProcessState) (peakMemory, readBytes, writeBytes int64) {
+	return 0, 0, 0
+}
+
+// replaceExecutable moves newPath over exe. A running executable can't be
+// overwritten, but it can be renamed out of the way.
+func replaceExecutable(exe, newPath string) error {
+	old := exe + ".old"
+	os.Remove(old)
+	if err := os.Rename(exe, old); err != nil {
+		return err
+	}
+	return os.Rename(newPath, exe)
+}
+
+// restartSelf exits so the service manager starts the new binary; Windows
+// can't replace a running process in place.
+func restartSelf(exe string) error {
+	os.Exit(0)
+	return nil
+}
+
+var getDiskFreeSpaceEx = syscall.NewLazyDLL("kernel32.dll").NewProc("GetDiskFreeSpaceExW")
+
+// diskSpace returns the size and free space of the volume holding dir.
+func diskSpace(dir string) (total, free int64) {
+	path, err := syscall.UTF16PtrFromString(dir)
+	if err != nil {
+		return 0, 0
+	}
+	var available, size, totalFree uint64
+	r, _, _ := getDiskFreeSpaceEx.Call(uintptr(unsafe.Pointer(path)), uintptr(unsafe.Pointer(&available)), uintptr(unsafe.Pointer(&size)), uintptr(unsafe.Pointer(&totalFree)))
+	if r == 0 {
+		return 0, 0
+	}
+	return int64(size), int64(available)
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// binfmtImage returns BINFMT_IMAGE, the image that registers QEMU
+// emulators with the host kernel so buildx can build for other
+// architectures, such as tonistiigi/binfmt@sha256:<digest>. It runs
+// privileged, so it must be pinned to a digest; there is no default.
+func binfmtImage() (string, error) {
+	image := os.Getenv("BINFMT_IMAGE")
+	if image == "" {
+		return "", fmt.Errorf("set BINFMT_IMAGE to install emulators, pinned to a digest such as tonistiigi/binfmt@sha256:<digest>")
+	}
+	if !strings.Contains(image, "@sha256:") {
+		return "", fmt.Errorf("BINFMT_IMAGE %q must be pinned to a digest", image)
+	}
+	return image, nil
+}
+
+// binfmtDir lists the emulators the kernel has registered.
+const binfmtDir = "/proc/sys/fs/binfmt_misc"
+
+var (
+	platformPattern = regexp.MustCompile(`^[a-z0-9]+/[a-z0-9_]+(/[a-z0-9]+)?$`)
+	emulatorPattern = regexp.MustCompile(`^[a-z0-9_]+$`)
+)
+
+// BuilderStatus tells which platforms the server can build for.
+type BuilderStatus struct {
+	Builder BuilderInfo `json:"builder"`
+	// Emulators are the architectures QEMU emulates on the host.
+	Emulators []string `json:"emulators"`
+	// ContainerdImageStore is whether the daemon keeps images in
+	// containerd, which loading multi-platform images needs.
+	ContainerdImageStore bool   `json:"containerdImageStore"`
+	Error                string `json:"error,omitempty"`
+}
+
+// BuilderSetup asks for emulators to be installed and, with
+// CreateBuilder, for the builder named by BUILDX_BUILDER to be created.
+type BuilderSetup struct {
+	// Emulators are architectures such as "arm64", or "all".
+	Emulators     []string `json:"emulators,omitempty"`
+	CreateBuilder bool     `json:"createBuilder,omitempty"`
+}
+
+func validatePlatforms(platforms []string) error {
+	for _, p := range platforms {
+		if !platformPattern.MatchString(p) {
+			return fmt.Errorf("invalid platform %q: must look like linux/arm64", p)
+		}
+	}
+	return nil
+}
+
+// platformFlags are the buildx flags that build for platforms, none for
+// the builder's native platform.
+func platformFlags(platforms []string) []string {
+	if len(platforms) == 0 {
+		return nil
+	}
+	return []string{"--platform", strings.Join(platforms, ",")}
+}
+
+// installedEmulators lists the architectures registered with binfmt_misc.
+func installedEmulators() []string {
+	emulators := []string{}
+	entries, err := os.ReadDir(binfmtDir)
+	if err != nil {
+		return emulators
+	}
+	for _, e := range entries {
+		if arch, ok := strings.CutPrefix(e.Name(), "qemu-"); ok {
+			emulators = append(emulators, arch)
+		}
+	}
+	sort.Strings(emulators)
+	return emulators
+}
+
+func containerdImageStore() bool {
+	out, err := exec.Command("docker", "info", "--format", "{{json .DriverStatus}}").Output()
+	return err == nil && strings.Contains(string(out), "io.containerd.snapshotter")
+}
+
+func builderStatus() BuilderStatus {
+	return BuilderStatus{Builder: currentBuilder(), Emulators: installedEmulators(), ContainerdImageStore: containerdImageStore()}
+}
+
+// checkPlatforms makes sure the builder can build platforms and the
+// daemon can load the result, before any time is spent building.
+func checkPlatforms(platforms []string) error {
+	if len(platforms) == 0 {
+		return nil
+	}
+	b := currentBuilder()
+	supported := make(map[string]bool)
+	for _, p := range strings.Split(b.Platforms, ",") {
+		supported[strings.TrimSuffix(strings.TrimSpace(p), "*")] = true
+	}
+	for _, p := range platforms {
+		if !supported[p] {
+			return fmt.Errorf("builder %s does not support %s; install its emulator with POST /api/admin/builder", b.Name, p)
+		}
+	}
+	if len(platforms) > 1 && !containerdImageStore() {
+		return fmt.Errorf("loading a multi-platform image needs the Docker daemon's containerd image store")
+	}
+	return nil
+}
+
+// setUpBuilder installs emulators and creates the server's builder.
+func setUpBuilder(setup BuilderSetup) error {
+	if len(setup.Emulators) > 0 {
+		image, err := binfmtImage()
+		if err != nil {
+			return err
+		}
+		out, err := exec.Command("docker", "run", "--privileged", "--rm", image, "--install", strings.Join(setup.Emulators, ",")).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("installing emulators: %v: %s", err, strings.TrimSpace(string(out)))
+		}
+	}
+	if setup.CreateBuilder {
+		name := os.Getenv("BUILDX_BUILDER")
+		if exec.Command("docker", "buildx", "inspect", name).Run() == nil {
+			return nil
+		}
+		out, err := exec.Command("docker", "buildx", "create", "--name", name, "--driver", "docker-container", "--bootstrap").CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("creating builder %s: %v: %s", name, err, strings.TrimSpace(string(out)))
+		}
+	}
+	return nil
+}
+
+func getBuilderHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	json.NewEncoder(w).Encode(builderStatus())
+}
+
+// setUpBuilderHandler prepares the host for multi-platform builds and
+// reports the result. The builder is created under BUILDX_BUILDER, which
+// builds use. It runs a privileged container, so it needs the admin
+// token.
+func setUpBuilderHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if !authorizeAdmin(w, r) {
+		return
+	}
+	var setup BuilderSetup
+	if err := json.NewDecoder(r.Body).Decode(&setup); err != nil {
+		http.Error(w, "Invalid builder setup", http.StatusBadRequest)
+		return
+	}
+	for _, e := range setup.Emulators {
+		if !emulatorPattern.MatchString(e) {
+			http.Error(w, fmt.Sprintf("invalid emulator %q", e), http.StatusBadRequest)
+			return
+		}
+	}
+	if len(setup.Emulators) > 0 {
+		if _, err := binfmtImage(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if setup.CreateBuilder && os.Getenv("BUILDX_BUILDER") == "" {
+		http.Error(w, "Set BUILDX_BUILDER to the builder's name so builds use it", http.StatusBadRequest)
+		return
+	}
+	err := setUpBuilder(setup)
+	status := builderStatus()
+	if err != nil {
+		log.Printf("Error setting up builder: %v", err)
+		status.Error = err.Error()
+	}
+	json.NewEncoder(w).Encode(status)
+}
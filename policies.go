@@ -0,0 +1,271 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os/exec"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Policy holds the defaults and rules an administrator sets for every
+// repository. Per-repository settings and build requests cannot relax
+// them.
+type Policy struct {
+	// Labels are put on every image, over any of the same name the
+	// Dockerfile sets.
+	Labels map[string]string `json:"labels,omitempty"`
+	// RequireScans runs the secret and license scans on every build,
+	// including dependency bot builds, and fails builds when a scanner is
+	// not set up.
+	RequireScans bool `json:"requireScans"`
+	// ForbiddenBaseImages are path.Match patterns such as "*:latest" or
+	// "centos". They are matched against each image a Dockerfile builds
+	// FROM as written, without its digest, and without its tag.
+	ForbiddenBaseImages []string `json:"forbiddenBaseImages,omitempty"`
+	// MaxImageSize is the largest image in bytes, or 0 for no limit.
+	// Repositories can set a lower limit of their own.
+	MaxImageSize int64 `json:"maxImageSize,omitempty"`
+	// ImageSizeAction is what exceeding MaxImageSize does: "fail", the
+	// default, or "warn".
+	ImageSizeAction string `json:"imageSizeAction,omitempty"`
+	// RequiredLabels must be set on every image, by the Dockerfile or by
+	// Labels.
+	RequiredLabels []string `json:"requiredLabels,omitempty"`
+}
+
+// PolicyViolation is one way a build broke the policy.
+type PolicyViolation struct {
+	Rule   string `json:"rule"`
+	Image  string `json:"image,omitempty"`
+	Detail string `json:"detail"`
+}
+
+// Policy rules, as reported in violations.
+const (
+	RuleRequireScans       = "requireScans"
+	RuleForbiddenBaseImage = "forbiddenBaseImages"
+	RuleMaxImageSize       = "maxImageSize"
+	RuleRequiredLabels     = "requiredLabels"
+)
+
+// PolicyError fails a build that violated the policy.
+type PolicyError struct {
+	Violations []PolicyViolation
+}
+
+func (e *PolicyError) Error() string {
+	details := make([]string, len(e.Violations))
+	for i, v := range e.Violations {
+		details[i] = v.Detail
+	}
+	return "policy violated: " + strings.Join(details, "; ")
+}
+
+func validatePolicy(p Policy) error {
+	for _, pattern := range p.ForbiddenBaseImages {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid base image pattern %q", pattern)
+		}
+	}
+	for name := range p.Labels {
+		if name == "" {
+			return fmt.Errorf("label names must not be empty")
+		}
+	}
+	for _, name := range p.RequiredLabels {
+		if name == "" {
+			return fmt.Errorf("required label names must not be empty")
+		}
+	}
+	if p.MaxImageSize < 0 {
+		return fmt.Errorf("maxImageSize must not be negative")
+	}
+	return validateSizeAction(p.ImageSizeAction)
+}
+
+// getPolicy returns the policy, which is empty until one is saved.
+func getPolicy() (Policy, error) {
+	var p Policy
+	var body string
+	err := db.QueryRow("SELECT policy FROM org_policy WHERE id = 1").Scan(&body)
+	if err == sql.ErrNoRows {
+		return p, nil
+	}
+	if err != nil {
+		return p, err
+	}
+	err = json.Unmarshal([]byte(body), &p)
+	return p, err
+}
+
+func savePolicy(p Policy) error {
+	body, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("INSERT OR REPLACE INTO org_policy (id, policy) VALUES (1, ?)", string(body))
+	return err
+}
+
+func savePolicyViolations(buildId string, violations []PolicyViolation) error {
+	body, err := json.Marshal(violations)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("INSERT OR REPLACE INTO build_policy_violations (build_id, violations) VALUES (?, ?)", buildId, string(body))
+	return err
+}
+
+func getPolicyViolations(buildId string) ([]PolicyViolation, error) {
+	var body string
+	if err := db.QueryRow("SELECT violations FROM build_policy_violations WHERE build_id = ?", buildId).Scan(&body); err != nil {
+		return nil, err
+	}
+	var violations []PolicyViolation
+	err := json.Unmarshal([]byte(body), &violations)
+	return violations, err
+}
+
+// policyLabels adds the policy's labels to labels, leaving the server's
+// own labels as they are.
+func policyLabels(p Policy, labels map[string]string) {
+	for name, value := range p.Labels {
+		if _, ok := labels[name]; !ok {
+			labels[name] = value
+		}
+	}
+}
+
+// checkScanPolicy reports the scans the policy requires that cannot run.
+func checkScanPolicy(p Policy) []PolicyViolation {
+	if !p.RequireScans {
+		return nil
+	}
+	var violations []PolicyViolation
+	if !secretScanEnabled() {
+		violations = append(violations, PolicyViolation{Rule: RuleRequireScans, Detail: "secret scan is required but SECRET_SCAN is not set or gitleaks is not installed"})
+	}
+	if !licenseScanEnabled() {
+		violations = append(violations, PolicyViolation{Rule: RuleRequireScans, Detail: "license scan is required but LICENSE_SCAN is not set or syft is not installed"})
+	}
+	return violations
+}
+
+// forbiddenBaseImage returns the pattern image matches, if any.
+func forbiddenBaseImage(p Policy, image string) (string, bool) {
+	name, _, _ := strings.Cut(image, "@")
+	candidates := []string{image, name}
+	// A colon after the last slash starts the tag rather than a port.
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		candidates = append(candidates, name[:i])
+	}
+	for _, pattern := range p.ForbiddenBaseImages {
+		for _, c := range candidates {
+			if ok, _ := path.Match(pattern, c); ok {
+				return pattern, true
+			}
+		}
+	}
+	return "", false
+}
+
+// imageLabelNames returns the names of the labels set on a local image.
+func imageLabelNames(image string) (map[string]bool, error) {
+	out, err := exec.Command("docker", "image", "inspect", "--format", "{{json .Config.Labels}}", image).Output()
+	if err != nil {
+		return nil, err
+	}
+	var labels map[string]string
+	if err := json.Unmarshal(out, &labels); err != nil {
+		return nil, fmt.Errorf("reading labels of %s: %v", image, err)
+	}
+	names := make(map[string]bool)
+	for name := range labels {
+		names[name] = true
+	}
+	return names, nil
+}
+
+// checkImagePolicy checks built images against the policy's rules on
+// base images and labels. Sizes are checked by checkImageSizes.
+func checkImagePolicy(p Policy, images []BuiltImage) ([]PolicyViolation, error) {
+	var violations []PolicyViolation
+	for _, image := range images {
+		for _, from := range image.FromImages {
+			if strings.Contains(from, "$") && len(p.ForbiddenBaseImages) > 0 {
+				violations = append(violations, PolicyViolation{Rule: RuleForbiddenBaseImage, Image: image.Image,
+					Detail: fmt.Sprintf("base image %s could not be resolved from the build args, so it can't be checked", from)})
+				continue
+			}
+			if pattern, ok := forbiddenBaseImage(p, from); ok {
+				violations = append(violations, PolicyViolation{Rule: RuleForbiddenBaseImage, Image: image.Image,
+					Detail: fmt.Sprintf("base image %s matches forbidden %q", from, pattern)})
+			}
+		}
+		if len(p.RequiredLabels) > 0 {
+			names, err := imageLabelNames(image.Image)
+			if err != nil {
+				return nil, err
+			}
+			var missing []string
+			for _, name := range p.RequiredLabels {
+				if !names[name] {
+					missing = append(missing, name)
+				}
+			}
+			sort.Strings(missing)
+			if len(missing) > 0 {
+				violations = append(violations, PolicyViolation{Rule: RuleRequiredLabels, Image: image.Image,
+					Detail: fmt.Sprintf("%s lacks required labels %s", image.Image, strings.Join(missing, ", "))})
+			}
+		}
+	}
+	return violations, nil
+}
+
+// policyFailure records violations against a build and returns the
+// error that fails it.
+func policyFailure(buildId string, violations []PolicyViolation) error {
+	if err := savePolicyViolations(buildId, violations); err != nil {
+		log.Printf("Error saving policy violations: %v", err)
+	}
+	return &PolicyError{Violations: violations}
+}
+
+func getPolicyHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	p, err := getPolicy()
+	if err != nil {
+		http.Error(w, "Could not get policy", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(p)
+}
+
+// setPolicyHandler replaces the policy every build is held to, which
+// needs the admin token.
+func setPolicyHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if !authorizeAdmin(w, r) {
+		return
+	}
+	var p Policy
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		http.Error(w, "Invalid policy", http.StatusBadRequest)
+		return
+	}
+	if err := validatePolicy(p); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := savePolicy(p); err != nil {
+		http.Error(w, "Could not save policy", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(p)
+}
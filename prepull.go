@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// prePullConcurrency bounds the base images pulled at once.
+const prePullConcurrency = 3
+
+// prePullEnabled reports whether builds should pull their base images
+// while cloning, set by PREPULL_BASE_IMAGES. Pulls land in the daemon's
+// image store, so only builders using the docker driver benefit.
+func prePullEnabled() bool {
+	return os.Getenv("PREPULL_BASE_IMAGES") != ""
+}
+
+// prePull is a set of base image pulls running alongside a clone.
+type prePull struct {
+	images  []string
+	started time.Time
+	elapsed time.Duration
+	done    chan struct{}
+}
+
+// prePullImages guesses the base images a build will need before its
+// clone finishes: from the Dockerfile at rev in the repository's mirror
+// when there is one, or else from the images its last build used. The
+// mirror may be a fetch behind, which only costs a wasted pull.
+func prePullImages(repoURL, rev string, compose bool) []string {
+	if mirrorDir != "" && !compose {
+		dir := mirrorPath(repoURL)
+		if _, err := os.Stat(dir); err == nil {
+			out, err := exec.Command("git", "--git-dir", dir, "show", rev+":Dockerfile").Output()
+			if err == nil {
+				return parseFromImages(bytes.NewReader(out))
+			}
+		}
+	}
+	rows, err := db.Query("SELECT image FROM base_images WHERE repo_url = ?", repoURL)
+	if err != nil {
+		log.Printf("Error getting base images of %s: %v", repoURL, err)
+		return nil
+	}
+	defer rows.Close()
+	var images []string
+	for rows.Next() {
+		var image string
+		if err := rows.Scan(&image); err == nil {
+			images = append(images, image)
+		}
+	}
+	return images
+}
+
+// startPrePull pulls images in the background, logging each to the
+// build's log. It returns nil if there is nothing to pull.
+func startPrePull(buildId string, images []string) *prePull {
+	if len(images) == 0 {
+		return nil
+	}
+	p := &prePull{images: images, started: time.Now(), done: make(chan struct{})}
+	go func() {
+		defer close(p.done)
+		sem := make(chan struct{}, prePullConcurrency)
+		var wg sync.WaitGroup
+		for _, image := range images {
+			wg.Add(1)
+			sem <- struct{}{}
+			go func(image string) {
+				defer wg.Done()
+				defer func() { <-sem }()
+				start := time.Now()
+				if out, err := exec.Command("docker", "pull", "--quiet", image).CombinedOutput(); err != nil {
+					logLine(buildId, fmt.Sprintf("==> pre-pull of %s failed: %s", image, bytes.TrimSpace(out)))
+					return
+				}
+				logLine(buildId, fmt.Sprintf("==> pre-pulled %s in %s", image, time.Since(start).Round(time.Millisecond)))
+			}(image)
+		}
+		wg.Wait()
+		p.elapsed = time.Since(p.started)
+	}()
+	return p
+}
+
+// wait blocks until the pulls finish and records how long they took and
+// how much of that the clone, which took cloneTime, hid.
+func (p *prePull) wait(buildId string, cloneTime time.Duration) {
+	if p == nil {
+		return
+	}
+	<-p.done
+	saved := min(p.elapsed, cloneTime)
+	pulled, savedSeconds, images := p.elapsed.Seconds(), saved.Seconds(), float64(len(p.images))
+	metrics := []BuildMetric{
+		{Name: "prepull_images", Value: fmt.Sprint(len(p.images)), Number: &images},
+		{Name: "prepull_seconds", Value: fmt.Sprintf("%.3f", pulled), Number: &pulled},
+		{Name: "prepull_saved_seconds", Value: fmt.Sprintf("%.3f", savedSeconds), Number: &savedSeconds},
+	}
+	if err := saveMetrics(buildId, metrics); err != nil {
+		log.Printf("Error saving pre-pull metrics: %v", err)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// The in-toto statement and SLSA v1 provenance predicate, reduced to the
+// fields this server can fill in.
+type ProvenanceStatement struct {
+	Type          string              `json:"_type"`
+	Subject       []ProvenanceSubject `json:"subject"`
+	PredicateType string              `json:"predicateType"`
+	Predicate     ProvenancePredicate `json:"predicate"`
+}
+
+type ProvenanceSubject struct {
+	Name   string            `json:"name"`
+	Digest map[string]string `json:"digest"`
+}
+
+type ProvenancePredicate struct {
+	BuildDefinition BuildDefinition `json:"buildDefinition"`
+	RunDetails      RunDetails      `json:"runDetails"`
+}
+
+type BuildDefinition struct {
+	BuildType            string                 `json:"buildType"`
+	ExternalParameters   map[string]interface{} `json:"externalParameters"`
+	InternalParameters   map[string]interface{} `json:"internalParameters"`
+	ResolvedDependencies []ResourceDescriptor   `json:"resolvedDependencies"`
+}
+
+type ResourceDescriptor struct {
+	URI    string            `json:"uri"`
+	Digest map[string]string `json:"digest"`
+}
+
+type RunDetails struct {
+	Builder  ProvenanceBuilder  `json:"builder"`
+	Metadata ProvenanceMetadata `json:"metadata"`
+}
+
+type ProvenanceBuilder struct {
+	ID string `json:"id"`
+}
+
+type ProvenanceMetadata struct {
+	InvocationID string    `json:"invocationId"`
+	StartedOn    time.Time `json:"startedOn"`
+	FinishedOn   time.Time `json:"finishedOn"`
+}
+
+const provenanceBuildType = "https://github.com/amitoo7/docker-build-server/buildx@v1"
+
+// provenanceMediaType is the media type of provenance attached to pushed
+// images, and provenanceFile the name it is attached under.
+const (
+	provenanceMediaType = "application/vnd.in-toto+json"
+	provenanceFile      = "provenance.intoto.json"
+)
+
+// builderID identifies this server in provenance; BUILDER_ID overrides the
+// hostname-based default.
+func builderID() string {
+	if id := os.Getenv("BUILDER_ID"); id != "" {
+		return id
+	}
+	host, _ := os.Hostname()
+	return "https://" + host + "/docker-build-server"
+}
+
+func newProvenance(buildId string, req BuildRequest, commitID string, images []BuiltImage, tools ToolVersions, started time.Time) ProvenanceStatement {
+	external := map[string]interface{}{"repoUrl": req.RepoUrl}
+	if len(req.Overrides) > 0 {
+		external["overrides"] = req.Overrides
+	}
+	if len(req.Parameters) > 0 {
+		external["parameters"] = req.Parameters
+	}
+	if req.Compose {
+		external["compose"] = true
+	}
+
+	var subjects []ProvenanceSubject
+	for _, image := range images {
+		name := image.Image
+		if i := strings.LastIndex(name, ":"); i >= 0 {
+			name = name[:i]
+		}
+		subjects = append(subjects, ProvenanceSubject{
+			Name:   name,
+			Digest: map[string]string{"sha256": strings.TrimPrefix(image.Digest, "sha256:")},
+		})
+	}
+	return ProvenanceStatement{
+		Type:          "https://in-toto.io/Statement/v1",
+		Subject:       subjects,
+		PredicateType: "https://slsa.dev/provenance/v1",
+		Predicate: ProvenancePredicate{
+			BuildDefinition: BuildDefinition{
+				BuildType:          provenanceBuildType,
+				ExternalParameters: external,
+				InternalParameters: map[string]interface{}{"tools": tools},
+				ResolvedDependencies: []ResourceDescriptor{{
+					URI:    "git+" + req.RepoUrl,
+					Digest: map[string]string{"gitCommit": commitID},
+				}},
+			},
+			RunDetails: RunDetails{
+				Builder: ProvenanceBuilder{ID: builderID()},
+				Metadata: ProvenanceMetadata{
+					InvocationID: buildId,
+					StartedOn:    started.UTC(),
+					FinishedOn:   time.Now().UTC(),
+				},
+			},
+		},
+	}
+}
+
+func saveProvenance(buildId string, statement ProvenanceStatement) error {
+	body, err := json.Marshal(statement)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("INSERT INTO build_provenance (build_id, statement) VALUES (?, ?)", buildId, string(body))
+	return err
+}
+
+// getProvenance returns the provenance statement of buildId as stored.
+func getProvenance(buildId string) (string, error) {
+	var statement string
+	err := db.QueryRow("SELECT statement FROM build_provenance WHERE build_id = ?", buildId).Scan(&statement)
+	return statement, err
+}
+
+func provenanceHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	buildId := mux.Vars(r)["buildId"]
+	statement, err := getProvenance(buildId)
+	if err == sql.ErrNoRows {
+		http.Error(w, "No provenance for build", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Could not get provenance", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", provenanceMediaType)
+	w.Write([]byte(statement))
+}
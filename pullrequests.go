@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PullRequestBuild ties a build to the pull request it was made for.
+type PullRequestBuild struct {
+	BuildId  string
+	Provider string
+	// Repository is the provider's name for it, such as "owner/name".
+	Repository string
+	Number     int
+	BaseBranch string
+}
+
+var pullRequestClient = &http.Client{Timeout: 30 * time.Second}
+
+func savePullRequestBuild(pr PullRequestBuild) error {
+	_, err := db.Exec("INSERT INTO pull_request_builds (build_id, provider, repository, number, base_branch) VALUES (?, ?, ?, ?, ?)",
+		pr.BuildId, pr.Provider, pr.Repository, pr.Number, pr.BaseBranch)
+	return err
+}
+
+func getPullRequestBuild(buildId string) (PullRequestBuild, error) {
+	pr := PullRequestBuild{BuildId: buildId}
+	err := db.QueryRow("SELECT provider, repository, number, base_branch FROM pull_request_builds WHERE build_id = ?", buildId).
+		Scan(&pr.Provider, &pr.Repository, &pr.Number, &pr.BaseBranch)
+	return pr, err
+}
+
+// latestPullRequestBuild returns the ID of the last build made for pr's
+// pull request.
+func latestPullRequestBuild(pr PullRequestBuild) (string, error) {
+	var buildId string
+	err := db.QueryRow("SELECT build_id FROM pull_request_builds WHERE provider = ? AND repository = ? AND number = ? ORDER BY rowid DESC LIMIT 1",
+		pr.Provider, pr.Repository, pr.Number).Scan(&buildId)
+	return buildId, err
+}
+
+func isPullRequestBuild(buildId string) bool {
+	_, err := getPullRequestBuild(buildId)
+	return err == nil
+}
+
+// buildCVEs lists the known vulnerabilities of the base images a build
+// was pinned to.
+func buildCVEs(buildId string) (map[string]bool, error) {
+	builds, err := getVulnerableBuilds(buildId)
+	if err != nil {
+		return nil, err
+	}
+	cves := make(map[string]bool)
+	for _, b := range builds {
+		for _, cve := range b.CVEs {
+			cves[cve] = true
+		}
+	}
+	return cves, nil
+}
+
+func formatSize(n int64) string {
+	const unit = 1024
+	if n < unit && n > -unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	f, suffix := float64(n), "KMGT"
+	i := -1
+	for (f >= unit || f <= -unit) && i < len(suffix)-1 {
+		f /= unit
+		i++
+	}
+	return fmt.Sprintf("%.1f %ciB", f, suffix[i])
+}
+
+// missingFrom lists the keys of a that are not in b, sorted.
+func missingFrom(a, b map[string]bool) []string {
+	var keys []string
+	for k := range a {
+		if !b[k] {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// pullRequestCommentQueue hands comments to one goroutine, so a build's
+// started and finished comments are sent in order.
+var (
+	pullRequestCommentQueue = make(chan Event, 256)
+	pullRequestCommentOnce  sync.Once
+)
+
+func getPullRequestComment(pr PullRequestBuild) (int64, error) {
+	var id int64
+	err := db.QueryRow("SELECT comment_id FROM pull_request_comments WHERE provider = ? AND repository = ? AND number = ?",
+		pr.Provider, pr.Repository, pr.Number).Scan(&id)
+	return id, err
+}
+
+func savePullRequestComment(pr PullRequestBuild, id int64) error {
+	_, err := db.Exec("INSERT OR REPLACE INTO pull_request_comments (provider, repository, number, comment_id) VALUES (?, ?, ?, ?)",
+		pr.Provider, pr.Repository, pr.Number, id)
+	return err
+}
+
+// publicURL is the address users reach the server at, from PUBLIC_URL,
+// which comments link builds to. It is empty if unset.
+func publicURL() string {
+	return strings.TrimSuffix(os.Getenv("PUBLIC_URL"), "/")
+}
+
+// secretScanSummary describes a build's secret scan for a comment.
+func secretScanSummary(buildId string) string {
+	findings, err := getSecretFindings(buildId)
+	switch {
+	case err == sql.ErrNoRows:
+		return "not run"
+	case err != nil:
+		return "unknown"
+	case len(findings) == 0:
+		return "no findings"
+	case len(findings) == 1:
+		return "1 potential secret"
+	}
+	return fmt.Sprintf("%d potential secrets", len(findings))
+}
+
+// licenseScanSummary describes a build's license scan for a comment.
+func licenseScanSummary(buildId string) string {
+	body, err := getLicenseReport(buildId)
+	if err == sql.ErrNoRows {
+		return "not run"
+	}
+	var report LicenseReport
+	if err != nil || json.Unmarshal([]byte(body), &report) != nil {
+		return "unknown"
+	}
+	if len(report.Denied) > 0 {
+		return "denied licenses: " + strings.Join(report.Denied, ", ")
+	}
+	return fmt.Sprintf("%d packages, no denied licenses", len(report.Packages))
+}
+
+// pullRequestComment summarizes a pull request build. Finished builds
+// are compared with the last build of the branch the pull request
+// targets.
+func pullRequestComment(pr PullRequestBuild, e Event) string {
+	var b strings.Builder
+	status := "running"
+	switch e.Type {
+	case EventBuildSucceeded:
+		status = "succeeded"
+	case EventBuildFailed:
+		status = "failed"
+	}
+	fmt.Fprintf(&b, "### Build %s\n\n| | |\n|---|---|\n", status)
+	fmt.Fprintf(&b, "| Build | `%s` |\n", e.BuildId)
+	if e.CommitID != "" {
+		fmt.Fprintf(&b, "| Commit | %.7s |\n", e.CommitID)
+	}
+	if s, err := store.GetStatus(e.BuildId); err == nil && s.StartedAt != nil && s.FinishedAt != nil {
+		fmt.Fprintf(&b, "| Duration | %s |\n", s.FinishedAt.Sub(*s.StartedAt).Round(time.Second))
+	}
+	if e.Type == EventBuildSucceeded {
+		writeBuildComparison(&b, pr, e)
+		fmt.Fprintf(&b, "| Secret scan | %s |\n", secretScanSummary(e.BuildId))
+		fmt.Fprintf(&b, "| License scan | %s |\n", licenseScanSummary(e.BuildId))
+	}
+	if u := publicURL(); u != "" {
+		fmt.Fprintf(&b, "\n[Build details](%s/api/builds/%s), [log](%s/api/builds/%s/logs/tail)\n", u, e.BuildId, u, e.BuildId)
+	}
+	if e.Type == EventBuildFailed && e.Err != nil {
+		fmt.Fprintf(&b, "\n```\n%s\n```\n", redact(e.Err.Error()))
+	}
+	return b.String()
+}
+
+// writeBuildComparison adds the image size and known base image CVEs of
+// a successful build to a comment's table, next to those of the last
+// build of the pull request's base branch.
+func writeBuildComparison(b *strings.Builder, pr PullRequestBuild, e Event) {
+	base, baseErr := store.LastBranchBuild(e.RepoUrl, pr.BaseBranch)
+	fmt.Fprintf(b, "| Image | `%s` |\n", e.Image)
+	if size, ok := imageSize(e.Image); ok {
+		fmt.Fprintf(b, "| Image size | %s", formatSize(size))
+		if baseErr == nil {
+			if baseSize, ok := imageSize(base.Image); ok {
+				fmt.Fprintf(b, " (%+d B on `%s` at %.7s)", size-baseSize, pr.BaseBranch, base.CommitID)
+			}
+		}
+		b.WriteString(" |\n")
+	}
+	cves, err := buildCVEs(e.BuildId)
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(b, "| Known base image CVEs | %d", len(cves))
+	if baseErr == nil {
+		if baseCVEs, err := buildCVEs(base.BuildId); err == nil {
+			if added := missingFrom(cves, baseCVEs); len(added) > 0 {
+				fmt.Fprintf(b, "; new: %s", strings.Join(added, ", "))
+			}
+			if fixed := missingFrom(baseCVEs, cves); len(fixed) > 0 {
+				fmt.Fprintf(b, "; fixed: %s", strings.Join(fixed, ", "))
+			}
+		}
+	}
+	b.WriteString(" |\n")
+}
+
+func githubAPIURL() string {
+	if u := os.Getenv("GITHUB_API_URL"); u != "" {
+		return strings.TrimSuffix(u, "/")
+	}
+	return "https://api.github.com"
+}
+
+// githubComment creates a comment on a GitHub pull request, or edits
+// comment commentId if it is not 0 and still exists, returning the ID of
+// the comment written.
+func githubComment(token string, pr PullRequestBuild, commentId int64, body string) (int64, error) {
+	payload, err := json.Marshal(map[string]string{"body": body})
+	if err != nil {
+		return 0, err
+	}
+	if commentId != 0 {
+		url := fmt.Sprintf("%s/repos/%s/issues/comments/%d", githubAPIURL(), pr.Repository, commentId)
+		resp, err := githubRequest(token, http.MethodPatch, url, payload)
+		if err != nil {
+			return 0, err
+		}
+		resp.Body.Close()
+		switch resp.StatusCode {
+		case http.StatusOK:
+			return commentId, nil
+		case http.StatusNotFound:
+			// Deleted from the pull request; post a new one.
+		default:
+			return 0, fmt.Errorf("GitHub returned %s", resp.Status)
+		}
+	}
+
+	url := fmt.Sprintf("%s/repos/%s/issues/%d/comments", githubAPIURL(), pr.Repository, pr.Number)
+	resp, err := githubRequest(token, http.MethodPost, url, payload)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return 0, fmt.Errorf("GitHub returned %s", resp.Status)
+	}
+	var created struct {
+		ID int64 `json:"id"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&created)
+	return created.ID, err
+}
+
+func githubRequest(token, method, url string, payload []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, url, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("Content-Type", "application/json")
+	return pullRequestClient.Do(req)
+}
+
+// updatePullRequestComment writes the build's state to the pull
+// request's comment, creating the comment on its first build.
+func updatePullRequestComment(pr PullRequestBuild, e Event) {
+	// An earlier build finishing late must not replace the result of a
+	// later push.
+	latest, err := latestPullRequestBuild(pr)
+	if err != nil {
+		log.Printf("Error getting latest build of %s#%d: %v", pr.Repository, pr.Number, err)
+		return
+	}
+	if latest != e.BuildId {
+		return
+	}
+	s, err := getWebhookSettings(e.RepoUrl)
+	if err != nil || s.Token == "" {
+		log.Printf("Not commenting on %s#%d: no API token for %s", pr.Repository, pr.Number, e.RepoUrl)
+		return
+	}
+	commentId, err := getPullRequestComment(pr)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("Error getting comment on %s#%d: %v", pr.Repository, pr.Number, err)
+		return
+	}
+	id, err := githubComment(s.Token, pr, commentId, pullRequestComment(pr, e))
+	if err != nil {
+		log.Printf("Error commenting on %s#%d: %v", pr.Repository, pr.Number, err)
+		return
+	}
+	if id != commentId {
+		if err := savePullRequestComment(pr, id); err != nil {
+			log.Printf("Error recording comment on %s#%d: %v", pr.Repository, pr.Number, err)
+		}
+	}
+}
+
+// commentPullRequest keeps one comment on each pull request up to date
+// with its latest build, using the repository's webhook token.
+func commentPullRequest(e Event) {
+	if e.Type != EventBuildStarted && e.Type != EventBuildSucceeded && e.Type != EventBuildFailed {
+		return
+	}
+	if !isPullRequestBuild(e.BuildId) {
+		return
+	}
+	pullRequestCommentOnce.Do(func() {
+		go func() {
+			for e := range pullRequestCommentQueue {
+				pr, err := getPullRequestBuild(e.BuildId)
+				if err != nil {
+					log.Printf("Error getting pull request of build %s: %v", e.BuildId, err)
+					continue
+				}
+				updatePullRequestComment(pr, e)
+			}
+		}()
+	})
+	select {
+	case pullRequestCommentQueue <- e:
+	default:
+		log.Printf("Dropped pull request comment for build %s: queue full", e.BuildId)
+	}
+}
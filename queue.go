@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// BuildQueue limits how many builds run at once and how many may wait for
+// a free slot. Submissions beyond that are rejected rather than piling up
+// clones on disk.
+type BuildQueue struct {
+	mu          sync.Mutex
+	slotFreed   *sync.Cond
+	queued      int
+	running     int
+	maxDepth    int
+	concurrency int
+	// limit is the number of builds allowed to run, lowered below
+	// concurrency while the Docker daemon is throttled.
+	limit     int
+	throttled string
+}
+
+func NewBuildQueue(concurrency, maxDepth int) *BuildQueue {
+	q := &BuildQueue{
+		maxDepth:    maxDepth,
+		concurrency: concurrency,
+		limit:       concurrency,
+	}
+	q.slotFreed = sync.NewCond(&q.mu)
+	return q
+}
+
+// SetLimit changes how many builds may run, between one and the
+// configured concurrency, with reason saying why it is below the
+// maximum. Running builds are not stopped; new ones wait until enough
+// have finished.
+func (q *BuildQueue) SetLimit(limit int, reason string) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.limit = max(1, min(limit, q.concurrency))
+	q.throttled = ""
+	if q.limit < q.concurrency {
+		q.throttled = reason
+	}
+	q.slotFreed.Broadcast()
+	return q.limit
+}
+
+// Limit returns how many builds may currently run and the configured
+// maximum.
+func (q *BuildQueue) Limit() (limit, concurrency int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.limit, q.concurrency
+}
+
+// Reserve claims a place in the queue, returning false when it is full.
+func (q *BuildQueue) Reserve() bool {
+	return q.ReserveN(1)
+}
+
+// ReserveN claims n places at once, or none if they don't all fit.
+func (q *BuildQueue) ReserveN(n int) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.queued+n > q.maxDepth {
+		return false
+	}
+	q.queued += n
+	return true
+}
+
+// ReleaseN gives back places claimed with ReserveN that will not be run.
+func (q *BuildQueue) ReleaseN(n int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.queued -= n
+}
+
+// Run waits for a free slot and runs fn in it. The caller must have
+// reserved a place with Reserve.
+func (q *BuildQueue) Run(fn func()) {
+	q.mu.Lock()
+	for q.running >= q.limit {
+		q.slotFreed.Wait()
+	}
+	q.queued--
+	q.running++
+	q.mu.Unlock()
+
+	defer func() {
+		q.mu.Lock()
+		q.running--
+		q.mu.Unlock()
+		q.slotFreed.Signal()
+	}()
+	fn()
+}
+
+type QueueStats struct {
+	Running     int     `json:"running"`
+	Queued      int     `json:"queued"`
+	Concurrency int     `json:"concurrency"`
+	MaxDepth    int     `json:"maxDepth"`
+	Saturation  float64 `json:"saturation"`
+	// EffectiveConcurrency is below Concurrency while the Docker daemon
+	// is throttled, for the reason in Throttled.
+	EffectiveConcurrency int    `json:"effectiveConcurrency"`
+	Throttled            string `json:"throttled,omitempty"`
+}
+
+func (q *BuildQueue) Stats() QueueStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	stats := QueueStats{
+		Running:     q.running,
+		Queued:      q.queued,
+		Concurrency: q.concurrency,
+		MaxDepth:    q.maxDepth,
+
+		EffectiveConcurrency: q.limit,
+		Throttled:            q.throttled,
+	}
+	if q.maxDepth > 0 {
+		stats.Saturation = float64(q.queued) / float64(q.maxDepth)
+	}
+	return stats
+}
+
+var queue *BuildQueue
+
+// queueRetryAfter is the Retry-After hint, in seconds, sent with 429s.
+var queueRetryAfter int
+
+func rejectQueueFull(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", strconv.Itoa(queueRetryAfter))
+	http.Error(w, "Build queue is full", http.StatusTooManyRequests)
+}
+
+type QueueResponse struct {
+	QueueStats
+	Scheduled []ScheduledBuild `json:"scheduled"`
+}
+
+func queueHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	scheduled, err := getScheduledBuilds()
+	if err != nil {
+		http.Error(w, "Could not get scheduled builds", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(QueueResponse{QueueStats: queue.Stats(), Scheduled: scheduled})
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var (
+	registryHostPattern = regexp.MustCompile(`^[a-zA-Z0-9.-]+(:[0-9]+)?$`)
+	repositoryPattern   = regexp.MustCompile(`^[a-z0-9]+([._-][a-z0-9]+)*(/[a-z0-9]+([._-][a-z0-9]+)*)*$`)
+)
+
+// RegistrySettings say where a repository's images are pushed.
+type RegistrySettings struct {
+	RepoUrl string `json:"repoUrl"`
+	// Registry is the registry's host, such as ghcr.io, or empty for
+	// Docker Hub.
+	Registry string `json:"registry,omitempty"`
+	// Repository is the image's name in the registry, such as org/app.
+	// Compose builds push each service to Repository/<service>.
+	Repository string `json:"repository"`
+	// Username and Password log in to the registry, when set. Otherwise
+	// the server's own Docker credentials are used. The password is never
+	// returned; HasPassword tells whether one is set.
+	Username    string `json:"username,omitempty"`
+	Password    string `json:"password,omitempty"`
+	HasPassword bool   `json:"hasPassword"`
+	// Push pushes every successful build. Without it only builds that
+	// ask to be pushed are.
+	Push bool `json:"push"`
+}
+
+// PushedImage is an image a build pushed and where it went.
+type PushedImage struct {
+	Image     string `json:"image"`
+	Reference string `json:"reference"`
+	// Digest is the manifest digest the registry stored it under.
+	Digest string `json:"digest,omitempty"`
+	// Provenance is the digest of the build's provenance statement,
+	// attached to the image in the registry.
+	Provenance string `json:"provenance,omitempty"`
+}
+
+func validateRegistrySettings(s RegistrySettings) error {
+	if s.Registry != "" && !registryHostPattern.MatchString(s.Registry) {
+		return fmt.Errorf("invalid registry %q: must be a host such as ghcr.io, without a scheme", s.Registry)
+	}
+	if !repositoryPattern.MatchString(s.Repository) {
+		return fmt.Errorf("invalid repository %q: must be a lowercase name such as org/app", s.Repository)
+	}
+	if (s.Username == "") != (s.Password == "") {
+		return errors.New("username and password must be set together")
+	}
+	return nil
+}
+
+func getRegistrySettings(repoURL string) (RegistrySettings, error) {
+	s := RegistrySettings{RepoUrl: repoURL}
+	err := db.QueryRow("SELECT registry, repository, username, password, push FROM registry_settings WHERE repo_url = ?", repoURL).
+		Scan(&s.Registry, &s.Repository, &s.Username, &s.Password, &s.Push)
+	s.HasPassword = s.Password != ""
+	registerSecrets(s.Password)
+	return s, err
+}
+
+func saveRegistrySettings(s RegistrySettings) error {
+	registerSecrets(s.Password)
+	_, err := db.Exec("INSERT OR REPLACE INTO registry_settings (repo_url, registry, repository, username, password, push) VALUES (?, ?, ?, ?, ?, ?)",
+		s.RepoUrl, s.Registry, s.Repository, s.Username, s.Password, s.Push)
+	return err
+}
+
+func savePushedImages(buildId string, pushed []PushedImage) error {
+	body, err := json.Marshal(pushed)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("INSERT OR REPLACE INTO build_pushes (build_id, images) VALUES (?, ?)", buildId, string(body))
+	return err
+}
+
+func getPushedImages(buildId string) ([]PushedImage, error) {
+	var body string
+	if err := db.QueryRow("SELECT images FROM build_pushes WHERE build_id = ?", buildId).Scan(&body); err != nil {
+		return nil, err
+	}
+	var pushed []PushedImage
+	err := json.Unmarshal([]byte(body), &pushed)
+	return pushed, err
+}
+
+// checkPushRequest makes sure a build asking to be pushed has somewhere
+// to go.
+func checkPushRequest(req *BuildRequest) error {
+	if !req.Push {
+		return nil
+	}
+	_, err := getRegistrySettings(req.RepoUrl)
+	if err == sql.ErrNoRows {
+		return errors.New("push requested but no registry is configured for the repository")
+	}
+	return err
+}
+
+// buildRegistry returns where a build's images go and whether they are
+// pushed at all.
+func buildRegistry(req BuildRequest) (RegistrySettings, bool, error) {
+	s, err := getRegistrySettings(req.RepoUrl)
+	if err == sql.ErrNoRows {
+		return s, false, nil
+	}
+	if err != nil {
+		return s, false, err
+	}
+	return s, s.Push || req.Push, nil
+}
+
+// remoteReference names image in the registry, tagged tag.
+func remoteReference(s RegistrySettings, image BuiltImage, tag string) string {
+	name := s.Repository
+	if image.Service != "" {
+		name += "/" + image.Service
+	}
+	if s.Registry != "" {
+		name = s.Registry + "/" + name
+	}
+	return name + ":" + tag
+}
+
+// registryLogin logs in to the registry with the settings' credentials,
+// storing them in configDir so they are neither shared with other builds
+// nor left on the host. The password goes through stdin, out of the
+// process list.
+func registryLogin(ctx context.Context, s RegistrySettings, configDir string) error {
+	args := []string{"--config", configDir, "login", "--username", s.Username, "--password-stdin"}
+	if s.Registry != "" {
+		args = append(args, s.Registry)
+	}
+	cmd := exec.CommandContext(ctx, "docker", args...)
+	cmd.Stdin = strings.NewReader(s.Password)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("logging in to %s: %s", registryName(s), redact(strings.TrimSpace(string(out))))
+	}
+	return nil
+}
+
+func registryName(s RegistrySettings) string {
+	if s.Registry == "" {
+		return "Docker Hub"
+	}
+	return s.Registry
+}
+
+// pushedDigest returns the digest the registry reported for reference.
+func pushedDigest(reference string) string {
+	out, err := exec.Command("docker", "image", "inspect", "--format", "{{range .RepoDigests}}{{println .}}{{end}}", reference).Output()
+	if err != nil {
+		return ""
+	}
+	name := reference[:strings.LastIndex(reference, ":")]
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		if digest, ok := strings.CutPrefix(scanner.Text(), name+"@"); ok {
+			return digest
+		}
+	}
+	return ""
+}
+
+// pushedSubjects are the pushed images as provenance subjects: their names
+// in the registry and the digests the registry stored them under.
+func pushedSubjects(pushed []PushedImage) []ProvenanceSubject {
+	var subjects []ProvenanceSubject
+	for _, p := range pushed {
+		subjects = append(subjects, ProvenanceSubject{
+			Name:   p.Reference[:strings.LastIndex(p.Reference, ":")],
+			Digest: map[string]string{"sha256": strings.TrimPrefix(p.Digest, "sha256:")},
+		})
+	}
+	return subjects
+}
+
+// attachProvenance attaches statement to the pushed image with oras, as
+// an in-toto artifact referring to its digest, and returns the artifact's
+// digest. configDir holds the registry login, if the settings have one.
+func attachProvenance(configDir string, p PushedImage, statement []byte) (string, error) {
+	dir, err := os.MkdirTemp("", "provenance-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(dir)
+	if err := os.WriteFile(filepath.Join(dir, provenanceFile), statement, 0600); err != nil {
+		return "", err
+	}
+	subject := p.Reference[:strings.LastIndex(p.Reference, ":")] + "@" + p.Digest
+	args := []string{"attach", "--artifact-type", provenanceMediaType}
+	if configDir != "" {
+		args = append(args, "--registry-config", filepath.Join(configDir, "config.json"))
+	}
+	args = append(args, subject, provenanceFile+":"+provenanceMediaType)
+	cmd := exec.Command("oras", args...)
+	// oras only accepts files named relative to its working directory.
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("attaching provenance to %s: %s", subject, redact(strings.TrimSpace(string(out))))
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		if digest, ok := strings.CutPrefix(strings.TrimSpace(line), "Digest: "); ok {
+			return digest, nil
+		}
+	}
+	return "", nil
+}
+
+// pushImages tags images for the registry and pushes them, then attaches
+// statement to each, with its subjects replaced by the pushed images.
+// Without oras installed the statement is only stored with the build.
+func pushImages(buildId string, s RegistrySettings, images []BuiltImage, tag string, statement *ProvenanceStatement) ([]PushedImage, error) {
+	var configDir string
+	var config []string
+	if s.Username != "" {
+		var err error
+		if configDir, err = os.MkdirTemp("", "registry-"); err != nil {
+			return nil, err
+		}
+		defer os.RemoveAll(configDir)
+		if err := registryLogin(context.Background(), s, configDir); err != nil {
+			return nil, err
+		}
+		config = []string{"--config", configDir}
+	}
+
+	var pushed []PushedImage
+	for _, image := range images {
+		ref := remoteReference(s, image, tag)
+		if out, err := exec.Command("docker", "tag", image.Image, ref).CombinedOutput(); err != nil {
+			return pushed, fmt.Errorf("tagging %s as %s: %s", image.Image, ref, strings.TrimSpace(string(out)))
+		}
+		logLine(buildId, fmt.Sprintf("==> pushing %s", ref))
+		args := append(append([]string{}, config...), "push", ref)
+		if err := runCommand(buildId, exec.Command("docker", args...)); err != nil {
+			return pushed, fmt.Errorf("pushing %s: %v", ref, err)
+		}
+		digest := pushedDigest(ref)
+		if digest == "" {
+			return pushed, fmt.Errorf("the registry reported no digest for %s", ref)
+		}
+		pushed = append(pushed, PushedImage{Image: image.Image, Reference: ref, Digest: digest})
+	}
+
+	statement.Subject = pushedSubjects(pushed)
+	if _, err := exec.LookPath("oras"); err != nil {
+		logLine(buildId, "==> oras is not installed; provenance is not attached to the pushed images")
+		return pushed, nil
+	}
+	body, err := json.Marshal(statement)
+	if err != nil {
+		return pushed, err
+	}
+	for i := range pushed {
+		logLine(buildId, fmt.Sprintf("==> attaching provenance to %s", pushed[i].Reference))
+		if pushed[i].Provenance, err = attachProvenance(configDir, pushed[i], body); err != nil {
+			return pushed, err
+		}
+	}
+	return pushed, nil
+}
+
+// checkRegistryLogin logs in to the repository's registry with its
+// credentials and throws the session away.
+func checkRegistryLogin(s RegistrySettings) SecretCheck {
+	check := SecretCheck{Name: "registry"}
+	configDir, err := os.MkdirTemp("", "registry-")
+	if err != nil {
+		check.Status = SecretSkipped
+		check.Detail = err.Error()
+		return check
+	}
+	defer os.RemoveAll(configDir)
+	ctx, cancel := context.WithTimeout(context.Background(), secretCheckTimeout)
+	defer cancel()
+	if err := registryLogin(ctx, s, configDir); err != nil {
+		check.Status = SecretInvalid
+		check.Detail = err.Error()
+		return check
+	}
+	check.Status = SecretValid
+	return check
+}
+
+func getRegistrySettingsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	repoURL := r.URL.Query().Get("repo")
+	if err := validateRepoURL(repoURL); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s, err := getRegistrySettings(repoURL)
+	if err == sql.ErrNoRows {
+		http.Error(w, "No registry configured for repository", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Could not get registry settings", http.StatusInternalServerError)
+		return
+	}
+	s.Password = ""
+	json.NewEncoder(w).Encode(s)
+}
+
+// setRegistrySettingsHandler saves where a repository's images are
+// pushed. An empty password keeps the one already set for the same
+// username.
+func setRegistrySettingsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	var s RegistrySettings
+	if err := json.NewDecoder(r.Body).Decode(&s); err != nil || s.RepoUrl == "" {
+		http.Error(w, "Request must contain repoUrl and repository", http.StatusBadRequest)
+		return
+	}
+	if err := validateRepoURL(s.RepoUrl); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if s.Username != "" && s.Password == "" {
+		existing, err := getRegistrySettings(s.RepoUrl)
+		if err != nil && err != sql.ErrNoRows {
+			http.Error(w, "Could not get registry settings", http.StatusInternalServerError)
+			return
+		}
+		if existing.Username == s.Username {
+			s.Password = existing.Password
+		}
+	}
+	if err := validateRegistrySettings(s); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := saveRegistrySettings(s); err != nil {
+		http.Error(w, "Could not save registry settings", http.StatusInternalServerError)
+		return
+	}
+	s.HasPassword = s.Password != ""
+	s.Password = ""
+	json.NewEncoder(w).Encode(s)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// ResourceUsage is what a build consumed on this host: its own commands,
+// and when buildx uses the docker-container driver, the BuildKit
+// container while the build's images were building. Builds running at
+// the same time on one builder each count all of its usage then. With
+// the docker driver BuildKit runs inside the daemon, whose usage is not
+// included.
+type ResourceUsage struct {
+	CPUSeconds      float64 `json:"cpuSeconds"`
+	WallSeconds     float64 `json:"wallSeconds"`
+	AvgCPUPercent   float64 `json:"avgCpuPercent"`
+	PeakMemoryBytes int64   `json:"peakMemoryBytes"`
+	ReadBytes       int64   `json:"readBytes"`
+	WriteBytes      int64   `json:"writeBytes"`
+}
+
+// buildkitSampleInterval is how often the BuildKit container's usage is
+// sampled while an image builds.
+const buildkitSampleInterval = 2 * time.Second
+
+// recordResourceUsage adds the usage of one finished command to its
+// build's totals.
+func recordResourceUsage(buildId string, state *os.ProcessState, wall time.Duration) {
+	cpu := (state.UserTime() + state.SystemTime()).Seconds()
+	peakMemory, readBytes, writeBytes := processUsage(state)
+	addResourceUsage(buildId, ResourceUsage{CPUSeconds: cpu, WallSeconds: wall.Seconds(), PeakMemoryBytes: peakMemory, ReadBytes: readBytes, WriteBytes: writeBytes})
+}
+
+func addResourceUsage(buildId string, u ResourceUsage) {
+	_, err := db.Exec(`INSERT INTO build_resources (build_id, cpu_seconds, wall_seconds, peak_memory_bytes, read_bytes, write_bytes)
+        VALUES (?, ?, ?, ?, ?, ?)
+        ON CONFLICT(build_id) DO UPDATE SET
+            cpu_seconds = cpu_seconds + excluded.cpu_seconds,
+            wall_seconds = wall_seconds + excluded.wall_seconds,
+            peak_memory_bytes = max(peak_memory_bytes, excluded.peak_memory_bytes),
+            read_bytes = read_bytes + excluded.read_bytes,
+            write_bytes = write_bytes + excluded.write_bytes`,
+		buildId, u.CPUSeconds, u.WallSeconds, u.PeakMemoryBytes, u.ReadBytes, u.WriteBytes)
+	if err != nil {
+		log.Printf("Error recording resource usage: %v", err)
+	}
+}
+
+// buildkitContainer names the container BuildKit runs in for the current
+// buildx builder, if it uses the docker-container driver.
+func buildkitContainer() (string, bool) {
+	out, err := exec.Command("docker", "buildx", "inspect").Output()
+	if err != nil {
+		return "", false
+	}
+	var names []string
+	var driver string
+	for _, line := range strings.Split(string(out), "\n") {
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		switch strings.TrimSpace(key) {
+		case "Name":
+			names = append(names, strings.TrimSpace(value))
+		case "Driver":
+			driver = strings.TrimSpace(value)
+		}
+	}
+	// The builder's name comes first, then those of its nodes.
+	if driver != "docker-container" || len(names) < 2 {
+		return "", false
+	}
+	return "buildx_buildkit_" + names[1], true
+}
+
+// containerSample is one reading of docker stats for a container. IO
+// counts are totals since the container started.
+type containerSample struct {
+	cpuPercent  float64
+	memoryBytes int64
+	readBytes   int64
+	writeBytes  int64
+}
+
+func sampleContainer(name string) (containerSample, error) {
+	var sample containerSample
+	out, err := exec.Command("docker", "stats", "--no-stream", "--format", "{{.CPUPerc}}\t{{.MemUsage}}\t{{.BlockIO}}", name).Output()
+	if err != nil {
+		return sample, err
+	}
+	fields := strings.Split(strings.TrimSpace(string(out)), "\t")
+	if len(fields) != 3 {
+		return sample, fmt.Errorf("unexpected docker stats output %q", out)
+	}
+	sample.cpuPercent, _ = strconv.ParseFloat(strings.TrimSuffix(fields[0], "%"), 64)
+	memory, _, _ := strings.Cut(fields[1], "/")
+	sample.memoryBytes = parseSize(strings.TrimSpace(memory))
+	read, write, _ := strings.Cut(fields[2], "/")
+	sample.readBytes, sample.writeBytes = parseSize(strings.TrimSpace(read)), parseSize(strings.TrimSpace(write))
+	return sample, nil
+}
+
+// sampleBuildKit samples the BuildKit container until the returned
+// function is called, which adds what it used meanwhile to buildId's
+// usage. CPU time is worked out from the CPU percentage of each sample.
+func sampleBuildKit(buildId string) func() {
+	container, ok := buildkitContainer()
+	if !ok {
+		return func() {}
+	}
+	done := make(chan struct{})
+	finished := make(chan ResourceUsage)
+	go func() {
+		var usage ResourceUsage
+		var first, last containerSample
+		sampled := false
+		lastAt := time.Now()
+		for {
+			if s, err := sampleContainer(container); err == nil {
+				now := time.Now()
+				if !sampled {
+					first, sampled = s, true
+				}
+				usage.CPUSeconds += s.cpuPercent / 100 * now.Sub(lastAt).Seconds()
+				usage.PeakMemoryBytes = max(usage.PeakMemoryBytes, s.memoryBytes)
+				last, lastAt = s, now
+			}
+			select {
+			case <-done:
+				usage.ReadBytes = max(last.readBytes-first.readBytes, 0)
+				usage.WriteBytes = max(last.writeBytes-first.writeBytes, 0)
+				finished <- usage
+				return
+			case <-time.After(buildkitSampleInterval):
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		addResourceUsage(buildId, <-finished)
+	}
+}
+
+func getResourceUsage(buildId string) (ResourceUsage, error) {
+	var u ResourceUsage
+	err := db.QueryRow("SELECT cpu_seconds, wall_seconds, peak_memory_bytes, read_bytes, write_bytes FROM build_resources WHERE build_id = ?", buildId).
+		Scan(&u.CPUSeconds, &u.WallSeconds, &u.PeakMemoryBytes, &u.ReadBytes, &u.WriteBytes)
+	if err == nil && u.WallSeconds > 0 {
+		u.AvgCPUPercent = 100 * u.CPUSeconds / u.WallSeconds
+	}
+	return u, err
+}
+
+func resourcesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	usage, err := getResourceUsage(mux.Vars(r)["buildId"])
+	if err == sql.ErrNoRows {
+		http.Error(w, "No resource usage for build", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Could not get resource usage", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(usage)
+}
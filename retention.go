@@ -0,0 +1,247 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// maxRetentionHours bounds how long a failed build's workspace is kept.
+const maxRetentionHours = 7 * 24
+
+// WorkspaceRetention is how many hours a repository's failed builds keep
+// their workspace so the failure can be reproduced. Zero removes it as
+// soon as the build fails.
+type WorkspaceRetention struct {
+	RepoUrl string `json:"repoUrl"`
+	Hours   int    `json:"hours"`
+}
+
+// RetainedWorkspace is the workspace of a failed build kept for download.
+type RetainedWorkspace struct {
+	BuildId   string    `json:"buildId"`
+	RepoUrl   string    `json:"repoUrl"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+func getWorkspaceRetention(repoURL string) (int, error) {
+	var hours int
+	err := db.QueryRow("SELECT hours FROM workspace_retention WHERE repo_url = ?", repoURL).Scan(&hours)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return hours, err
+}
+
+func saveWorkspaceRetention(repoURL string, hours int) error {
+	_, err := db.Exec("INSERT OR REPLACE INTO workspace_retention (repo_url, hours) VALUES (?, ?)", repoURL, hours)
+	return err
+}
+
+// retainWorkspace keeps a failed build's workspace for its repository's
+// retention period, or removes it straight away.
+func retainWorkspace(e Event) {
+	if e.Type != EventBuildFailed {
+		return
+	}
+	hours, err := getWorkspaceRetention(e.RepoUrl)
+	if err != nil {
+		log.Printf("Error getting workspace retention: %v", err)
+	}
+	dir := buildDir(e.BuildId)
+	if _, err := os.Stat(dir); err != nil {
+		return
+	}
+	if hours > 0 {
+		expires := time.Now().UTC().Add(time.Duration(hours) * time.Hour)
+		_, err := db.Exec("INSERT OR REPLACE INTO retained_workspaces (build_id, repo_url, expires_at) VALUES (?, ?, ?)", e.BuildId, e.RepoUrl, expires)
+		if err == nil {
+			logLine(e.BuildId, "==> workspace retained until "+expires.Format(time.RFC3339))
+			return
+		}
+		log.Printf("Error retaining workspace of %s: %v", e.BuildId, err)
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		log.Printf("Error removing repository directory: %v", err)
+	}
+}
+
+func getRetainedWorkspace(buildId string) (RetainedWorkspace, error) {
+	ws := RetainedWorkspace{BuildId: buildId}
+	err := db.QueryRow("SELECT repo_url, expires_at FROM retained_workspaces WHERE build_id = ?", buildId).Scan(&ws.RepoUrl, &ws.ExpiresAt)
+	return ws, err
+}
+
+// isWorkspaceRetained reports whether buildId's workspace is kept for
+// download and must not be cleaned up yet.
+func isWorkspaceRetained(buildId string) bool {
+	ws, err := getRetainedWorkspace(buildId)
+	return err == nil && time.Now().Before(ws.ExpiresAt)
+}
+
+// removeExpiredWorkspaces deletes retained workspaces past their expiry.
+func removeExpiredWorkspaces() {
+	rows, err := db.Query("SELECT build_id FROM retained_workspaces WHERE expires_at <= ?", time.Now().UTC())
+	if err != nil {
+		log.Printf("Error listing expired workspaces: %v", err)
+		return
+	}
+	var expired []string
+	for rows.Next() {
+		var buildId string
+		if err := rows.Scan(&buildId); err == nil {
+			expired = append(expired, buildId)
+		}
+	}
+	rows.Close()
+
+	for _, buildId := range expired {
+		if err := os.RemoveAll(buildDir(buildId)); err != nil {
+			log.Printf("Error removing workspace of %s: %v", buildId, err)
+			continue
+		}
+		db.Exec("DELETE FROM retained_workspaces WHERE build_id = ?", buildId)
+	}
+}
+
+func runWorkspaceSweeper() {
+	for range time.Tick(10 * time.Minute) {
+		removeExpiredWorkspaces()
+	}
+}
+
+// writeWorkspaceTarball writes dir as a gzipped tarball whose entries are
+// rooted at prefix. Git metadata is left out: the clone's .git/config
+// holds the repository URL, credentials and all.
+func writeWorkspaceTarball(w io.Writer, dir, prefix string) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Name() == ".git" && path != dir {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		var link string
+		if info.Mode()&fs.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		} else if !info.Mode().IsRegular() && !info.IsDir() {
+			return nil
+		}
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(filepath.Join(prefix, rel))
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+func setWorkspaceRetentionHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	var settings WorkspaceRetention
+	if err := json.NewDecoder(r.Body).Decode(&settings); err != nil || settings.RepoUrl == "" {
+		http.Error(w, "Request must contain repoUrl and hours", http.StatusBadRequest)
+		return
+	}
+	if err := validateRepoURL(settings.RepoUrl); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if settings.Hours < 0 || settings.Hours > maxRetentionHours {
+		http.Error(w, "hours must be between 0 and 168", http.StatusBadRequest)
+		return
+	}
+	if err := saveWorkspaceRetention(settings.RepoUrl, settings.Hours); err != nil {
+		http.Error(w, "Could not save workspace retention", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(settings)
+}
+
+func getWorkspaceRetentionHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	repoURL := r.URL.Query().Get("repo")
+	if err := validateRepoURL(repoURL); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	hours, err := getWorkspaceRetention(repoURL)
+	if err != nil {
+		http.Error(w, "Could not get workspace retention", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(WorkspaceRetention{RepoUrl: repoURL, Hours: hours})
+}
+
+// workspaceHandler downloads a failed build's retained workspace as a
+// gzipped tarball, which needs the admin token.
+func workspaceHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if !authorizeAdmin(w, r) {
+		return
+	}
+	buildId := mux.Vars(r)["buildId"]
+	if !isWorkspaceRetained(buildId) {
+		http.Error(w, "No retained workspace for build", http.StatusNotFound)
+		return
+	}
+	dir := buildDir(buildId)
+	if _, err := os.Stat(dir); err != nil {
+		http.Error(w, "No retained workspace for build", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+buildId+`.tar.gz"`)
+	if err := writeWorkspaceTarball(w, dir, buildId); err != nil {
+		// The response has started, so the client sees a truncated
+		// archive rather than an error status.
+		log.Printf("Error archiving workspace of %s: %v", buildId, err)
+	}
+}
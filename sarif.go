@@ -0,0 +1,157 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// The parts of SARIF 2.1.0 needed to report a build's findings.
+type SarifLog struct {
+	Schema  string     `json:"$schema"`
+	Version string     `json:"version"`
+	Runs    []SarifRun `json:"runs"`
+}
+
+type SarifRun struct {
+	Tool    SarifTool     `json:"tool"`
+	Results []SarifResult `json:"results"`
+}
+
+type SarifTool struct {
+	Driver SarifDriver `json:"driver"`
+}
+
+type SarifDriver struct {
+	Name           string      `json:"name"`
+	InformationURI string      `json:"informationUri,omitempty"`
+	Rules          []SarifRule `json:"rules,omitempty"`
+}
+
+type SarifRule struct {
+	ID               string       `json:"id"`
+	ShortDescription SarifMessage `json:"shortDescription"`
+}
+
+type SarifResult struct {
+	RuleID    string          `json:"ruleId"`
+	Level     string          `json:"level"`
+	Message   SarifMessage    `json:"message"`
+	Locations []SarifLocation `json:"locations"`
+}
+
+type SarifMessage struct {
+	Text string `json:"text"`
+}
+
+type SarifLocation struct {
+	PhysicalLocation SarifPhysicalLocation `json:"physicalLocation"`
+}
+
+type SarifPhysicalLocation struct {
+	ArtifactLocation SarifArtifactLocation `json:"artifactLocation"`
+	Region           *SarifRegion          `json:"region,omitempty"`
+}
+
+type SarifArtifactLocation struct {
+	URI string `json:"uri"`
+}
+
+type SarifRegion struct {
+	StartLine int `json:"startLine"`
+}
+
+func sarifLocation(file string, line int) []SarifLocation {
+	location := SarifLocation{PhysicalLocation: SarifPhysicalLocation{ArtifactLocation: SarifArtifactLocation{URI: file}}}
+	if line > 0 {
+		location.PhysicalLocation.Region = &SarifRegion{StartLine: line}
+	}
+	return []SarifLocation{location}
+}
+
+func secretsSarifRun(findings []SecretFinding) SarifRun {
+	run := SarifRun{
+		Tool:    SarifTool{Driver: SarifDriver{Name: "gitleaks", InformationURI: "https://github.com/gitleaks/gitleaks"}},
+		Results: []SarifResult{},
+	}
+	seen := make(map[string]bool)
+	for _, f := range findings {
+		if !seen[f.RuleID] {
+			seen[f.RuleID] = true
+			run.Tool.Driver.Rules = append(run.Tool.Driver.Rules, SarifRule{ID: f.RuleID, ShortDescription: SarifMessage{Text: f.Description}})
+		}
+		level := "warning"
+		if f.HighConfidence() {
+			level = "error"
+		}
+		run.Results = append(run.Results, SarifResult{
+			RuleID:    f.RuleID,
+			Level:     level,
+			Message:   SarifMessage{Text: f.Description},
+			Locations: sarifLocation(f.File, f.StartLine),
+		})
+	}
+	return run
+}
+
+// baseImageSarifRun reports CVEs of pinned base images against the
+// Dockerfile, the only place in the source they can be fixed.
+func baseImageSarifRun(vulnerable []VulnerableBuild) SarifRun {
+	run := SarifRun{
+		Tool:    SarifTool{Driver: SarifDriver{Name: "docker-build-server base image advisories"}},
+		Results: []SarifResult{},
+	}
+	seen := make(map[string]bool)
+	for _, v := range vulnerable {
+		for _, cve := range v.CVEs {
+			if !seen[cve] {
+				seen[cve] = true
+				run.Tool.Driver.Rules = append(run.Tool.Driver.Rules, SarifRule{ID: cve, ShortDescription: SarifMessage{Text: cve}})
+			}
+			run.Results = append(run.Results, SarifResult{
+				RuleID:    cve,
+				Level:     "error",
+				Message:   SarifMessage{Text: "Base image " + v.Image + "@" + v.Digest + " is affected by " + cve},
+				Locations: sarifLocation("Dockerfile", 0),
+			})
+		}
+	}
+	return run
+}
+
+// sarifHandler exports a build's secret scan findings and base image
+// advisories as SARIF, for GitHub code scanning and similar tools.
+func sarifHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	buildId := mux.Vars(r)["buildId"]
+	sarif := SarifLog{
+		Schema:  "https://json.schemastore.org/sarif-2.1.0.json",
+		Version: "2.1.0",
+		Runs:    []SarifRun{},
+	}
+
+	findings, err := getSecretFindings(buildId)
+	if err != nil && err != sql.ErrNoRows {
+		http.Error(w, "Could not get secret scan findings", http.StatusInternalServerError)
+		return
+	}
+	if err == nil {
+		sarif.Runs = append(sarif.Runs, secretsSarifRun(findings))
+	}
+	vulnerable, err := getVulnerableBuilds(buildId)
+	if err != nil {
+		http.Error(w, "Could not get base image advisories", http.StatusInternalServerError)
+		return
+	}
+	if len(vulnerable) > 0 {
+		sarif.Runs = append(sarif.Runs, baseImageSarifRun(vulnerable))
+	}
+	if len(sarif.Runs) == 0 {
+		http.Error(w, "No scan results for build", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/sarif+json")
+	json.NewEncoder(w).Encode(sarif)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// schedulerInterval is how often due scheduled builds are queued.
+const schedulerInterval = 10 * time.Second
+
+type ScheduledBuild struct {
+	BuildId string    `json:"buildId"`
+	RepoUrl string    `json:"repoUrl"`
+	RunAt   time.Time `json:"runAt"`
+}
+
+// scheduleBuild stores req to be queued under buildId at req.RunAt.
+func scheduleBuild(buildId string, req BuildRequest) error {
+	runAt := req.RunAt.UTC()
+	req.RunAt = nil
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("INSERT INTO scheduled_builds (build_id, repo_url, request, run_at, status) VALUES (?, ?, ?, ?, 'scheduled')", buildId, req.RepoUrl, string(body), runAt)
+	return err
+}
+
+func getScheduledBuilds() ([]ScheduledBuild, error) {
+	rows, err := db.Query("SELECT build_id, repo_url, run_at FROM scheduled_builds WHERE status = 'scheduled' ORDER BY run_at")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	scheduled := []ScheduledBuild{}
+	for rows.Next() {
+		var s ScheduledBuild
+		if err := rows.Scan(&s.BuildId, &s.RepoUrl, &s.RunAt); err != nil {
+			return nil, err
+		}
+		scheduled = append(scheduled, s)
+	}
+	return scheduled, rows.Err()
+}
+
+// getScheduledStatus returns the repository, status and run time of a
+// scheduled build.
+func getScheduledStatus(buildId string) (repoURL, status string, runAt time.Time, err error) {
+	err = db.QueryRow("SELECT repo_url, status, run_at FROM scheduled_builds WHERE build_id = ?", buildId).Scan(&repoURL, &status, &runAt)
+	return repoURL, status, runAt, err
+}
+
+// setScheduledStatus moves a scheduled build from one status to another,
+// reporting whether it was in the expected status.
+func setScheduledStatus(buildId, from, to string) (bool, error) {
+	res, err := db.Exec("UPDATE scheduled_builds SET status = ? WHERE build_id = ? AND status = ?", to, buildId, from)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// queueDueBuilds queues every scheduled build whose time has come. Builds
+// that don't fit in the queue stay scheduled and are retried next tick.
+func queueDueBuilds() {
+	if buildsPaused() {
+		return
+	}
+	rows, err := db.Query("SELECT build_id, request FROM scheduled_builds WHERE status = 'scheduled' AND run_at <= ?", time.Now().UTC())
+	if err != nil {
+		log.Printf("Error getting due builds: %v", err)
+		return
+	}
+	due := make(map[string]string)
+	for rows.Next() {
+		var buildId, body string
+		if err := rows.Scan(&buildId, &body); err != nil {
+			log.Printf("Error reading scheduled build: %v", err)
+			continue
+		}
+		due[buildId] = body
+	}
+	rows.Close()
+
+	for buildId, body := range due {
+		var req BuildRequest
+		if err := json.Unmarshal([]byte(body), &req); err != nil {
+			log.Printf("Error decoding scheduled build %s: %v", buildId, err)
+			continue
+		}
+		// Claim the build first so a concurrent cancel can't race the start.
+		ok, err := setScheduledStatus(buildId, "scheduled", "started")
+		if err != nil || !ok {
+			continue
+		}
+		if !enqueueBuild(buildId, req) {
+			setScheduledStatus(buildId, "started", "scheduled")
+		}
+	}
+}
+
+func runScheduler() {
+	for range time.Tick(schedulerInterval) {
+		queueDueBuilds()
+	}
+}
+
+func cancelScheduledHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	buildId := mux.Vars(r)["buildId"]
+	ok, err := setScheduledStatus(buildId, "scheduled", "canceled")
+	if err != nil {
+		http.Error(w, "Could not cancel scheduled build", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, "No pending scheduled build with that ID", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
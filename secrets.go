@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Outcomes of a secret check.
+const (
+	SecretValid    = "valid"
+	SecretExpiring = "expiring"
+	SecretInvalid  = "invalid"
+	SecretSkipped  = "skipped"
+)
+
+// secretExpiryWarning is how close to its expiry a credential is
+// reported as expiring.
+const secretExpiryWarning = 7 * 24 * time.Hour
+
+const secretCheckTimeout = 30 * time.Second
+
+// SecretCheck is the result of exercising one credential a repository's
+// builds use.
+type SecretCheck struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Detail string `json:"detail,omitempty"`
+	// ExpiresAt is when the credential stops working, if the provider
+	// says.
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+}
+
+// SecretVerification reports which of a repository's credentials still
+// work. Valid is false if any of them is invalid.
+type SecretVerification struct {
+	RepoUrl   string        `json:"repoUrl"`
+	Valid     bool          `json:"valid"`
+	Checks    []SecretCheck `json:"checks"`
+	CheckedAt time.Time     `json:"checkedAt"`
+}
+
+// checkGitAuth lists the repository's refs the way a clone would, which
+// exercises credentials in the URL and the server's SSH keys.
+func checkGitAuth(repoURL string) SecretCheck {
+	check := SecretCheck{Name: "git"}
+	ctx, cancel := context.WithTimeout(context.Background(), secretCheckTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "git", "ls-remote", "--heads", "--", repoURL)
+	// Fail rather than wait for a password nobody will type.
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0", "GIT_SSH_COMMAND=ssh -o BatchMode=yes")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		check.Status = SecretInvalid
+		check.Detail = redact(strings.TrimSpace(string(out)))
+		if check.Detail == "" {
+			check.Detail = err.Error()
+		}
+		return check
+	}
+	check.Status = SecretValid
+	return check
+}
+
+// githubRepoPath matches the owner/name at the end of a GitHub clone URL.
+var githubRepoPath = regexp.MustCompile(`[:/]([^/:]+/[^/]+?)(\.git)?/?$`)
+
+// repoHost returns the host of a clone URL, including scp-like ones such
+// as git@host:org/app.
+func repoHost(repoURL string) string {
+	if strings.Contains(repoURL, "://") {
+		u, err := url.Parse(repoURL)
+		if err != nil {
+			return ""
+		}
+		return u.Hostname()
+	}
+	host, _, _ := strings.Cut(repoURL, ":")
+	if _, after, ok := strings.Cut(host, "@"); ok {
+		host = after
+	}
+	return host
+}
+
+// isGitHubRepo reports whether repoURL is on the GitHub instance whose API
+// the token is sent to: github.com, or the one GITHUB_API_URL points at.
+func isGitHubRepo(repoURL string) bool {
+	host := strings.ToLower(repoHost(repoURL))
+	api, err := url.Parse(githubAPIURL())
+	if err != nil {
+		return false
+	}
+	apiHost := strings.ToLower(api.Hostname())
+	return host != "" && (host == apiHost || "api."+host == apiHost)
+}
+
+// checkGitHubToken reads the repository with the webhook API token,
+// which pull request comments need. GitHub reports when personal access
+// tokens expire.
+func checkGitHubToken(repoURL, token string) SecretCheck {
+	check := SecretCheck{Name: "api-token"}
+	if !isGitHubRepo(repoURL) {
+		check.Status = SecretSkipped
+		check.Detail = repoURL + " is not on GitHub or the instance GITHUB_API_URL points at"
+		return check
+	}
+	m := githubRepoPath.FindStringSubmatch(repoURL)
+	if m == nil {
+		check.Status = SecretSkipped
+		check.Detail = "cannot tell the GitHub repository from " + repoURL
+		return check
+	}
+	resp, err := githubRequest(token, http.MethodGet, githubAPIURL()+"/repos/"+m[1], nil)
+	if err != nil {
+		check.Status = SecretInvalid
+		check.Detail = err.Error()
+		return check
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized:
+		check.Status = SecretInvalid
+		check.Detail = "GitHub rejected the token; it may have expired or been revoked"
+		return check
+	case http.StatusForbidden, http.StatusNotFound:
+		check.Status = SecretInvalid
+		check.Detail = "token cannot read " + m[1]
+		return check
+	default:
+		check.Status = SecretInvalid
+		check.Detail = "GitHub returned " + resp.Status
+		return check
+	}
+
+	check.Status = SecretValid
+	if exp := resp.Header.Get("GitHub-Authentication-Token-Expiration"); exp != "" {
+		if t, err := time.Parse("2006-01-02 15:04:05 MST", exp); err == nil {
+			check.ExpiresAt = &t
+			if time.Until(t) < secretExpiryWarning {
+				check.Status = SecretExpiring
+				check.Detail = fmt.Sprintf("token expires on %s", t.Format("2006-01-02"))
+			}
+		}
+	}
+	return check
+}
+
+// verifySecrets exercises each credential configured for repoURL without
+// building: git access, the webhook's API token and signing secret, and
+// the registry login, if set.
+func verifySecrets(repoURL string) (SecretVerification, error) {
+	v := SecretVerification{RepoUrl: repoURL, Valid: true, CheckedAt: time.Now().UTC()}
+	v.Checks = append(v.Checks, checkGitAuth(repoURL))
+
+	s, err := getWebhookSettings(repoURL)
+	if err != nil && err != sql.ErrNoRows {
+		return v, err
+	}
+	if s.Token != "" {
+		v.Checks = append(v.Checks, checkGitHubToken(repoURL, s.Token))
+	}
+	if s.Secret != "" {
+		// Only the provider can sign with it, so a mismatch shows up as
+		// rejected deliveries.
+		v.Checks = append(v.Checks, SecretCheck{Name: "webhook-secret", Status: SecretSkipped, Detail: "checked on each delivery"})
+	}
+	registry, err := getRegistrySettings(repoURL)
+	if err != nil && err != sql.ErrNoRows {
+		return v, err
+	}
+	if registry.Username != "" {
+		v.Checks = append(v.Checks, checkRegistryLogin(registry))
+	}
+	for _, c := range v.Checks {
+		if c.Status == SecretInvalid {
+			v.Valid = false
+		}
+	}
+	return v, nil
+}
+
+// verifySecretsHandler checks the credentials of ?repo= so expired or
+// revoked ones are found before a build needs them.
+func verifySecretsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	repoURL := r.URL.Query().Get("repo")
+	if repoURL == "" {
+		http.Error(w, "repo is required", http.StatusBadRequest)
+		return
+	}
+	if err := validateRepoURL(repoURL); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	v, err := verifySecrets(repoURL)
+	if err != nil {
+		http.Error(w, "Could not get repository settings", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// SecretFinding is a potential secret found in a build's source. The
+// matched secret itself is never stored.
+type SecretFinding struct {
+	RuleID      string  `json:"ruleId"`
+	Description string  `json:"description"`
+	File        string  `json:"file"`
+	StartLine   int     `json:"startLine"`
+	Entropy     float64 `json:"entropy"`
+}
+
+// HighConfidence reports whether the finding came from a rule for a
+// specific credential format rather than gitleaks' generic entropy rules.
+func (f SecretFinding) HighConfidence() bool {
+	return !strings.HasPrefix(f.RuleID, "generic")
+}
+
+// secretScanEnabled reports whether builds should scan their source for
+// secrets, which needs SECRET_SCAN set and gitleaks installed.
+func secretScanEnabled() bool {
+	if os.Getenv("SECRET_SCAN") == "" {
+		return false
+	}
+	_, err := exec.LookPath("gitleaks")
+	return err == nil
+}
+
+// scanSecrets runs gitleaks over the checked out files in repoDir.
+func scanSecrets(buildId, repoDir string) ([]SecretFinding, error) {
+	report, err := os.CreateTemp("", "gitleaks-*.json")
+	if err != nil {
+		return nil, err
+	}
+	report.Close()
+	defer os.Remove(report.Name())
+
+	cmd := exec.Command("gitleaks", "detect", "--no-git", "--no-banner", "--exit-code", "0",
+		"--source", repoDir, "--report-format", "json", "--report-path", report.Name())
+	if err := runCommand(buildId, cmd); err != nil {
+		return nil, fmt.Errorf("gitleaks: %v", err)
+	}
+
+	body, err := os.ReadFile(report.Name())
+	if err != nil {
+		return nil, err
+	}
+	findings := []SecretFinding{}
+	if err := json.Unmarshal(body, &findings); err != nil {
+		return nil, fmt.Errorf("could not parse gitleaks report: %v", err)
+	}
+	for i := range findings {
+		if rel, err := filepath.Rel(repoDir, findings[i].File); err == nil {
+			findings[i].File = rel
+		}
+	}
+	return findings, nil
+}
+
+// checkSecretFindings fails the build on high-confidence findings when
+// SECRET_SCAN_FAIL is set.
+func checkSecretFindings(findings []SecretFinding) error {
+	if os.Getenv("SECRET_SCAN_FAIL") == "" {
+		return nil
+	}
+	var leaks []string
+	for _, f := range findings {
+		if f.HighConfidence() {
+			leaks = append(leaks, fmt.Sprintf("%s (%s:%d)", f.RuleID, f.File, f.StartLine))
+		}
+	}
+	if len(leaks) > 0 {
+		return fmt.Errorf("source contains secrets: %s", strings.Join(leaks, ", "))
+	}
+	return nil
+}
+
+func saveSecretFindings(buildId string, findings []SecretFinding) error {
+	body, err := json.Marshal(findings)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("INSERT INTO build_secret_findings (build_id, findings) VALUES (?, ?)", buildId, string(body))
+	return err
+}
+
+func getSecretFindings(buildId string) ([]SecretFinding, error) {
+	var body string
+	if err := db.QueryRow("SELECT findings FROM build_secret_findings WHERE build_id = ?", buildId).Scan(&body); err != nil {
+		return nil, err
+	}
+	var findings []SecretFinding
+	err := json.Unmarshal([]byte(body), &findings)
+	return findings, err
+}
+
+func secretFindingsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	findings, err := getSecretFindings(mux.Vars(r)["buildId"])
+	if err == sql.ErrNoRows {
+		http.Error(w, "No secret scan for build", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Could not get secret scan findings", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(findings)
+}
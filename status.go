@@ -0,0 +1,139 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// EventBuildQueued is published when a build is accepted into the queue.
+const EventBuildQueued = "build.queued"
+
+// Build states reported by the status API. Scheduled builds that have not
+// been queued yet are "scheduled" or "canceled".
+const (
+	StateQueued    = "queued"
+	StateStarting  = "starting"
+	StateCloning   = "cloning"
+	StateScanning  = "scanning"
+	StateBuilding  = "building"
+	StatePushing   = "pushing"
+	StateSucceeded = "succeeded"
+	StateFailed    = "failed"
+)
+
+// stageStates maps build stages to the state a build is in during them.
+var stageStates = map[string]string{
+	"clone":        StateCloning,
+	"secret-scan":  StateScanning,
+	"build":        StateBuilding,
+	"license-scan": StateScanning,
+	"policy":       StateScanning,
+	"push":         StatePushing,
+}
+
+type BuildStatus struct {
+	BuildId    string     `json:"buildId"`
+	RepoUrl    string     `json:"repoUrl,omitempty"`
+	State      string     `json:"state"`
+	Stage      string     `json:"stage,omitempty"`
+	Error      string     `json:"error,omitempty"`
+	RunAt      *time.Time `json:"runAt,omitempty"`
+	QueuedAt   *time.Time `json:"queuedAt,omitempty"`
+	StartedAt  *time.Time `json:"startedAt,omitempty"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+	// PolicyViolations say how a build failed the policy.
+	PolicyViolations []PolicyViolation `json:"policyViolations,omitempty"`
+	// ImageSizes break down the images of a build checked against size
+	// limits.
+	ImageSizes []ImageSizeReport `json:"imageSizes,omitempty"`
+	// PushedImages are where a build's images were pushed.
+	PushedImages []PushedImage `json:"pushedImages,omitempty"`
+	// Build holds the details of a successful build.
+	Build *BuildResponse `json:"build,omitempty"`
+}
+
+// recordBuildStatus keeps build_status in step with each build's
+// lifecycle.
+func recordBuildStatus(e Event) {
+	now := time.Now().UTC()
+	var err error
+	switch e.Type {
+	case EventBuildQueued:
+		err = store.QueueBuild(e.BuildId, e.RepoUrl, now)
+	case EventBuildStarted:
+		err = store.StartBuild(e.BuildId, e.RepoUrl, now)
+	case EventStageStarted:
+		state, ok := stageStates[e.Stage]
+		if !ok {
+			return
+		}
+		err = store.SetStage(e.BuildId, state, e.Stage)
+	case EventBuildSucceeded:
+		err = store.FinishBuild(e.BuildId, StateSucceeded, "", now)
+	case EventBuildFailed:
+		err = store.FinishBuild(e.BuildId, StateFailed, redact(e.Err.Error()), now)
+	default:
+		return
+	}
+	if err != nil {
+		log.Printf("Error recording status of build %s: %v", e.BuildId, err)
+	}
+}
+
+// getBuildStatus looks a build up among tracked, scheduled and, for
+// builds that finished before status was tracked, successful builds.
+func getBuildStatus(buildId string) (BuildStatus, error) {
+	status, err := store.GetStatus(buildId)
+	if err == sql.ErrNoRows {
+		var runAt time.Time
+		status.RepoUrl, status.State, runAt, err = getScheduledStatus(buildId)
+		if err == nil {
+			status.RunAt = &runAt
+		} else if err == sql.ErrNoRows {
+			status.State, err = StateSucceeded, nil
+		}
+	}
+	if err != nil {
+		return status, err
+	}
+
+	if status.State == StateFailed {
+		if status.PolicyViolations, err = getPolicyViolations(buildId); err != nil && err != sql.ErrNoRows {
+			return status, err
+		}
+	}
+	if status.ImageSizes, err = getImageSizeReports(buildId); err != nil && err != sql.ErrNoRows {
+		return status, err
+	}
+	if status.PushedImages, err = getPushedImages(buildId); err != nil && err != sql.ErrNoRows {
+		return status, err
+	}
+	if status.State == StateSucceeded {
+		build, err := getBuild(buildId)
+		if err != nil {
+			return status, err
+		}
+		status.RepoUrl = build.RepoUrl
+		status.Build = &build
+	}
+	return status, nil
+}
+
+func buildStatusHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	status, err := getBuildStatus(mux.Vars(r)["buildId"])
+	if err == sql.ErrNoRows {
+		http.Error(w, "Build not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Could not get build status", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(status)
+}
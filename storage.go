@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// RepoStorage is the disk used on behalf of one repository.
+type RepoStorage struct {
+	RepoUrl     string `json:"repoUrl"`
+	MirrorBytes int64  `json:"mirrorBytes"`
+	ImageBytes  int64  `json:"imageBytes"`
+	Images      int    `json:"images"`
+	TotalBytes  int64  `json:"totalBytes"`
+}
+
+type StorageReport struct {
+	Repos      []RepoStorage `json:"repos"`
+	TotalBytes int64         `json:"totalBytes"`
+}
+
+// dirSize sums the size of every regular file under dir.
+func dirSize(dir string) int64 {
+	var size int64
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+// imageSize returns the size of a local image, or false if it no longer
+// exists.
+func imageSize(image string) (int64, bool) {
+	out, err := exec.Command("docker", "image", "inspect", "--format", "{{.Size}}", image).Output()
+	if err != nil {
+		return 0, false
+	}
+	size, err := strconv.ParseInt(strings.TrimSpace(string(out)), 10, 64)
+	return size, err == nil
+}
+
+// repoStorage measures the disk used on behalf of repo: its mirror and
+// those of images that still exist.
+func repoStorage(repo string, images []string) RepoStorage {
+	usage := RepoStorage{RepoUrl: repo}
+	if mirrorDir != "" {
+		usage.MirrorBytes = dirSize(mirrorPath(repo))
+	}
+	for _, image := range images {
+		if size, ok := imageSize(image); ok {
+			usage.ImageBytes += size
+			usage.Images++
+		}
+	}
+	usage.TotalBytes = usage.MirrorBytes + usage.ImageBytes
+	return usage
+}
+
+// storageHandler reports disk usage per repository, optionally limited to
+// one with ?repo=.
+func storageHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	images, err := store.BuiltImages(r.URL.Query().Get("repo"))
+	if err != nil {
+		http.Error(w, "Could not get builds", http.StatusInternalServerError)
+		return
+	}
+
+	report := StorageReport{Repos: []RepoStorage{}}
+	for repo, repoImages := range images {
+		usage := repoStorage(repo, repoImages)
+		report.TotalBytes += usage.TotalBytes
+		report.Repos = append(report.Repos, usage)
+	}
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+)
+
+// BuildStore records builds and their progress. Settings and per-build
+// records of other features live in their own tables, next to the code
+// that uses them.
+type BuildStore interface {
+	// SaveBuild records a successful build.
+	SaveBuild(e Event) error
+	// GetBuild returns a successful build, or sql.ErrNoRows.
+	GetBuild(buildId string) (BuildResponse, error)
+	// LastBuild returns the most recent successful build.
+	LastBuild() (BuildResponse, error)
+	// LastBranchBuild returns the most recent successful build of
+	// repoURL's branch, leaving out pull requests, or sql.ErrNoRows.
+	LastBranchBuild(repoURL, branch string) (BuildResponse, error)
+	// BuiltImages maps each repository, or only repoURL if it is given,
+	// to the distinct images built from it.
+	BuiltImages(repoURL string) (map[string][]string, error)
+
+	QueueBuild(buildId, repoURL string, at time.Time) error
+	StartBuild(buildId, repoURL string, at time.Time) error
+	SetStage(buildId, state, stage string) error
+	// FinishBuild records the final state of a build, with errMsg if it
+	// failed.
+	FinishBuild(buildId, state, errMsg string, at time.Time) error
+	// GetStatus returns the tracked status of a build, or sql.ErrNoRows.
+	GetStatus(buildId string) (BuildStatus, error)
+	// History lists tracked builds newest first, only those of repoURL
+	// or in state when they are given.
+	History(repoURL, state string, limit, offset int) (BuildHistory, error)
+}
+
+// store holds build records, set up by initDB.
+var store BuildStore
+
+// sqliteBuildStore keeps builds in the builds and build_status tables.
+type sqliteBuildStore struct {
+	db *sql.DB
+}
+
+func (s sqliteBuildStore) SaveBuild(e Event) error {
+	overrides, err := encodeJSONColumn(e.Overrides)
+	if err != nil {
+		return err
+	}
+	parameters, err := encodeJSONColumn(e.Parameters)
+	if err != nil {
+		return err
+	}
+	changed, err := encodeJSONColumn(e.ChangedFiles)
+	if err != nil {
+		return err
+	}
+	compression, err := encodeJSONColumn(e.Compression)
+	if err != nil {
+		return err
+	}
+	images, err := encodeJSONColumn(e.Images)
+	if err != nil {
+		return err
+	}
+	var committedAt sql.NullTime
+	if !e.Commit.CommittedAt.IsZero() {
+		committedAt = sql.NullTime{Time: e.Commit.CommittedAt, Valid: true}
+	}
+	_, err = s.db.Exec("INSERT INTO builds (id, repo_url, branch, commit_id, image, image_digest, overrides, parameters, commit_author, commit_author_email, commit_message, committed_at, base_commit, changed_files, compression, images) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		e.BuildId, e.RepoUrl, e.Branch, e.CommitID, e.Image, e.ImageDigest, overrides, parameters, e.Commit.Author, e.Commit.AuthorEmail, e.Commit.Message, committedAt, e.BaseCommit, changed, compression, images)
+	return err
+}
+
+// buildColumns are the builds columns scanBuild reads, in order.
+const buildColumns = "id, repo_url, commit_id, image, image_digest, overrides, parameters, commit_author, commit_author_email, commit_message, committed_at, base_commit, changed_files, compression, images"
+
+func scanBuild(row rowScanner) (BuildResponse, error) {
+	var build BuildResponse
+	var overrides, parameters, changed, compression, images string
+	var commit CommitInfo
+	var committedAt sql.NullTime
+	err := row.Scan(&build.BuildId, &build.RepoUrl, &build.CommitID, &build.Image, &build.ImageDigest, &overrides, &parameters, &commit.Author, &commit.AuthorEmail, &commit.Message, &committedAt, &build.BaseCommit, &changed, &compression, &images)
+	if err != nil {
+		return build, err
+	}
+	if committedAt.Valid {
+		commit.CommittedAt = committedAt.Time
+		build.Commit = &commit
+	}
+	if err := decodeJSONColumn(overrides, &build.Overrides); err != nil {
+		return build, err
+	}
+	if err := decodeJSONColumn(parameters, &build.Parameters); err != nil {
+		return build, err
+	}
+	if err := decodeJSONColumn(changed, &build.ChangedFiles); err != nil {
+		return build, err
+	}
+	if err := decodeJSONColumn(compression, &build.Compression); err != nil {
+		return build, err
+	}
+	if err := decodeJSONColumn(images, &build.Images); err != nil {
+		return build, err
+	}
+	return build, nil
+}
+
+func (s sqliteBuildStore) GetBuild(buildId string) (BuildResponse, error) {
+	return scanBuild(s.db.QueryRow("SELECT "+buildColumns+" FROM builds WHERE id = ?", buildId))
+}
+
+func (s sqliteBuildStore) LastBuild() (BuildResponse, error) {
+	return scanBuild(s.db.QueryRow("SELECT " + buildColumns + " FROM builds ORDER BY timestamp DESC LIMIT 1"))
+}
+
+func (s sqliteBuildStore) LastBranchBuild(repoURL, branch string) (BuildResponse, error) {
+	// Pull request builds are not on the branch later builds compare with.
+	return scanBuild(s.db.QueryRow("SELECT "+buildColumns+" FROM builds WHERE repo_url = ? AND branch = ? AND id NOT IN (SELECT build_id FROM pull_request_builds) ORDER BY timestamp DESC LIMIT 1", repoURL, branch))
+}
+
+func (s sqliteBuildStore) BuiltImages(repoURL string) (map[string][]string, error) {
+	query := "SELECT DISTINCT repo_url, image FROM builds"
+	var args []interface{}
+	if repoURL != "" {
+		query += " WHERE repo_url = ?"
+		args = append(args, repoURL)
+	}
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	images := make(map[string][]string)
+	for rows.Next() {
+		var repo, image string
+		if err := rows.Scan(&repo, &image); err != nil {
+			return nil, err
+		}
+		images[repo] = append(images[repo], image)
+	}
+	return images, rows.Err()
+}
+
+func (s sqliteBuildStore) QueueBuild(buildId, repoURL string, at time.Time) error {
+	_, err := s.db.Exec("INSERT OR IGNORE INTO build_status (build_id, repo_url, state, queued_at) VALUES (?, ?, ?, ?)",
+		buildId, repoURL, StateQueued, at)
+	return err
+}
+
+func (s sqliteBuildStore) StartBuild(buildId, repoURL string, at time.Time) error {
+	_, err := s.db.Exec(`INSERT INTO build_status (build_id, repo_url, state, started_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT (build_id) DO UPDATE SET state = excluded.state, started_at = excluded.started_at`,
+		buildId, repoURL, StateStarting, at)
+	return err
+}
+
+func (s sqliteBuildStore) SetStage(buildId, state, stage string) error {
+	_, err := s.db.Exec("UPDATE build_status SET state = ?, stage = ? WHERE build_id = ?", state, stage, buildId)
+	return err
+}
+
+func (s sqliteBuildStore) FinishBuild(buildId, state, errMsg string, at time.Time) error {
+	_, err := s.db.Exec("UPDATE build_status SET state = ?, error = ?, finished_at = ? WHERE build_id = ?", state, errMsg, at, buildId)
+	return err
+}
+
+func nullTime(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
+
+func (s sqliteBuildStore) GetStatus(buildId string) (BuildStatus, error) {
+	status := BuildStatus{BuildId: buildId}
+	var stage, errMsg sql.NullString
+	var queuedAt, startedAt, finishedAt sql.NullTime
+	err := s.db.QueryRow("SELECT repo_url, state, stage, error, queued_at, started_at, finished_at FROM build_status WHERE build_id = ?", buildId).
+		Scan(&status.RepoUrl, &status.State, &stage, &errMsg, &queuedAt, &startedAt, &finishedAt)
+	status.Stage, status.Error = stage.String, errMsg.String
+	status.QueuedAt, status.StartedAt, status.FinishedAt = nullTime(queuedAt), nullTime(startedAt), nullTime(finishedAt)
+	return status, err
+}
+
+const historyColumns = `s.build_id, s.repo_url, s.state, COALESCE(b.commit_id, ''), COALESCE(b.image, ''),
+    COALESCE(b.commit_author, ''), COALESCE(b.commit_author_email, ''), COALESCE(b.commit_message, ''), b.committed_at,
+    COALESCE(s.error, ''), s.queued_at, s.started_at, s.finished_at, t.trigger`
+
+// historyFilter matches every build when the repository or state given
+// is empty.
+const historyFilter = `FROM build_status s LEFT JOIN builds b ON b.id = s.build_id
+    LEFT JOIN build_triggers t ON t.build_id = s.build_id
+    WHERE (? = '' OR s.repo_url = ?) AND (? = '' OR s.state = ?)`
+
+func (s sqliteBuildStore) History(repoURL, state string, limit, offset int) (BuildHistory, error) {
+	history := BuildHistory{Builds: []BuildSummary{}, Limit: limit, Offset: offset}
+	filters := []interface{}{repoURL, repoURL, state, state}
+	err := s.db.QueryRow("SELECT COUNT(*) "+historyFilter, filters...).Scan(&history.Total)
+	if err != nil {
+		return history, err
+	}
+
+	rows, err := s.db.Query("SELECT "+historyColumns+" "+historyFilter+
+		" ORDER BY COALESCE(s.queued_at, s.started_at, s.finished_at) DESC LIMIT ? OFFSET ?", append(filters, limit, offset)...)
+	if err != nil {
+		return history, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var b BuildSummary
+		var commit CommitInfo
+		var committedAt, queuedAt, startedAt, finishedAt sql.NullTime
+		var trigger sql.NullString
+		err := rows.Scan(&b.BuildId, &b.RepoUrl, &b.Status, &b.CommitID, &b.Image,
+			&commit.Author, &commit.AuthorEmail, &commit.Message, &committedAt,
+			&b.Error, &queuedAt, &startedAt, &finishedAt, &trigger)
+		if err != nil {
+			return history, err
+		}
+		if trigger.Valid {
+			b.Trigger = &Trigger{}
+			if err := json.Unmarshal([]byte(trigger.String), b.Trigger); err != nil {
+				return history, err
+			}
+		}
+		if committedAt.Valid {
+			commit.CommittedAt = committedAt.Time
+			b.Commit = &commit
+		}
+		b.QueuedAt, b.StartedAt, b.FinishedAt = nullTime(queuedAt), nullTime(startedAt), nullTime(finishedAt)
+		if b.StartedAt != nil && b.FinishedAt != nil {
+			d := b.FinishedAt.Sub(*b.StartedAt).Seconds()
+			b.DurationSeconds = &d
+		}
+		history.Builds = append(history.Builds, b)
+	}
+	return history, rows.Err()
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+// States of a build's logs websocket.
+const (
+	StreamNeverConnected = "never-connected"
+	StreamConnected      = "connected"
+	StreamDisconnected   = "disconnected"
+)
+
+// StreamState records whether anyone was following a build's logs
+// websocket, and how many log lines were streamed to nobody.
+type StreamState struct {
+	State          string     `json:"state"`
+	ConnectedAt    *time.Time `json:"connectedAt,omitempty"`
+	DisconnectedAt *time.Time `json:"disconnectedAt,omitempty"`
+	Lines          int        `json:"lines"`
+	MissedLines    int        `json:"missedLines"`
+}
+
+// streamStates holds the stream state of running builds, guarded by mu
+// along with clients.
+var streamStates = make(map[string]*StreamState)
+
+// trackStream starts and finishes a build's stream state. A build's
+// final state is stored once it finishes, with a warning in its log if
+// some of the output was never streamed.
+func trackStream(e Event) {
+	switch e.Type {
+	case EventBuildStarted:
+		mu.Lock()
+		st := &StreamState{State: StreamNeverConnected}
+		// The client may have connected while the build was queued.
+		if _, ok := clients[e.BuildId]; ok {
+			now := time.Now().UTC()
+			st.State, st.ConnectedAt = StreamConnected, &now
+		}
+		streamStates[e.BuildId] = st
+		mu.Unlock()
+	case EventBuildSucceeded, EventBuildFailed:
+		mu.Lock()
+		st, ok := streamStates[e.BuildId]
+		delete(streamStates, e.BuildId)
+		mu.Unlock()
+		if !ok {
+			return
+		}
+		if st.MissedLines > 0 {
+			client := "never connected"
+			if st.ConnectedAt != nil {
+				client = "connected at " + st.ConnectedAt.Format(time.RFC3339)
+			}
+			if st.DisconnectedAt != nil {
+				client += ", disconnected at " + st.DisconnectedAt.Format(time.RFC3339)
+			}
+			ts := time.Now().UTC().Format("2006-01-02T15:04:05.000Z07:00")
+			appendLog(e.BuildId, fmt.Sprintf("%s ==> WARNING %d of %d log lines were not streamed to a websocket client (client %s)\n", ts, st.MissedLines, st.Lines, client))
+		}
+		_, err := db.Exec("INSERT OR REPLACE INTO build_streams (build_id, state, connected_at, disconnected_at, lines, missed_lines) VALUES (?, ?, ?, ?, ?, ?)",
+			e.BuildId, st.State, st.ConnectedAt, st.DisconnectedAt, st.Lines, st.MissedLines)
+		if err != nil {
+			log.Printf("Error saving stream state of %s: %v", e.BuildId, err)
+		}
+	}
+}
+
+// countStreamedLine records that a log line of buildId was, or with no
+// client was not, streamed. mu must be held.
+func countStreamedLine(buildId string, streamed bool) {
+	if st, ok := streamStates[buildId]; ok {
+		st.Lines++
+		if !streamed {
+			st.MissedLines++
+		}
+	}
+}
+
+// clientConnected records that a client started following buildId. mu
+// must be held.
+func clientConnected(buildId string) {
+	if st, ok := streamStates[buildId]; ok {
+		now := time.Now().UTC()
+		st.State, st.ConnectedAt, st.DisconnectedAt = StreamConnected, &now, nil
+	}
+}
+
+// dropClient forgets buildId's client after it went away or a write to
+// it failed. mu must be held.
+func dropClient(buildId string, conn *websocket.Conn) {
+	if clients[buildId] != conn {
+		return
+	}
+	conn.Close()
+	delete(clients, buildId)
+	if st, ok := streamStates[buildId]; ok {
+		now := time.Now().UTC()
+		st.State, st.DisconnectedAt = StreamDisconnected, &now
+	}
+}
+
+// watchClient reads from conn until the client goes away, since a
+// connection that is only written to never notices being closed.
+func watchClient(buildId string, conn *websocket.Conn) {
+	for {
+		if _, _, err := conn.NextReader(); err != nil {
+			break
+		}
+	}
+	mu.Lock()
+	dropClient(buildId, conn)
+	mu.Unlock()
+}
+
+func getStreamState(buildId string) (*StreamState, error) {
+	mu.Lock()
+	if st, ok := streamStates[buildId]; ok {
+		state := *st
+		mu.Unlock()
+		return &state, nil
+	}
+	mu.Unlock()
+
+	var st StreamState
+	var connectedAt, disconnectedAt sql.NullTime
+	err := db.QueryRow("SELECT state, connected_at, disconnected_at, lines, missed_lines FROM build_streams WHERE build_id = ?", buildId).
+		Scan(&st.State, &connectedAt, &disconnectedAt, &st.Lines, &st.MissedLines)
+	if err != nil {
+		return nil, err
+	}
+	if connectedAt.Valid {
+		st.ConnectedAt = &connectedAt.Time
+	}
+	if disconnectedAt.Valid {
+		st.DisconnectedAt = &disconnectedAt.Time
+	}
+	return &st, nil
+}
+
+func streamStateHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	st, err := getStreamState(mux.Vars(r)["buildId"])
+	if err == sql.ErrNoRows {
+		http.Error(w, "No stream state for build", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Could not get stream state", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(st)
+}
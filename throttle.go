@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Events published when daemon throttling engages or is lifted.
+const (
+	EventDaemonThrottled = "daemon.throttled"
+	EventDaemonRecovered = "daemon.recovered"
+)
+
+const (
+	// Consecutive probes needed before throttling harder or easing off,
+	// so a single slow response doesn't change parallelism.
+	throttleAfterProbes = 2
+	recoverAfterProbes  = 5
+	// minDockerRootFree is the share of the Docker root filesystem that
+	// must stay free before the daemon counts as under storage pressure.
+	minDockerRootFree = 0.10
+)
+
+// probeDaemon checks whether the Docker daemon is saturated: its API
+// erroring or answering slower than slow, or the filesystem holding its
+// image layers nearly full. It returns why, or "" if it is healthy.
+func probeDaemon(slow time.Duration) string {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*slow)
+	defer cancel()
+	start := time.Now()
+	out, err := exec.CommandContext(ctx, "docker", "info", "--format", "{{.DockerRootDir}}").Output()
+	elapsed := time.Since(start)
+	if ctx.Err() != nil {
+		return fmt.Sprintf("docker API timed out after %s", 2*slow)
+	}
+	if err != nil {
+		return fmt.Sprintf("docker API failed: %v", err)
+	}
+	if elapsed > slow {
+		return fmt.Sprintf("docker API took %s", elapsed.Round(time.Millisecond))
+	}
+	// The root is only visible when the daemon runs on this host.
+	if root := strings.TrimSpace(string(out)); root != "" {
+		if total, free := diskSpace(root); total > 0 && float64(free)/float64(total) < minDockerRootFree {
+			return fmt.Sprintf("%s is %.0f%% full", root, 100-100*float64(free)/float64(total))
+		}
+	}
+	return ""
+}
+
+// runDaemonThrottle probes the daemon every interval. While it stays
+// saturated the number of concurrent builds is halved, down to one; once
+// it has been healthy for a while builds are let back in one at a time.
+func runDaemonThrottle(interval, slow time.Duration) {
+	var unhealthy, healthy int
+	for range time.Tick(interval) {
+		reason := probeDaemon(slow)
+		if reason != "" {
+			unhealthy, healthy = unhealthy+1, 0
+		} else {
+			unhealthy, healthy = 0, healthy+1
+		}
+
+		limit, concurrency := queue.Limit()
+		switch {
+		case unhealthy >= throttleAfterProbes && limit > 1:
+			unhealthy = 0
+			limit = queue.SetLimit(limit/2, reason)
+			log.Printf("Docker daemon saturated (%s), running at most %d of %d builds", reason, limit, concurrency)
+			bus.Publish(Event{Type: EventDaemonThrottled, Err: fmt.Errorf("%s", reason), Concurrency: limit})
+		case healthy >= recoverAfterProbes && limit < concurrency:
+			healthy = 0
+			limit = queue.SetLimit(limit+1, "recovering from daemon saturation")
+			log.Printf("Docker daemon healthy, running at most %d of %d builds", limit, concurrency)
+			if limit == concurrency {
+				bus.Publish(Event{Type: EventDaemonRecovered, Concurrency: limit})
+			}
+		}
+	}
+}
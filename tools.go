@@ -0,0 +1,127 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// ToolVersions records the host tooling a build ran with.
+type ToolVersions struct {
+	Git    string `json:"git"`
+	Docker string `json:"docker"`
+	Buildx string `json:"buildx"`
+}
+
+var versionPattern = regexp.MustCompile(`\d+(\.\d+)+`)
+
+// toolVersion runs a version command and extracts the first dotted version
+// number from its output.
+func toolVersion(name string, args ...string) (string, error) {
+	out, err := exec.Command(name, args...).Output()
+	if err != nil {
+		return "", fmt.Errorf("%s: %v", name, err)
+	}
+	v := versionPattern.FindString(string(out))
+	if v == "" {
+		return "", fmt.Errorf("could not parse %s version from %q", name, strings.TrimSpace(string(out)))
+	}
+	return v, nil
+}
+
+func detectToolVersions() (ToolVersions, error) {
+	var tools ToolVersions
+	var err error
+	if tools.Git, err = toolVersion("git", "--version"); err != nil {
+		return tools, err
+	}
+	if tools.Docker, err = toolVersion("docker", "version", "--format", "{{.Server.Version}}"); err != nil {
+		return tools, err
+	}
+	if tools.Buildx, err = toolVersion("docker", "buildx", "version"); err != nil {
+		return tools, err
+	}
+	return tools, nil
+}
+
+// compareVersions compares dotted version strings numerically, returning
+// -1, 0 or 1.
+func compareVersions(a, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y int
+		if i < len(as) {
+			x, _ = strconv.Atoi(as[i])
+		}
+		if i < len(bs) {
+			y, _ = strconv.Atoi(bs[i])
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// checkToolVersions fails if the host tooling is older than the minimums
+// set in MIN_GIT_VERSION, MIN_DOCKER_VERSION and MIN_BUILDX_VERSION.
+func checkToolVersions(tools ToolVersions) error {
+	requirements := []struct{ name, have, env string }{
+		{"git", tools.Git, "MIN_GIT_VERSION"},
+		{"docker", tools.Docker, "MIN_DOCKER_VERSION"},
+		{"buildx", tools.Buildx, "MIN_BUILDX_VERSION"},
+	}
+	for _, req := range requirements {
+		if err := checkToolVersion(req.name, req.have, req.env); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkToolVersion fails if version have of a tool is older than the
+// minimum set in the environment variable env.
+func checkToolVersion(name, have, env string) error {
+	min := os.Getenv(env)
+	if min != "" && compareVersions(have, min) < 0 {
+		return fmt.Errorf("%s %s is installed but at least %s is required", name, have, min)
+	}
+	return nil
+}
+
+func saveToolVersions(buildId string, tools ToolVersions) error {
+	_, err := db.Exec("INSERT INTO build_tools (build_id, git, docker, buildx) VALUES (?, ?, ?, ?)", buildId, tools.Git, tools.Docker, tools.Buildx)
+	return err
+}
+
+func getToolVersions(buildId string) (ToolVersions, error) {
+	var tools ToolVersions
+	err := db.QueryRow("SELECT git, docker, buildx FROM build_tools WHERE build_id = ?", buildId).Scan(&tools.Git, &tools.Docker, &tools.Buildx)
+	return tools, err
+}
+
+func buildToolsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	buildId := mux.Vars(r)["buildId"]
+	tools, err := getToolVersions(buildId)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Build not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Could not get tool versions", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(tools)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// Trigger sources.
+const (
+	TriggerAPI        = "api"
+	TriggerSchedule   = "schedule"
+	TriggerBatch      = "batch"
+	TriggerDependency = "dependency"
+	TriggerBaseImage  = "base-image"
+	TriggerWebhook    = "webhook"
+)
+
+// Trigger records how a build was started.
+type Trigger struct {
+	Source string `json:"source"`
+	// Client is the address of the API caller that requested the build.
+	Client  string `json:"client,omitempty"`
+	BatchId string `json:"batchId,omitempty"`
+	// UpstreamRepo and UpstreamBuildId identify the build whose success
+	// triggered a dependency build.
+	UpstreamRepo    string `json:"upstreamRepo,omitempty"`
+	UpstreamBuildId string `json:"upstreamBuildId,omitempty"`
+	// BaseImage is the base image whose update triggered a rebuild.
+	BaseImage string `json:"baseImage,omitempty"`
+	// Provider and DeliveryId identify the webhook delivery that
+	// triggered a build.
+	Provider   string `json:"provider,omitempty"`
+	DeliveryId string `json:"deliveryId,omitempty"`
+	// PullRequest is the number of the pull request a build is for.
+	PullRequest int `json:"pullRequest,omitempty"`
+}
+
+func saveTrigger(buildId string, trigger *Trigger) error {
+	if trigger == nil {
+		return nil
+	}
+	body, err := json.Marshal(trigger)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("INSERT OR REPLACE INTO build_triggers (build_id, trigger) VALUES (?, ?)", buildId, string(body))
+	return err
+}
+
+func getTrigger(buildId string) (*Trigger, error) {
+	var body string
+	err := db.QueryRow("SELECT trigger FROM build_triggers WHERE build_id = ?", buildId).Scan(&body)
+	if err != nil {
+		return nil, err
+	}
+	var trigger Trigger
+	err = json.Unmarshal([]byte(body), &trigger)
+	return &trigger, err
+}
+
+func triggerHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	trigger, err := getTrigger(mux.Vars(r)["buildId"])
+	if err == sql.ErrNoRows {
+		http.Error(w, "No trigger recorded for build", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Could not get build trigger", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(trigger)
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// skipMarkers in a commit message skip the build whatever the filters.
+var skipMarkers = []string{"[skip ci]", "[ci skip]", "[skip build]"}
+
+// botAuthors match the names and emails of dependency update bots, whose
+// commits are not built unless a repository opts in.
+var botAuthors = regexp.MustCompile(`(?i)\[bot\]|^(dependabot|renovate)\b`)
+
+// TriggerFilters decide which pushed commits of a repository are built.
+type TriggerFilters struct {
+	RepoUrl string `json:"repoUrl"`
+	// AllowBots builds commits by dependency update bots such as
+	// dependabot, which are otherwise skipped.
+	AllowBots bool `json:"allowBots"`
+	// IgnoreAuthors are regular expressions matched against the commit
+	// author's name and email.
+	IgnoreAuthors []string `json:"ignoreAuthors,omitempty"`
+	// IgnoreMessages are regular expressions matched against the commit
+	// message.
+	IgnoreMessages []string `json:"ignoreMessages,omitempty"`
+}
+
+// SkippedTrigger records a commit that was not built and why.
+type SkippedTrigger struct {
+	RepoUrl   string    `json:"repoUrl"`
+	Source    string    `json:"source"`
+	CommitID  string    `json:"commitId"`
+	Author    string    `json:"author"`
+	Message   string    `json:"message"`
+	Reason    string    `json:"reason"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+func validateTriggerFilters(f TriggerFilters) error {
+	for _, pattern := range append(f.IgnoreAuthors, f.IgnoreMessages...) {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return fmt.Errorf("invalid pattern %q: %v", pattern, err)
+		}
+	}
+	return nil
+}
+
+func getTriggerFilters(repoURL string) (TriggerFilters, error) {
+	f := TriggerFilters{RepoUrl: repoURL}
+	var body string
+	err := db.QueryRow("SELECT filters FROM trigger_filters WHERE repo_url = ?", repoURL).Scan(&body)
+	if err == sql.ErrNoRows {
+		return f, nil
+	}
+	if err != nil {
+		return f, err
+	}
+	err = json.Unmarshal([]byte(body), &f)
+	return f, err
+}
+
+func saveTriggerFilters(f TriggerFilters) error {
+	body, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("INSERT OR REPLACE INTO trigger_filters (repo_url, filters) VALUES (?, ?)", f.RepoUrl, string(body))
+	return err
+}
+
+// triggerSkipReason says why a pushed commit should not be built, or
+// returns "" if it should.
+func triggerSkipReason(f TriggerFilters, commit CommitInfo) string {
+	message := strings.ToLower(commit.Message)
+	for _, marker := range skipMarkers {
+		if strings.Contains(message, marker) {
+			return "commit message contains " + marker
+		}
+	}
+	for _, pattern := range f.IgnoreMessages {
+		// Patterns were checked when the filters were saved.
+		if re, err := regexp.Compile(pattern); err == nil && re.MatchString(commit.Message) {
+			return fmt.Sprintf("commit message matches %q", pattern)
+		}
+	}
+	if !f.AllowBots && (botAuthors.MatchString(commit.Author) || botAuthors.MatchString(commit.AuthorEmail)) {
+		return fmt.Sprintf("commit author %s is a bot", commit.Author)
+	}
+	for _, pattern := range f.IgnoreAuthors {
+		re, err := regexp.Compile(pattern)
+		if err == nil && (re.MatchString(commit.Author) || re.MatchString(commit.AuthorEmail)) {
+			return fmt.Sprintf("commit author %s matches %q", commit.Author, pattern)
+		}
+	}
+	return ""
+}
+
+// filterTrigger applies repoURL's filters to a pushed commit, returning
+// and recording why it is skipped, or "" if it should be built.
+func filterTrigger(repoURL, source, commitID string, commit CommitInfo) string {
+	f, err := getTriggerFilters(repoURL)
+	if err != nil {
+		// Build rather than silently drop the push.
+		log.Printf("Error getting trigger filters of %s: %v", repoURL, err)
+		return ""
+	}
+	reason := triggerSkipReason(f, commit)
+	if reason == "" {
+		return ""
+	}
+	log.Printf("Not building %s at %s: %s", repoURL, commitID, reason)
+	_, err = db.Exec("INSERT INTO skipped_triggers (repo_url, source, commit_id, author, message, reason, timestamp) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		repoURL, source, commitID, commit.Author, commit.Message, reason, time.Now().UTC())
+	if err != nil {
+		log.Printf("Error recording skipped trigger: %v", err)
+	}
+	return reason
+}
+
+func getSkippedTriggers(repoURL string, limit int) ([]SkippedTrigger, error) {
+	rows, err := db.Query("SELECT repo_url, source, commit_id, author, message, reason, timestamp FROM skipped_triggers WHERE (? = '' OR repo_url = ?) ORDER BY timestamp DESC LIMIT ?",
+		repoURL, repoURL, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	skipped := []SkippedTrigger{}
+	for rows.Next() {
+		var s SkippedTrigger
+		if err := rows.Scan(&s.RepoUrl, &s.Source, &s.CommitID, &s.Author, &s.Message, &s.Reason, &s.Timestamp); err != nil {
+			return nil, err
+		}
+		skipped = append(skipped, s)
+	}
+	return skipped, rows.Err()
+}
+
+func getTriggerFiltersHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	repoURL := r.URL.Query().Get("repo")
+	if err := validateRepoURL(repoURL); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f, err := getTriggerFilters(repoURL)
+	if err != nil {
+		http.Error(w, "Could not get trigger filters", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(f)
+}
+
+func setTriggerFiltersHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	var f TriggerFilters
+	if err := json.NewDecoder(r.Body).Decode(&f); err != nil || f.RepoUrl == "" {
+		http.Error(w, "Request must contain repoUrl", http.StatusBadRequest)
+		return
+	}
+	if err := validateRepoURL(f.RepoUrl); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validateTriggerFilters(f); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := saveTriggerFilters(f); err != nil {
+		http.Error(w, "Could not save trigger filters", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(f)
+}
+
+// skippedTriggersHandler lists the latest commits that were not built,
+// optionally only those of ?repo=.
+func skippedTriggersHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	limit, ok := queryInt(r, "limit", 20)
+	if !ok || limit == 0 || limit > maxHistoryLimit {
+		http.Error(w, "limit must be between 1 and 100", http.StatusBadRequest)
+		return
+	}
+	skipped, err := getSkippedTriggers(r.URL.Query().Get("repo"), limit)
+	if err != nil {
+		http.Error(w, "Could not get skipped triggers", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(skipped)
+}
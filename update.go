@@ -0,0 +1,232 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ReleaseManifest describes the latest release; it is served at
+// UPDATE_CHECK_URL.
+type ReleaseManifest struct {
+	Version string `json:"version"`
+	// Assets maps "os/arch" to the server binary for that platform.
+	Assets map[string]ReleaseAsset `json:"assets"`
+}
+
+type ReleaseAsset struct {
+	URL    string `json:"url"`
+	SHA256 string `json:"sha256"`
+	// Signature is the base64 Ed25519 signature of the binary, checked
+	// against the base64 public key in UPDATE_PUBLIC_KEY.
+	Signature string `json:"signature"`
+}
+
+// releaseCheckInterval is how long a fetched manifest is reused by
+// /api/version.
+const releaseCheckInterval = time.Hour
+
+const maxReleaseSize = 512 << 20
+
+var updateClient = &http.Client{Timeout: 5 * time.Minute}
+
+// releaseCheckClient fetches the manifest, which /api/version waits for,
+// so it gives up long before updateClient does.
+var releaseCheckClient = &http.Client{Timeout: 10 * time.Second}
+
+var latestRelease struct {
+	sync.Mutex
+	manifest *ReleaseManifest
+	checked  time.Time
+}
+
+// draining is set once an update is installed: new builds are refused
+// until the queue empties and the server restarts into the new binary.
+var draining atomic.Bool
+
+func rejectDraining(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", strconv.Itoa(queueRetryAfter))
+	http.Error(w, "Server is restarting for an update", http.StatusServiceUnavailable)
+}
+
+func fetchLatestRelease() (*ReleaseManifest, error) {
+	resp, err := releaseCheckClient.Get(os.Getenv("UPDATE_CHECK_URL"))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("release check returned %s", resp.Status)
+	}
+	var manifest ReleaseManifest
+	if err := json.NewDecoder(resp.Body).Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("could not parse release manifest: %v", err)
+	}
+	return &manifest, nil
+}
+
+// cachedLatestRelease returns the latest release, fetching it at most once
+// per releaseCheckInterval. The lock is not held while fetching, so a slow
+// release check doesn't hold up callers served from the cache.
+func cachedLatestRelease() (*ReleaseManifest, error) {
+	latestRelease.Lock()
+	manifest, checked := latestRelease.manifest, latestRelease.checked
+	latestRelease.Unlock()
+	if manifest != nil && time.Since(checked) < releaseCheckInterval {
+		return manifest, nil
+	}
+	manifest, err := fetchLatestRelease()
+	if err != nil {
+		return nil, err
+	}
+	latestRelease.Lock()
+	latestRelease.manifest, latestRelease.checked = manifest, time.Now()
+	latestRelease.Unlock()
+	return manifest, nil
+}
+
+// newerRelease reports whether release is newer than the running version.
+func newerRelease(release string) bool {
+	return compareVersions(strings.TrimPrefix(release, "v"), strings.TrimPrefix(version, "v")) > 0
+}
+
+// downloadRelease fetches asset and checks its checksum and signature.
+func downloadRelease(asset ReleaseAsset) ([]byte, error) {
+	publicKey, err := base64.StdEncoding.DecodeString(os.Getenv("UPDATE_PUBLIC_KEY"))
+	if err != nil || len(publicKey) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("UPDATE_PUBLIC_KEY is not a base64 Ed25519 public key")
+	}
+	signature, err := base64.StdEncoding.DecodeString(asset.Signature)
+	if err != nil {
+		return nil, fmt.Errorf("release signature is not base64: %v", err)
+	}
+
+	resp, err := updateClient.Get(asset.URL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("download returned %s", resp.Status)
+	}
+	binary, err := io.ReadAll(io.LimitReader(resp.Body, maxReleaseSize))
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(binary)
+	if !strings.EqualFold(hex.EncodeToString(sum[:]), asset.SHA256) {
+		return nil, fmt.Errorf("release checksum mismatch")
+	}
+	if !ed25519.Verify(publicKey, binary, signature) {
+		return nil, fmt.Errorf("release signature does not verify")
+	}
+	return binary, nil
+}
+
+// installRelease writes binary next to the running executable and swaps
+// it into place, returning the executable's path.
+func installRelease(binary []byte) (string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return "", err
+	}
+	newPath := exe + ".new"
+	if err := os.WriteFile(newPath, binary, 0755); err != nil {
+		return "", err
+	}
+	if err := replaceExecutable(exe, newPath); err != nil {
+		os.Remove(newPath)
+		return "", err
+	}
+	return exe, nil
+}
+
+// restartWhenIdle waits for queued and running builds to finish, then
+// restarts into exe.
+func restartWhenIdle(exe string) {
+	for {
+		stats := queue.Stats()
+		if stats.Running == 0 && stats.Queued == 0 {
+			break
+		}
+		time.Sleep(time.Second)
+	}
+	log.Printf("Restarting into updated binary %s", exe)
+	if err := restartSelf(exe); err != nil {
+		log.Fatalf("Could not restart after update: %v", err)
+	}
+}
+
+// updateHandler installs the latest release and restarts into it once the
+// build queue drains. It needs UPDATE_CHECK_URL, UPDATE_PUBLIC_KEY and the
+// admin token.
+func updateHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if !authorizeAdmin(w, r) {
+		return
+	}
+	if os.Getenv("UPDATE_CHECK_URL") == "" || os.Getenv("UPDATE_PUBLIC_KEY") == "" {
+		http.Error(w, "Self-update is not enabled", http.StatusForbidden)
+		return
+	}
+	if draining.Load() {
+		http.Error(w, "An update is already being installed", http.StatusConflict)
+		return
+	}
+
+	manifest, err := fetchLatestRelease()
+	if err != nil {
+		log.Printf("Error checking for updates: %v", err)
+		http.Error(w, "Could not check for updates", http.StatusBadGateway)
+		return
+	}
+	if !newerRelease(manifest.Version) {
+		json.NewEncoder(w).Encode(map[string]string{"status": "up-to-date", "version": version})
+		return
+	}
+	asset, ok := manifest.Assets[runtime.GOOS+"/"+runtime.GOARCH]
+	if !ok {
+		http.Error(w, "Release has no binary for "+runtime.GOOS+"/"+runtime.GOARCH, http.StatusNotFound)
+		return
+	}
+	binary, err := downloadRelease(asset)
+	if err != nil {
+		log.Printf("Error downloading release %s: %v", manifest.Version, err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	if !draining.CompareAndSwap(false, true) {
+		http.Error(w, "An update is already being installed", http.StatusConflict)
+		return
+	}
+	exe, err := installRelease(binary)
+	if err != nil {
+		draining.Store(false)
+		log.Printf("Error installing release %s: %v", manifest.Version, err)
+		http.Error(w, "Could not install update", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Installed release %s, restarting once the build queue drains", manifest.Version)
+	go restartWhenIdle(exe)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{"status": "restarting", "version": manifest.Version})
+}
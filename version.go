@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"runtime"
+	"runtime/debug"
+)
+
+// Set at release time with -ldflags "-X main.version=... -X main.commit=...".
+// Builds from a git checkout fall back to the VCS stamp Go embeds.
+var (
+	version = "dev"
+	commit  = ""
+)
+
+type VersionInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	Modified  bool   `json:"modified,omitempty"`
+	GoVersion string `json:"goVersion"`
+	Platform  string `json:"platform"`
+	// Latest and UpdateAvailable are reported when UPDATE_CHECK_URL is set.
+	Latest          string `json:"latest,omitempty"`
+	UpdateAvailable bool   `json:"updateAvailable,omitempty"`
+}
+
+func versionInfo() VersionInfo {
+	info := VersionInfo{
+		Version:   version,
+		Commit:    commit,
+		GoVersion: runtime.Version(),
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok && info.Commit == "" {
+		for _, s := range bi.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				info.Commit = s.Value
+			case "vcs.modified":
+				info.Modified = s.Value == "true"
+			}
+		}
+	}
+	return info
+}
+
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	info := versionInfo()
+	if os.Getenv("UPDATE_CHECK_URL") != "" {
+		if manifest, err := cachedLatestRelease(); err != nil {
+			log.Printf("Error checking for updates: %v", err)
+		} else {
+			info.Latest = manifest.Version
+			info.UpdateAvailable = newerRelease(manifest.Version)
+		}
+	}
+	json.NewEncoder(w).Encode(info)
+}
@@ -0,0 +1,431 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// maxWebhookBody is the largest payload GitHub delivers, and more than
+// Bitbucket does.
+const maxWebhookBody = 25 << 20
+
+// WebhookSettings say how pushes to a repository trigger builds.
+type WebhookSettings struct {
+	RepoUrl string `json:"repoUrl"`
+	// Secret signs deliveries. It is never returned; HasSecret tells
+	// whether one is set.
+	Secret    string `json:"secret,omitempty"`
+	HasSecret bool   `json:"hasSecret"`
+	// Branch is the branch whose pushes are built, by default the
+	// repository's default branch.
+	Branch string `json:"branch,omitempty"`
+	// AutoBuild turns push-triggered builds on.
+	AutoBuild bool `json:"autoBuild"`
+	// Token authenticates calls to the provider's API, such as pull
+	// request comments. Like Secret it is never returned.
+	Token    string `json:"token,omitempty"`
+	HasToken bool   `json:"hasToken"`
+	// DependencyBots builds pull requests opened by dependency update
+	// bots and comments on them with the image's size and known
+	// vulnerabilities compared with the branch they target.
+	DependencyBots bool `json:"dependencyBots"`
+	// DependencyBotScans runs the secret and license scans, which are
+	// otherwise skipped, on dependency bot builds.
+	DependencyBotScans bool `json:"dependencyBotScans"`
+	// PullRequests builds every pull request from a branch of the
+	// repository and comments on it with the result.
+	PullRequests bool `json:"pullRequests"`
+}
+
+// WebhookResponse tells the sender what became of a delivery.
+type WebhookResponse struct {
+	Status  string `json:"status"`
+	Reason  string `json:"reason,omitempty"`
+	BuildId string `json:"buildId,omitempty"`
+}
+
+// Webhook delivery outcomes.
+const (
+	WebhookQueued  = "queued"
+	WebhookIgnored = "ignored"
+)
+
+func getWebhookSettings(repoURL string) (WebhookSettings, error) {
+	return findWebhookSettings(repoURL)
+}
+
+// findWebhookSettings returns the settings of whichever of repoURLs, the
+// clone URLs a provider reports for one repository, has them.
+func findWebhookSettings(repoURLs ...string) (WebhookSettings, error) {
+	var s WebhookSettings
+	var placeholders []string
+	var args []interface{}
+	for _, u := range repoURLs {
+		if u != "" {
+			placeholders = append(placeholders, "?")
+			args = append(args, u)
+		}
+	}
+	if len(args) == 0 {
+		return s, sql.ErrNoRows
+	}
+	err := db.QueryRow("SELECT repo_url, secret, branch, auto_build, token, dependency_bots, dependency_bot_scans, pull_requests FROM webhook_settings WHERE repo_url IN ("+strings.Join(placeholders, ", ")+") LIMIT 1", args...).
+		Scan(&s.RepoUrl, &s.Secret, &s.Branch, &s.AutoBuild, &s.Token, &s.DependencyBots, &s.DependencyBotScans, &s.PullRequests)
+	s.HasSecret, s.HasToken = s.Secret != "", s.Token != ""
+	registerSecrets(s.Secret, s.Token)
+	return s, err
+}
+
+func saveWebhookSettings(s WebhookSettings) error {
+	registerSecrets(s.Secret, s.Token)
+	_, err := db.Exec("INSERT OR REPLACE INTO webhook_settings (repo_url, secret, branch, auto_build, token, dependency_bots, dependency_bot_scans, pull_requests) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		s.RepoUrl, s.Secret, s.Branch, s.AutoBuild, s.Token, s.DependencyBots, s.DependencyBotScans, s.PullRequests)
+	return err
+}
+
+func getWebhookSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	repoURL := r.URL.Query().Get("repo")
+	if err := validateRepoURL(repoURL); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s, err := getWebhookSettings(repoURL)
+	if err == sql.ErrNoRows {
+		http.Error(w, "No webhook configured for repository", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Could not get webhook settings", http.StatusInternalServerError)
+		return
+	}
+	s.Secret, s.Token = "", ""
+	json.NewEncoder(w).Encode(s)
+}
+
+// setWebhookSettingsHandler saves a repository's webhook settings. An
+// empty secret or token keeps the one already set.
+func setWebhookSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	var s WebhookSettings
+	if err := json.NewDecoder(r.Body).Decode(&s); err != nil || s.RepoUrl == "" {
+		http.Error(w, "Request must contain repoUrl", http.StatusBadRequest)
+		return
+	}
+	if err := validateRepoURL(s.RepoUrl); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if s.Branch != "" {
+		if err := validateBranch(s.Branch); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if s.Secret == "" || s.Token == "" {
+		existing, err := getWebhookSettings(s.RepoUrl)
+		if err != nil && err != sql.ErrNoRows {
+			http.Error(w, "Could not get webhook settings", http.StatusInternalServerError)
+			return
+		}
+		if s.Secret == "" {
+			s.Secret = existing.Secret
+		}
+		if s.Token == "" {
+			s.Token = existing.Token
+		}
+	}
+	if err := saveWebhookSettings(s); err != nil {
+		http.Error(w, "Could not save webhook settings", http.StatusInternalServerError)
+		return
+	}
+	s.HasSecret, s.HasToken = s.Secret != "", s.Token != ""
+	s.Secret, s.Token = "", ""
+	json.NewEncoder(w).Encode(s)
+}
+
+// readWebhookBody reads a delivery, which must be read whole to check its
+// signature.
+func readWebhookBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxWebhookBody+1))
+	if err != nil {
+		http.Error(w, "Could not read payload", http.StatusBadRequest)
+		return nil, false
+	}
+	if len(body) > maxWebhookBody {
+		http.Error(w, "Payload too large", http.StatusRequestEntityTooLarge)
+		return nil, false
+	}
+	return body, true
+}
+
+// PushedCommit is the new head of a branch a push updated.
+type PushedCommit struct {
+	ID     string
+	Commit CommitInfo
+}
+
+// triggerPush builds the repository's branch if a push updated it and
+// the repository's webhook settings and trigger filters allow it.
+// pushed maps branch names to their new heads.
+func triggerPush(w http.ResponseWriter, s WebhookSettings, provider, deliveryId string, pushed map[string]PushedCommit) {
+	ignore := func(reason string) {
+		json.NewEncoder(w).Encode(WebhookResponse{Status: WebhookIgnored, Reason: reason})
+	}
+	if !s.AutoBuild {
+		ignore("autoBuild is off for " + s.RepoUrl)
+		return
+	}
+	branch := s.Branch
+	if branch == "" {
+		var err error
+		if branch, err = defaultBranch(s.RepoUrl); err != nil {
+			log.Printf("Error detecting default branch of %s: %v", s.RepoUrl, err)
+			http.Error(w, "Could not detect default branch", http.StatusBadGateway)
+			return
+		}
+	}
+	head, ok := pushed[branch]
+	if !ok {
+		ignore("push does not update branch " + branch)
+		return
+	}
+	if reason := filterTrigger(s.RepoUrl, TriggerWebhook, head.ID, head.Commit); reason != "" {
+		ignore(reason)
+		return
+	}
+
+	// Build the pushed commit, not whatever the branch points to once the
+	// build starts, which may be a later push.
+	req := BuildRequest{RepoUrl: s.RepoUrl, Branch: branch, Commit: head.ID, Trigger: &Trigger{Source: TriggerWebhook, Provider: provider, DeliveryId: deliveryId}}
+	if buildId, ok := queueWebhookBuild(w, req, nil); ok {
+		log.Printf("Triggered build %s of %s on push of %s", buildId, s.RepoUrl, head.ID)
+	}
+}
+
+// queueWebhookBuild queues req and answers the delivery with its build
+// ID. Deliveries are idempotent by delivery ID, so a redelivery gets the
+// build queued first. prepare, if set, runs before a new build is
+// queued.
+func queueWebhookBuild(w http.ResponseWriter, req BuildRequest, prepare func(buildId string) error) (string, bool) {
+	if err := validateBuildRequest(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return "", false
+	}
+	if draining.Load() {
+		rejectDraining(w)
+		return "", false
+	}
+
+	var key string
+	if req.Trigger.DeliveryId != "" {
+		key = req.Trigger.Provider + ":" + req.Trigger.DeliveryId
+		if buildId, ok := lookupIdempotencyKey(key); ok {
+			json.NewEncoder(w).Encode(WebhookResponse{Status: WebhookQueued, BuildId: buildId})
+			return "", false
+		}
+	}
+	buildId := uuid.New().String()
+	if key != "" {
+		owner, err := claimIdempotencyKey(key, buildId)
+		if err != nil {
+			http.Error(w, "Could not record delivery", http.StatusInternalServerError)
+			return "", false
+		}
+		if owner != buildId {
+			json.NewEncoder(w).Encode(WebhookResponse{Status: WebhookQueued, BuildId: owner})
+			return "", false
+		}
+	}
+	if prepare != nil {
+		if err := prepare(buildId); err != nil {
+			releaseIdempotencyKey(key, buildId)
+			log.Printf("Error preparing build %s: %v", buildId, err)
+			http.Error(w, "Could not queue build", http.StatusInternalServerError)
+			return "", false
+		}
+	}
+	if !enqueueBuild(buildId, req) {
+		releaseIdempotencyKey(key, buildId)
+		rejectQueueFull(w)
+		return "", false
+	}
+	json.NewEncoder(w).Encode(WebhookResponse{Status: WebhookQueued, BuildId: buildId})
+	return buildId, true
+}
+
+// githubPush holds the parts of a GitHub push event the server uses.
+type githubPush struct {
+	Ref        string `json:"ref"`
+	After      string `json:"after"`
+	Deleted    bool   `json:"deleted"`
+	HeadCommit *struct {
+		ID        string    `json:"id"`
+		Message   string    `json:"message"`
+		Timestamp time.Time `json:"timestamp"`
+		Author    struct {
+			Name  string `json:"name"`
+			Email string `json:"email"`
+		} `json:"author"`
+	} `json:"head_commit"`
+	Repository struct {
+		CloneURL string `json:"clone_url"`
+		SSHURL   string `json:"ssh_url"`
+		HTMLURL  string `json:"html_url"`
+		GitURL   string `json:"git_url"`
+	} `json:"repository"`
+}
+
+// githubPullRequest holds the parts of a GitHub pull_request event the
+// server uses.
+type githubPullRequest struct {
+	Action      string `json:"action"`
+	Number      int    `json:"number"`
+	PullRequest struct {
+		User struct {
+			Login string `json:"login"`
+		} `json:"user"`
+		Head struct {
+			Ref  string `json:"ref"`
+			SHA  string `json:"sha"`
+			Repo struct {
+				FullName string `json:"full_name"`
+			} `json:"repo"`
+		} `json:"head"`
+		Base struct {
+			Ref string `json:"ref"`
+		} `json:"base"`
+	} `json:"pull_request"`
+	Repository struct {
+		FullName string `json:"full_name"`
+	} `json:"repository"`
+}
+
+// triggerPullRequest builds pull requests, all of them with pullRequests
+// set or only those opened by dependency update bots with dependencyBots
+// set, and records the pull request so the result is commented on it.
+// Dependency bot pull requests are built without scans unless the
+// repository asks for them.
+func triggerPullRequest(w http.ResponseWriter, s WebhookSettings, deliveryId string, body []byte) {
+	ignore := func(reason string) {
+		json.NewEncoder(w).Encode(WebhookResponse{Status: WebhookIgnored, Reason: reason})
+	}
+	var event githubPullRequest
+	if err := json.Unmarshal(body, &event); err != nil {
+		http.Error(w, "Invalid payload", http.StatusBadRequest)
+		return
+	}
+	pr := event.PullRequest
+	dependencyBot := s.DependencyBots && botAuthors.MatchString(pr.User.Login)
+	switch {
+	case !s.PullRequests && !s.DependencyBots:
+		ignore("pullRequests and dependencyBots are off for " + s.RepoUrl)
+		return
+	case event.Action != "opened" && event.Action != "synchronize" && event.Action != "reopened":
+		ignore("pull request " + event.Action)
+		return
+	case !s.PullRequests && !dependencyBot:
+		ignore("pull request author " + pr.User.Login + " is not a dependency bot")
+		return
+	case pr.Head.Repo.FullName != event.Repository.FullName:
+		// The head branch of a fork cannot be cloned from the repository.
+		ignore("pull request is from a fork")
+		return
+	}
+
+	req := BuildRequest{
+		RepoUrl:   s.RepoUrl,
+		Branch:    pr.Head.Ref,
+		Commit:    pr.Head.SHA,
+		SkipScans: dependencyBot && !s.DependencyBotScans,
+		Trigger:   &Trigger{Source: TriggerWebhook, Provider: "github", DeliveryId: deliveryId, PullRequest: event.Number},
+	}
+	buildId, ok := queueWebhookBuild(w, req, func(buildId string) error {
+		return savePullRequestBuild(PullRequestBuild{BuildId: buildId, Provider: "github", Repository: event.Repository.FullName, Number: event.Number, BaseBranch: pr.Base.Ref})
+	})
+	if ok {
+		log.Printf("Triggered build %s of %s for pull request #%d", buildId, s.RepoUrl, event.Number)
+	}
+}
+
+// validSignature checks a "sha256=" signature header, an HMAC of the
+// body keyed with the webhook secret, as GitHub and Bitbucket send.
+func validSignature(secret string, body []byte, header string) bool {
+	sig, ok := strings.CutPrefix(header, "sha256=")
+	if !ok || secret == "" {
+		return false
+	}
+	got, err := hex.DecodeString(sig)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(got, mac.Sum(nil))
+}
+
+// githubWebhookHandler builds the configured branch of a repository when
+// GitHub reports a push to it.
+func githubWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	body, ok := readWebhookBody(w, r)
+	if !ok {
+		return
+	}
+	var push githubPush
+	if err := json.Unmarshal(body, &push); err != nil {
+		http.Error(w, "Invalid payload", http.StatusBadRequest)
+		return
+	}
+	repo := push.Repository
+	s, err := findWebhookSettings(repo.CloneURL, repo.SSHURL, repo.HTMLURL, repo.GitURL)
+	if err == sql.ErrNoRows {
+		http.Error(w, "No webhook configured for repository", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Could not get webhook settings", http.StatusInternalServerError)
+		return
+	}
+	if !validSignature(s.Secret, body, r.Header.Get("X-Hub-Signature-256")) {
+		log.Printf("Rejected GitHub delivery %s for %s: bad signature", r.Header.Get("X-GitHub-Delivery"), s.RepoUrl)
+		http.Error(w, "Invalid signature", http.StatusUnauthorized)
+		return
+	}
+
+	switch event := r.Header.Get("X-GitHub-Event"); event {
+	case "ping":
+		json.NewEncoder(w).Encode(WebhookResponse{Status: "pong"})
+		return
+	case "push":
+	case "pull_request":
+		triggerPullRequest(w, s, r.Header.Get("X-GitHub-Delivery"), body)
+		return
+	default:
+		json.NewEncoder(w).Encode(WebhookResponse{Status: WebhookIgnored, Reason: "event " + event + " is not handled"})
+		return
+	}
+	if push.Deleted || push.HeadCommit == nil {
+		json.NewEncoder(w).Encode(WebhookResponse{Status: WebhookIgnored, Reason: "push has no head commit"})
+		return
+	}
+
+	branch, ok := strings.CutPrefix(push.Ref, "refs/heads/")
+	if !ok {
+		json.NewEncoder(w).Encode(WebhookResponse{Status: WebhookIgnored, Reason: push.Ref + " is not a branch"})
+		return
+	}
+	head := push.HeadCommit
+	commit := CommitInfo{Author: head.Author.Name, AuthorEmail: head.Author.Email, Message: head.Message, CommittedAt: head.Timestamp}
+	triggerPush(w, s, "github", r.Header.Get("X-GitHub-Delivery"), map[string]PushedCommit{branch: {ID: head.ID, Commit: commit}})
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// WorkerRequirements are the labels a host must have to build a
+// repository, such as arch=arm64, gpu=true or region=eu.
+type WorkerRequirements struct {
+	RepoUrl string            `json:"repoUrl"`
+	Labels  map[string]string `json:"labels"`
+}
+
+// NoMatchingWorkerError fails a build that this server may not run.
+type NoMatchingWorkerError struct {
+	Missing []string
+}
+
+func (e *NoMatchingWorkerError) Error() string {
+	return "no matching worker: this server lacks " + strings.Join(e.Missing, ", ")
+}
+
+// workerLabels describes this server for routing: its os and arch, and
+// the labels in WORKER_LABELS, a comma-separated list of name=value
+// pairs that may also replace those two.
+func workerLabels() map[string]string {
+	labels := map[string]string{"os": runtime.GOOS, "arch": runtime.GOARCH}
+	for _, pair := range strings.Split(os.Getenv("WORKER_LABELS"), ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(pair), "=")
+		if name != "" {
+			labels[strings.TrimSpace(name)] = strings.TrimSpace(value)
+		}
+	}
+	return labels
+}
+
+func validateWorkerLabels(labels map[string]string) error {
+	for name, value := range labels {
+		if name == "" || strings.ContainsAny(name, "=, \t\n") {
+			return fmt.Errorf("invalid worker label name %q", name)
+		}
+		if strings.ContainsAny(value, ",\n") {
+			return fmt.Errorf("invalid value %q for worker label %s", value, name)
+		}
+	}
+	return nil
+}
+
+// getWorkerRequirements returns the labels repoURL requires, or none.
+func getWorkerRequirements(repoURL string) (map[string]string, error) {
+	var body string
+	err := db.QueryRow("SELECT labels FROM worker_requirements WHERE repo_url = ?", repoURL).Scan(&body)
+	if err != nil {
+		return nil, err
+	}
+	var labels map[string]string
+	err = json.Unmarshal([]byte(body), &labels)
+	return labels, err
+}
+
+func saveWorkerRequirements(repoURL string, labels map[string]string) error {
+	body, err := json.Marshal(labels)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("INSERT OR REPLACE INTO worker_requirements (repo_url, labels) VALUES (?, ?)", repoURL, string(body))
+	return err
+}
+
+// matchWorker fails with NoMatchingWorkerError unless this server has
+// every label repoURL requires.
+func matchWorker(repoURL string) error {
+	required, err := getWorkerRequirements(repoURL)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	have := workerLabels()
+	var missing []string
+	for name, value := range required {
+		if have[name] != value {
+			missing = append(missing, name+"="+value)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	sort.Strings(missing)
+	return &NoMatchingWorkerError{Missing: missing}
+}
+
+func setWorkerRequirementsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	var req WorkerRequirements
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RepoUrl == "" {
+		http.Error(w, "Request must contain repoUrl and labels", http.StatusBadRequest)
+		return
+	}
+	if err := validateRepoURL(req.RepoUrl); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validateWorkerLabels(req.Labels); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := saveWorkerRequirements(req.RepoUrl, req.Labels); err != nil {
+		http.Error(w, "Could not save worker requirements", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(req)
+}
+
+func getWorkerRequirementsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	repoURL := r.URL.Query().Get("repo")
+	if err := validateRepoURL(repoURL); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	labels, err := getWorkerRequirements(repoURL)
+	if err == sql.ErrNoRows {
+		http.Error(w, "No worker requirements configured for repository", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Could not get worker requirements", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(WorkerRequirements{RepoUrl: repoURL, Labels: labels})
+}